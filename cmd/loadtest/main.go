@@ -0,0 +1,190 @@
+// Command loadtest fills a server with rooms of simulated typists and reports
+// how fast their code updates reach the other members, how many never arrive,
+// and what the load costs the server in goroutines and heap.
+//
+// Without -url it starts the server in-process against a fake LeetCode and a
+// fake execution engine; run it from the repository root so the server finds
+// its templates. The goroutines and heap of an in-process run include the
+// simulated members.
+//
+//	go run ./cmd/loadtest -rooms 50 -typists 2 -duration 30s -exec-interval 5s
+//	go run ./cmd/loadtest -url http://localhost:3000 -rooms 20
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode/leetcodetest"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server/servertest"
+)
+
+// options of a load test run
+type options struct {
+	URL           string
+	Rooms         int
+	Typists       int
+	Duration      time.Duration
+	Rate          float64
+	CodeSize      int
+	Ramp          time.Duration
+	ExecInterval  time.Duration
+	EngineLatency time.Duration
+	Settle        time.Duration
+	SampleEvery   time.Duration
+	TemplateDir   string
+	JSON          bool
+}
+
+func parseOptions(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.StringVar(&opts.URL, "url", "", "Server to load; empty starts one in-process with a fake engine and LeetCode")
+	fs.IntVar(&opts.Rooms, "rooms", 10, "Rooms to open")
+	fs.IntVar(&opts.Typists, "typists", 2, "Members typing in every room; the server's ROOM_CAPACITY must allow them")
+	fs.DurationVar(&opts.Duration, "duration", 30*time.Second, "How long the members type")
+	fs.Float64Var(&opts.Rate, "rate", 5, "Code updates every typist sends per second")
+	fs.IntVar(&opts.CodeSize, "code-size", 512, "Bytes of code in every update")
+	fs.DurationVar(&opts.Ramp, "ramp", 0, "Time over which the rooms are opened")
+	fs.DurationVar(&opts.ExecInterval, "exec-interval", 0, "Every room runs its code this often; 0 runs nothing")
+	fs.DurationVar(&opts.EngineLatency, "engine-latency", 200*time.Millisecond, "Run time of the fake engine of an in-process server")
+	fs.DurationVar(&opts.Settle, "settle", 5*time.Second, "How long to wait for the last updates after typing stops")
+	fs.DurationVar(&opts.SampleEvery, "sample-every", time.Second, "How often the server's metrics are sampled")
+	fs.StringVar(&opts.TemplateDir, "template-dir", "templates", "Templates of an in-process server")
+	fs.BoolVar(&opts.JSON, "json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	switch {
+	case opts.Rooms < 1:
+		return opts, fmt.Errorf("rooms must be at least 1")
+	case opts.Typists < 2:
+		return opts, fmt.Errorf("typists must be at least 2 so every update has a receiver")
+	case opts.Duration <= 0:
+		return opts, fmt.Errorf("duration must be positive")
+	case opts.Rate <= 0:
+		return opts, fmt.Errorf("rate must be positive")
+	case opts.CodeSize < 0, opts.Ramp < 0, opts.ExecInterval < 0, opts.EngineLatency < 0, opts.Settle < 0:
+		return opts, fmt.Errorf("code-size, ramp, exec-interval, engine-latency and settle must not be negative")
+	case opts.SampleEvery <= 0:
+		return opts, fmt.Errorf("sample-every must be positive")
+	}
+	return opts, nil
+}
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(2)
+	}
+	lo := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	tgt, err := startTarget(opts)
+	if err != nil {
+		lo.Error("failed to start the target", "err", err)
+		os.Exit(1)
+	}
+
+	// Interrupting stops the typing early and still reports
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rep, err := run(ctx, opts, tgt, lo)
+	tgt.close()
+	if err != nil {
+		lo.Error("load test failed", "err", err)
+		os.Exit(1)
+	}
+
+	if opts.JSON {
+		err = rep.writeJSON(os.Stdout)
+	} else {
+		err = rep.writeText(os.Stdout)
+	}
+	if err != nil {
+		lo.Error("failed to write the report", "err", err)
+		os.Exit(1)
+	}
+	if !rep.Healthy() {
+		os.Exit(1)
+	}
+}
+
+// target is the server under load
+type target struct {
+	url    string
+	name   string
+	client *http.Client
+	close  func()
+}
+
+// startTarget uses the server at opts.URL or starts one in-process
+func startTarget(opts options) (*target, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if opts.URL != "" {
+		return &target{url: opts.URL, name: opts.URL, client: client, close: func() {}}, nil
+	}
+
+	// The server panics on missing templates, so fail with a hint instead
+	if pages, _ := filepath.Glob(filepath.Join(opts.TemplateDir, "*.html")); len(pages) == 0 {
+		return nil, fmt.Errorf("no templates in %q: run from the repository root or set -template-dir", opts.TemplateDir)
+	}
+
+	leetcode := leetcodetest.NewServer()
+	engine := servertest.NewEngine()
+	engine.SetRun(func(ex servertest.Execution) (servertest.Result, int) {
+		time.Sleep(opts.EngineLatency)
+		return servertest.Result{Stdout: ex.Stdin}, http.StatusOK
+	})
+
+	cfg := core.DefaultConfig()
+	cfg.TemplateDir = opts.TemplateDir
+	cfg.CodeRunnerEngine = engine.URL
+	cfg.LeetcodeURL = leetcode.GraphQLURL()
+	cfg.MaxRooms = max(cfg.MaxRooms, opts.Rooms)
+	cfg.RoomCapacity = opts.Typists
+	if err := cfg.Validate(); err != nil {
+		leetcode.Close()
+		engine.Close()
+		return nil, err
+	}
+
+	// Only the server's warnings, such as slow clients, are worth seeing. Rooms
+	// log through the default logger.
+	serverLog := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	slog.SetDefault(serverLog)
+	co := core.New(cfg, serverLog)
+	srv := &server.Server{Co: co}
+	httpSrv := httptest.NewServer(srv.Handler())
+
+	return &target{
+		url:    httpSrv.URL,
+		name:   fmt.Sprintf("in-process (engine latency %s)", opts.EngineLatency),
+		client: client,
+		close: func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			srv.Drain(ctx)
+			httpSrv.Close()
+			leetcode.Close()
+			engine.Close()
+		},
+	}, nil
+}
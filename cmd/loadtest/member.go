@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
+)
+
+// capabilities keep code updates in their plain form, so every update
+// carries the sequence number and send time of its typist
+var capabilities = []string{server.CapCodeBuffers, server.CapChat, server.CapPresence}
+
+// wsURLAttr finds the socket URL the room page hands to its script
+var wsURLAttr = regexp.MustCompile(`data-ws-url="([^"]+)"`)
+
+var dialer = websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+// room is a room of simulated members; the first one created it
+type room struct {
+	id      string
+	members []*member
+
+	executions execStats
+}
+
+// execStats counts the runs of a room
+type execStats struct {
+	mu      sync.Mutex
+	ok      int64
+	failed  int64
+	latency histogram
+}
+
+// member is a simulated room member typing code. Its socket is written by
+// its typist goroutine only and read by its reader goroutine.
+type member struct {
+	roomID string
+	userID string
+	token  string // Join token of the member's room page
+	conn   *websocket.Conn
+	sent   atomic.Int64 // Sequence number of the last update sent
+	closed chan struct{}
+
+	mu           sync.Mutex
+	last         map[string]int64 // Newest update seen from every other member
+	delivered    int64
+	outOfOrder   int64
+	outputs      int64
+	backpressure int64
+	errors       int64
+	latency      histogram
+	writeErr     error
+}
+
+// openRoom creates a room and connects typists members to it
+func openRoom(ctx context.Context, tgt *target, typists int) (*room, error) {
+	roomID, wsPath, err := roomPage(ctx, tgt, "/api/create-room", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	r := &room{id: roomID}
+	for i := range typists {
+		if i > 0 {
+			if _, wsPath, err = roomPage(ctx, tgt, "/api/join-room", url.Values{"room_id": {roomID}}); err != nil {
+				r.close()
+				return nil, err
+			}
+		}
+		m, err := connect(ctx, tgt, wsPath)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.members = append(r.members, m)
+	}
+	return r, nil
+}
+
+// close disconnects every member
+func (r *room) close() {
+	for _, m := range r.members {
+		m.conn.Close()
+		<-m.closed
+	}
+}
+
+// roomPage posts form to path like the home page does and reads the room ID
+// and socket path from the room page
+func roomPage(ctx context.Context, tgt *target, path string, form url.Values) (roomID, wsPath string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tgt.url+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tgt.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("POST %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("POST %s: status %d", path, resp.StatusCode)
+	}
+
+	m := wsURLAttr.FindSubmatch(body)
+	if m == nil {
+		return "", "", fmt.Errorf("POST %s: no socket URL in the room page", path)
+	}
+	wsPath = html.UnescapeString(string(m[1]))
+	u, err := url.Parse(wsPath)
+	if err != nil {
+		return "", "", fmt.Errorf("POST %s: bad socket URL %q", path, wsPath)
+	}
+	return u.Query().Get("room_id"), wsPath, nil
+}
+
+// connect opens a socket on wsPath and completes the hello handshake
+func connect(ctx context.Context, tgt *target, wsPath string) (*member, error) {
+	conn, _, err := dialer.DialContext(ctx, "ws"+strings.TrimPrefix(tgt.url, "http")+wsPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	err = conn.WriteJSON(server.WebSocketMessage{
+		Type:    server.TypeHello,
+		Content: map[string]any{"version": server.MaxProtocolVersion, "capabilities": capabilities},
+	})
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for err == nil {
+		var msg server.WebSocketMessage
+		if err = conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type != server.TypeSync {
+			continue
+		}
+
+		conn.SetReadDeadline(time.Time{})
+		m := &member{
+			roomID: msg.RoomID,
+			userID: msg.UserID,
+			token:  joinToken(wsPath),
+			conn:   conn,
+			closed: make(chan struct{}),
+			last:   make(map[string]int64),
+		}
+		go m.read()
+		return m, nil
+	}
+	conn.Close()
+	return nil, fmt.Errorf("joining: %w", err)
+}
+
+// joinToken reads the join token from a socket path
+func joinToken(wsPath string) string {
+	u, err := url.Parse(wsPath)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("token")
+}
+
+// read records every message from the server until the socket closes
+func (m *member) read() {
+	defer close(m.closed)
+	for {
+		_, data, err := m.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		var msg server.WebSocketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		switch msg.Type {
+		case server.TypeCode:
+			m.recordCode(msg, received)
+		case server.TypeExecutionOutput:
+			m.outputs++
+		case server.TypeBackpressure:
+			m.backpressure++
+		case server.TypeError:
+			m.errors++
+		}
+		m.mu.Unlock()
+	}
+}
+
+// recordCode measures the latency of another member's update. Caller must hold m.mu.
+func (m *member) recordCode(msg server.WebSocketMessage, received time.Time) {
+	code, _ := msg.Content.(string)
+	var seq, sentAt int64
+	if _, err := fmt.Sscanf(code, "%d %d", &seq, &sentAt); err != nil || msg.UserID == m.userID {
+		return
+	}
+
+	if seq <= m.last[msg.UserID] {
+		m.outOfOrder++
+		return
+	}
+	m.last[msg.UserID] = seq
+	m.delivered++
+	m.latency.observe(received.Sub(time.Unix(0, sentAt)))
+}
+
+// typeCode sends rate code updates per second of size bytes until ctx is done
+func (m *member) typeCode(ctx context.Context, rate float64, size int) {
+	interval := time.Duration(float64(time.Second) / rate)
+
+	// Typists start out of step, like people do
+	select {
+	case <-time.After(rand.N(interval)):
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		seq := m.sent.Load() + 1
+		code := fmt.Sprintf("%d %d\n", seq, time.Now().UnixNano())
+		if pad := size - len(code); pad > 0 {
+			code += strings.Repeat("x", pad)
+		}
+
+		m.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		err := m.conn.WriteJSON(server.WebSocketMessage{Type: server.TypeCode, RoomID: m.roomID, Content: code})
+		if err != nil {
+			m.mu.Lock()
+			m.writeErr = err
+			m.mu.Unlock()
+			return
+		}
+		m.sent.Store(seq)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// execute runs code as the room's creator every interval until ctx is done.
+// The fake engine prints the stdin back; a real one runs the Python.
+func (r *room) execute(ctx context.Context, tgt *target, interval time.Duration) {
+	select {
+	case <-time.After(rand.N(interval)):
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.runOnce(ctx, tgt)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *room) runOnce(ctx context.Context, tgt *target) {
+	payload, _ := json.Marshal(server.ExecuteCodeRequest{
+		Language: "python",
+		Code:     "print(input())",
+		Stdin:    "loadtest",
+		RoomID:   r.id,
+	})
+
+	start := time.Now()
+	status := 0
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, tgt.url+"/api/execute-code", bytes.NewReader(payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+r.members[0].token)
+		var resp *http.Response
+		if resp, err = tgt.client.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+	}
+
+	r.executions.mu.Lock()
+	defer r.executions.mu.Unlock()
+	if status != http.StatusOK {
+		r.executions.failed++
+		return
+	}
+	r.executions.ok++
+	r.executions.latency.observe(time.Since(start))
+}
+
+// settled tells whether every member saw the last update of every other
+// member and the output of every run
+func (r *room) settled() bool {
+	r.executions.mu.Lock()
+	runs := r.executions.ok
+	r.executions.mu.Unlock()
+
+	for _, m := range r.members {
+		m.mu.Lock()
+		done := m.outputs >= runs
+		for _, other := range r.members {
+			if other != m && m.last[other.userID] != other.sent.Load() {
+				done = false
+			}
+		}
+		m.mu.Unlock()
+		if !done {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// histogram counts durations in buckets growing by 5%, precise enough for
+// percentiles without keeping every sample. The zero value is empty.
+type histogram struct {
+	counts [400]int64 // Bucket i holds durations up to 1.05^i microseconds
+	n      int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+var bucketGrowth = math.Log(1.05)
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		i = min(int(math.Ceil(math.Log(us)/bucketGrowth)), len(h.counts)-1)
+	}
+	h.counts[i]++
+	h.n++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+	h.max = max(h.max, o.max)
+}
+
+// quantile returns the upper bound of the bucket holding the q-th duration
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.n)))
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= max(rank, 1) {
+			return min(time.Duration(math.Pow(1.05, float64(i))*float64(time.Microsecond)), h.max)
+		}
+	}
+	return h.max
+}
+
+// summary of a histogram in milliseconds
+func (h *histogram) summary() Latency {
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/1e3) / 1e3 }
+	l := Latency{P50: ms(h.quantile(0.5)), P90: ms(h.quantile(0.9)), P99: ms(h.quantile(0.99)), Max: ms(h.max)}
+	if h.n > 0 {
+		l.Mean = ms(h.sum / time.Duration(h.n))
+	}
+	return l
+}
+
+// Server metrics the report reads
+const (
+	metricBroadcastsDropped = "plm_room_broadcasts_dropped_total"
+	metricQueueDrops        = "plm_socket_messages_dropped_total"
+	metricCoalesced         = "plm_socket_code_updates_coalesced_total"
+	metricRateLimited       = "plm_socket_messages_rate_limited_total"
+	metricSlowDisconnects   = "plm_socket_slow_disconnects_total"
+	metricGoroutines        = "plm_goroutines"
+	metricHeap              = "plm_heap_alloc_bytes"
+	metricClients           = "plm_clients_active"
+)
+
+// sampler scrapes the server's /metrics, keeping the first and last scrape
+// and the peak of every metric
+type sampler struct {
+	tgt  *target
+	done chan struct{}
+
+	mu          sync.Mutex
+	first, last map[string]float64
+	peak        map[string]float64
+}
+
+func newSampler(tgt *target) *sampler {
+	return &sampler{tgt: tgt, done: make(chan struct{}), peak: make(map[string]float64)}
+}
+
+// run samples every interval until ctx is done
+func (s *sampler) run(ctx context.Context, every time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sample(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wait returns once run returned
+func (s *sampler) wait() {
+	<-s.done
+}
+
+func (s *sampler) sample(ctx context.Context) error {
+	values, err := scrape(ctx, s.tgt)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.first == nil {
+		s.first = values
+	}
+	s.last = values
+	for name, v := range values {
+		s.peak[name] = max(s.peak[name], v)
+	}
+	return nil
+}
+
+// delta is how much a counter grew during the run
+func (s *sampler) delta(name string) int64 {
+	return int64(s.last[name] - s.first[name])
+}
+
+// scrape reads the server's metrics, summing the series of every metric
+func scrape(ctx context.Context, tgt *target) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tgt.url+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tgt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /metrics: status %d", resp.StatusCode)
+	}
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		v, err := strconv.ParseFloat(line[strings.LastIndexByte(line, ' ')+1:], 64)
+		if err == nil {
+			values[name] += v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// Latency percentiles in milliseconds
+type Latency struct {
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	Max  float64 `json:"max_ms"`
+	Mean float64 `json:"mean_ms"`
+}
+
+// Usage of a server resource before, at the peak of and after the run
+type Usage struct {
+	Before float64 `json:"before"`
+	Peak   float64 `json:"peak"`
+	After  float64 `json:"after"`
+}
+
+// Report sums up a load test run
+type Report struct {
+	Target          string  `json:"target"`
+	Rooms           int     `json:"rooms"`
+	TypistsPerRoom  int     `json:"typists_per_room"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	UpdatesPerSec   float64 `json:"updates_per_second"`
+	ExecIntervalSec float64 `json:"exec_interval_seconds,omitempty"`
+
+	Members struct {
+		Joined       int     `json:"joined"`
+		JoinFailures int     `json:"join_failures"`
+		Disconnected int     `json:"disconnected"`
+		WriteErrors  int     `json:"write_errors"`
+		SetupSeconds float64 `json:"setup_seconds"`
+	} `json:"members"`
+
+	Updates struct {
+		Sent         int64   `json:"sent"`
+		Expected     int64   `json:"expected"`
+		Delivered    int64   `json:"delivered"`
+		Missed       int64   `json:"missed"`
+		OutOfOrder   int64   `json:"out_of_order"`
+		RoomsOutSync int     `json:"rooms_out_of_sync"`
+		Latency      Latency `json:"latency"`
+	} `json:"updates"`
+
+	Executions struct {
+		OK              int64   `json:"ok"`
+		Failed          int64   `json:"failed"`
+		OutputsExpected int64   `json:"outputs_expected"`
+		OutputsReceived int64   `json:"outputs_received"`
+		Latency         Latency `json:"latency"`
+	} `json:"executions"`
+
+	// Counted by the members
+	Backpressure int64 `json:"backpressure_warnings"`
+	Errors       int64 `json:"errors"`
+
+	// Read from the server's metrics, when it serves them
+	Server *ServerStats `json:"server,omitempty"`
+}
+
+// ServerStats are the server's own counters for the run
+type ServerStats struct {
+	BroadcastsDropped int64 `json:"broadcasts_dropped"`
+	QueueDrops        int64 `json:"queue_drops"`
+	Coalesced         int64 `json:"code_updates_coalesced"`
+	RateLimited       int64 `json:"rate_limited"`
+	SlowDisconnects   int64 `json:"slow_disconnects"`
+	PeakClients       int64 `json:"peak_clients"`
+	Goroutines        Usage `json:"goroutines"`
+	HeapBytes         Usage `json:"heap_bytes"`
+}
+
+// collect fills the report from the rooms and the metric samples
+func (rep *Report) collect(rooms []*room, samples *sampler) {
+	var updates, execs histogram
+	for _, r := range rooms {
+		if !r.settled() {
+			rep.Updates.RoomsOutSync++
+		}
+
+		r.executions.mu.Lock()
+		rep.Executions.OK += r.executions.ok
+		rep.Executions.Failed += r.executions.failed
+		rep.Executions.OutputsExpected += r.executions.ok * int64(len(r.members))
+		execs.merge(&r.executions.latency)
+		r.executions.mu.Unlock()
+
+		for _, m := range r.members {
+			rep.Members.Joined++
+			rep.Updates.Sent += m.sent.Load()
+			for _, other := range r.members {
+				if other != m {
+					rep.Updates.Expected += other.sent.Load()
+				}
+			}
+			select {
+			case <-m.closed:
+				rep.Members.Disconnected++
+			default:
+			}
+
+			m.mu.Lock()
+			rep.Updates.Delivered += m.delivered
+			rep.Updates.OutOfOrder += m.outOfOrder
+			rep.Executions.OutputsReceived += m.outputs
+			rep.Backpressure += m.backpressure
+			rep.Errors += m.errors
+			if m.writeErr != nil {
+				rep.Members.WriteErrors++
+			}
+			updates.merge(&m.latency)
+			m.mu.Unlock()
+		}
+	}
+	rep.Updates.Missed = rep.Updates.Expected - rep.Updates.Delivered
+	rep.Updates.Latency = updates.summary()
+	rep.Executions.Latency = execs.summary()
+
+	samples.mu.Lock()
+	defer samples.mu.Unlock()
+	if samples.first == nil {
+		return
+	}
+	usage := func(name string) Usage {
+		return Usage{Before: samples.first[name], Peak: samples.peak[name], After: samples.last[name]}
+	}
+	rep.Server = &ServerStats{
+		BroadcastsDropped: samples.delta(metricBroadcastsDropped),
+		QueueDrops:        samples.delta(metricQueueDrops),
+		Coalesced:         samples.delta(metricCoalesced),
+		RateLimited:       samples.delta(metricRateLimited),
+		SlowDisconnects:   samples.delta(metricSlowDisconnects),
+		PeakClients:       int64(samples.peak[metricClients]),
+		Goroutines:        usage(metricGoroutines),
+		HeapBytes:         usage(metricHeap),
+	}
+}
+
+// Healthy tells whether every member stayed and ended with the code of every
+// other member
+func (rep *Report) Healthy() bool {
+	return rep.Members.JoinFailures == 0 && rep.Members.Disconnected == 0 && rep.Updates.RoomsOutSync == 0
+}
+
+func (rep *Report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func (rep *Report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Target\t%s\n", rep.Target)
+	fmt.Fprintf(tw, "Load\t%d rooms x %d typists, %.0fs at %g updates/s", rep.Rooms, rep.TypistsPerRoom, rep.DurationSeconds, rep.UpdatesPerSec)
+	if rep.ExecIntervalSec > 0 {
+		fmt.Fprintf(tw, ", a run every %gs per room", rep.ExecIntervalSec)
+	}
+	fmt.Fprintln(tw)
+
+	m := rep.Members
+	fmt.Fprintf(tw, "Members\t%d joined in %.1fs, %d rooms failed to open, %d disconnected, %d write errors\n",
+		m.Joined, m.SetupSeconds, m.JoinFailures, m.Disconnected, m.WriteErrors)
+
+	u := rep.Updates
+	fmt.Fprintf(tw, "Code updates\t%d sent, %d of %d deliveries arrived (%d missed, %d out of order), %d rooms out of sync\n",
+		u.Sent, u.Delivered, u.Expected, u.Missed, u.OutOfOrder, u.RoomsOutSync)
+	fmt.Fprintf(tw, "Update latency\t%s\n", formatLatency(u.Latency))
+
+	if rep.ExecIntervalSec > 0 {
+		e := rep.Executions
+		fmt.Fprintf(tw, "Executions\t%d ok, %d failed, %d of %d outputs reached the members\n",
+			e.OK, e.Failed, e.OutputsReceived, e.OutputsExpected)
+		fmt.Fprintf(tw, "Execution latency\t%s\n", formatLatency(e.Latency))
+	}
+	fmt.Fprintf(tw, "Client side\t%d backpressure warnings, %d errors\n", rep.Backpressure, rep.Errors)
+
+	if s := rep.Server; s != nil {
+		fmt.Fprintf(tw, "Server drops\t%d broadcasts dropped, %d queued messages dropped, %d slow disconnects\n",
+			s.BroadcastsDropped, s.QueueDrops, s.SlowDisconnects)
+		fmt.Fprintf(tw, "Server flow\t%d code updates coalesced, %d messages rate limited, %d clients at peak\n",
+			s.Coalesced, s.RateLimited, s.PeakClients)
+		fmt.Fprintf(tw, "Goroutines\t%.0f before, %.0f peak, %.0f after\n", s.Goroutines.Before, s.Goroutines.Peak, s.Goroutines.After)
+		fmt.Fprintf(tw, "Heap\t%s before, %s peak, %s after\n",
+			formatBytes(s.HeapBytes.Before), formatBytes(s.HeapBytes.Peak), formatBytes(s.HeapBytes.After))
+	} else {
+		fmt.Fprintf(tw, "Server\tmetrics unavailable\n")
+	}
+	return tw.Flush()
+}
+
+func formatLatency(l Latency) string {
+	return fmt.Sprintf("p50 %gms, p90 %gms, p99 %gms, max %gms, mean %gms", l.P50, l.P90, l.P99, l.Max, l.Mean)
+}
+
+func formatBytes(b float64) string {
+	return fmt.Sprintf("%.1f MiB", b/(1<<20))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// run opens the rooms, lets their members type for opts.Duration and
+// collects what they and the server's metrics saw
+func run(ctx context.Context, opts options, tgt *target, lo *slog.Logger) (*Report, error) {
+	rep := &Report{
+		Target:          tgt.name,
+		Rooms:           opts.Rooms,
+		TypistsPerRoom:  opts.Typists,
+		DurationSeconds: opts.Duration.Seconds(),
+		UpdatesPerSec:   opts.Rate,
+		ExecIntervalSec: opts.ExecInterval.Seconds(),
+	}
+
+	samples := newSampler(tgt)
+	if err := samples.sample(ctx); err != nil {
+		lo.Warn("server metrics are unavailable", "err", err)
+	}
+	sampling, stopSampling := context.WithCancel(ctx)
+	defer stopSampling()
+	go samples.run(sampling, opts.SampleEvery)
+
+	lo.Info("opening rooms", "target", tgt.url, "rooms", opts.Rooms, "typists", opts.Typists)
+	start := time.Now()
+	var rooms []*room
+	defer func() {
+		for _, r := range rooms {
+			r.close()
+		}
+	}()
+	for i := range opts.Rooms {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := openRoom(ctx, tgt, opts.Typists)
+		if err != nil {
+			rep.Members.JoinFailures++
+			lo.Warn("failed to open a room", "err", err)
+		} else {
+			rooms = append(rooms, r)
+		}
+		if opts.Ramp > 0 && i < opts.Rooms-1 {
+			time.Sleep(opts.Ramp / time.Duration(opts.Rooms-1))
+		}
+	}
+	rep.Members.SetupSeconds = time.Since(start).Seconds()
+	if len(rooms) == 0 {
+		return nil, fmt.Errorf("no room could be opened")
+	}
+
+	lo.Info("typing", "rooms", len(rooms), "duration", opts.Duration)
+	typing, stopTyping := context.WithTimeout(ctx, opts.Duration)
+	defer stopTyping()
+	var wg sync.WaitGroup
+	for _, r := range rooms {
+		for _, m := range r.members {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.typeCode(typing, opts.Rate, opts.CodeSize)
+			}()
+		}
+		if opts.ExecInterval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.execute(typing, tgt, opts.ExecInterval)
+			}()
+		}
+	}
+	wg.Wait()
+
+	// Updates and outputs still in flight get a moment to arrive
+	deadline := time.Now().Add(opts.Settle)
+	for time.Now().Before(deadline) && !allSettled(rooms) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	stopSampling()
+	samples.wait()
+	if err := samples.sample(context.WithoutCancel(ctx)); err != nil {
+		lo.Warn("server metrics are unavailable", "err", err)
+	}
+	rep.collect(rooms, samples)
+	return rep, nil
+}
+
+func allSettled(rooms []*room) bool {
+	for _, r := range rooms {
+		if !r.settled() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the server. LoadConfig fills it from, in
+// increasing order of precedence, the defaults, a JSON config file, the
+// environment and the command line flags.
+type Config struct {
+	Port        int
+	TemplateDir string // Page templates and static assets
+
+	// Code execution engine
+	CodeRunnerEngine  string        // Engine URL; EngineFallbackURL is used when empty
+	EngineFallbackURL string        // Deployed engine used when no engine is configured
+	PublicOrigin      string        // Origin header sent to the engine's domain check
+	ExecuteTimeout    time.Duration // Upper bound of one code execution
+	LeetcodeTimeout   time.Duration // Upper bound of one search on leetcode.com
+
+	// LeetCode
+	LeetcodeURL             string        // GraphQL endpoint questions are fetched from
+	LeetcodeRetries         int           // Retries after a 429, 5xx or network error
+	LeetcodeRate            float64       // Requests per second sent to LeetCode
+	LeetcodeBreakerFailures int           // Failed requests in a row that stop calls to LeetCode
+	LeetcodeBreakerCooldown time.Duration // How long calls stay stopped before a trial call
+
+	// Rooms
+	MaxRooms     int           // Old empty rooms are cleaned up past this many rooms
+	RoomCapacity int           // Members allowed in one room
+	RoomIdleTTL  time.Duration // Empty rooms are closed after this long
+	StaleRoomAge time.Duration // Empty rooms older than this go first when MaxRooms is reached
+	StateFile    string        // Rooms are saved here on shutdown and restored on start; off when empty
+
+	// Shutdown
+	ShutdownTimeout time.Duration // Deadline for draining rooms and executions on SIGTERM
+
+	// Health checks
+	ReadyTimeout time.Duration // Upper bound of each dependency check of the readiness probe
+
+	// Sockets
+	HandshakeTimeout time.Duration // Time a socket has to send its hello
+	PongWait         time.Duration // A socket without a pong for this long is dropped
+	PingInterval     time.Duration // Must be shorter than PongWait
+	WriteTimeout     time.Duration // Upper bound of one socket write
+
+	// Security
+	Secret         string   // HMAC key for join and invite tokens; random per process when empty
+	AllowedOrigins []string // Extra origins allowed to open room sockets
+	AdminToken     string   // Enables the admin API when set
+
+	// Logging
+	LogLevel  slog.Level // Records below this level are dropped
+	LogFormat string     // "text" or "json"
+
+	// Tracing
+	OTLPEndpoint     string  // OTLP/HTTP collector, e.g. http://localhost:4318; spans are not exported when empty
+	TraceSampleRatio float64 // Share of new traces that are recorded
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:                    3000,
+		TemplateDir:             "templates",
+		CodeRunnerEngine:        "http://localhost:8080",
+		EngineFallbackURL:       "https://code-execution-engine-797087556919.asia-south1.run.app",
+		PublicOrigin:            "https://practice-leetcode-multiplayer-797087556919.asia-south1.run.app",
+		ExecuteTimeout:          3 * time.Second,
+		LeetcodeTimeout:         5 * time.Second,
+		LeetcodeURL:             "https://leetcode.com/graphql",
+		LeetcodeRetries:         2,
+		LeetcodeRate:            5,
+		LeetcodeBreakerFailures: 5,
+		LeetcodeBreakerCooldown: 30 * time.Second,
+		MaxRooms:                100,
+		RoomCapacity:            2,
+		RoomIdleTTL:             30 * time.Minute,
+		StaleRoomAge:            24 * time.Hour,
+		ShutdownTimeout:         10 * time.Second,
+		ReadyTimeout:            2 * time.Second,
+		HandshakeTimeout:        2 * time.Second,
+		PongWait:                60 * time.Second,
+		PingInterval:            54 * time.Second,
+		WriteTimeout:            10 * time.Second,
+		LogLevel:                slog.LevelInfo,
+		LogFormat:               "text",
+		TraceSampleRatio:        1,
+	}
+}
+
+// secretSettings are never printed
+var secretSettings = map[string]bool{"token-secret": true, "admin-token": true}
+
+// envNames holds the environment variables that do not follow the flag name
+var envNames = map[string]string{"code-runner-engine": "CODE_RUNNER_ENGINE_API"}
+
+// envName returns the environment variable of a flag, e.g. ROOM_IDLE_TTL for room-idle-ttl
+func envName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return name
+	}
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// stringList is a flag.Value of comma or space separated strings
+type stringList struct {
+	list *[]string
+}
+
+func (s stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s stringList) Set(v string) error {
+	*s.list = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	return nil
+}
+
+// flagSet declares every setting as a flag with its current value as default.
+// Config files and the environment are applied through the same flags, so all
+// three sources share one parser per setting.
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.IntVar(&c.Port, "port", c.Port, "port of the HTTP server")
+	fs.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "directory of the page templates and static assets")
+	fs.StringVar(&c.CodeRunnerEngine, "code-runner-engine", c.CodeRunnerEngine, "URL of the code execution engine")
+	fs.StringVar(&c.EngineFallbackURL, "engine-fallback-url", c.EngineFallbackURL, "engine used when no engine URL is set")
+	fs.StringVar(&c.PublicOrigin, "public-origin", c.PublicOrigin, "public URL of this app, sent as Origin to the engine")
+	fs.DurationVar(&c.ExecuteTimeout, "execute-timeout", c.ExecuteTimeout, "upper bound of one code execution")
+	fs.DurationVar(&c.LeetcodeTimeout, "leetcode-timeout", c.LeetcodeTimeout, "upper bound of one leetcode.com search")
+	fs.StringVar(&c.LeetcodeURL, "leetcode-url", c.LeetcodeURL, "LeetCode GraphQL endpoint")
+	fs.IntVar(&c.LeetcodeRetries, "leetcode-retries", c.LeetcodeRetries, "retries after a 429, 5xx or network error from LeetCode")
+	fs.Float64Var(&c.LeetcodeRate, "leetcode-rate", c.LeetcodeRate, "requests per second sent to LeetCode")
+	fs.IntVar(&c.LeetcodeBreakerFailures, "leetcode-breaker-failures", c.LeetcodeBreakerFailures, "failed LeetCode requests in a row that stop calls to it")
+	fs.DurationVar(&c.LeetcodeBreakerCooldown, "leetcode-breaker-cooldown", c.LeetcodeBreakerCooldown, "how long calls to LeetCode stay stopped before a trial call")
+	fs.IntVar(&c.MaxRooms, "max-rooms", c.MaxRooms, "rooms kept before old empty rooms are cleaned up")
+	fs.IntVar(&c.RoomCapacity, "room-capacity", c.RoomCapacity, "members allowed in one room")
+	fs.DurationVar(&c.RoomIdleTTL, "room-idle-ttl", c.RoomIdleTTL, "close rooms that stayed empty this long (0 disables)")
+	fs.DurationVar(&c.StaleRoomAge, "stale-room-age", c.StaleRoomAge, "empty rooms older than this are cleaned up first")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "file rooms are saved to on shutdown and restored from on start")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "deadline for draining rooms and executions on shutdown")
+	fs.DurationVar(&c.ReadyTimeout, "ready-timeout", c.ReadyTimeout, "upper bound of each dependency check of the readiness probe")
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "time a socket has to send its hello")
+	fs.DurationVar(&c.PongWait, "pong-wait", c.PongWait, "drop sockets that sent no pong for this long")
+	fs.DurationVar(&c.PingInterval, "ping-interval", c.PingInterval, "how often sockets are pinged")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "upper bound of one socket write")
+	fs.StringVar(&c.Secret, "token-secret", c.Secret, "HMAC secret for join tokens and invite links")
+	fs.Var(stringList{&c.AllowedOrigins}, "allowed-origins", "comma separated origins allowed to open room sockets")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token of the admin API")
+	fs.TextVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output format: text or json")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "OTLP/HTTP collector URL traces are exported to")
+	fs.Float64Var(&c.TraceSampleRatio, "trace-sample-ratio", c.TraceSampleRatio, "share of new traces that are recorded, from 0 to 1")
+	return fs
+}
+
+// LoadConfig builds the config from the defaults, the JSON file named by the
+// -config flag or CONFIG_FILE, the environment and args, in that order
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	fs := cfg.flagSet("practice-leetcode-multiplayer")
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON config file")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// Flags given on the command line win over the file and the environment
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	set := func(name, value, source string) error {
+		if explicit[name] {
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s from %s: %w", name, source, err)
+		}
+		return nil
+	}
+
+	if *path != "" {
+		values, err := readConfigFile(*path)
+		if err != nil {
+			return cfg, err
+		}
+		for name, value := range values {
+			if fs.Lookup(name) == nil || name == "config" {
+				return cfg, fmt.Errorf("unknown setting %q in %s", name, *path)
+			}
+			if err := set(name, value, *path); err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		if value, found := os.LookupEnv(envName(f.Name)); found {
+			err = set(f.Name, value, "$"+envName(f.Name))
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// readConfigFile reads a JSON object of flag names to values. Values may be
+// strings, numbers or, for lists, arrays of strings.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// Validate reports the first setting that cannot work
+func (c Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	for name, u := range map[string]string{
+		"code-runner-engine":  c.CodeRunnerEngine,
+		"engine-fallback-url": c.EngineFallbackURL,
+		"public-origin":       c.PublicOrigin,
+		"leetcode-url":        c.LeetcodeURL,
+		"otlp-endpoint":       c.OTLPEndpoint,
+	} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("%s must be an absolute URL, got %q", name, u)
+		}
+	}
+	if c.CodeRunnerEngine == "" && c.EngineFallbackURL == "" {
+		return fmt.Errorf("one of code-runner-engine and engine-fallback-url is required")
+	}
+	if c.LeetcodeURL == "" {
+		return fmt.Errorf("leetcode-url is required")
+	}
+	if c.LeetcodeRetries < 0 {
+		return fmt.Errorf("leetcode-retries must not be negative, got %d", c.LeetcodeRetries)
+	}
+	if c.LeetcodeRate <= 0 {
+		return fmt.Errorf("leetcode-rate must be positive, got %v", c.LeetcodeRate)
+	}
+	if c.LeetcodeBreakerFailures < 1 {
+		return fmt.Errorf("leetcode-breaker-failures must be at least 1, got %d", c.LeetcodeBreakerFailures)
+	}
+	if c.MaxRooms < 1 {
+		return fmt.Errorf("max-rooms must be at least 1, got %d", c.MaxRooms)
+	}
+	if c.RoomCapacity < 1 {
+		return fmt.Errorf("room-capacity must be at least 1, got %d", c.RoomCapacity)
+	}
+	for name, d := range map[string]time.Duration{
+		"execute-timeout":           c.ExecuteTimeout,
+		"leetcode-timeout":          c.LeetcodeTimeout,
+		"leetcode-breaker-cooldown": c.LeetcodeBreakerCooldown,
+		"stale-room-age":            c.StaleRoomAge,
+		"shutdown-timeout":          c.ShutdownTimeout,
+		"ready-timeout":             c.ReadyTimeout,
+		"handshake-timeout":         c.HandshakeTimeout,
+		"pong-wait":                 c.PongWait,
+		"ping-interval":             c.PingInterval,
+		"write-timeout":             c.WriteTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive, got %v", name, d)
+		}
+	}
+	if c.RoomIdleTTL < 0 {
+		return fmt.Errorf("room-idle-ttl must not be negative, got %v", c.RoomIdleTTL)
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return fmt.Errorf("trace-sample-ratio must be between 0 and 1, got %v", c.TraceSampleRatio)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log-format must be text or json, got %q", c.LogFormat)
+	}
+	if c.PingInterval >= c.PongWait {
+		return fmt.Errorf("ping-interval (%v) must be shorter than pong-wait (%v)", c.PingInterval, c.PongWait)
+	}
+	return nil
+}
+
+// LogValue logs the effective config as one group of settings, with secrets
+// redacted
+func (c Config) LogValue() slog.Value {
+	fs := c.flagSet("")
+	var attrs []slog.Attr
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretSettings[f.Name] {
+			if value == "" {
+				value = "<unset>"
+			} else {
+				value = "<redacted>"
+			}
+		}
+		attrs = append(attrs, slog.String(f.Name, value))
+	})
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsetenv clears an environment variable for the rest of the test
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // JSON config file, none when empty
+		env  string // ROOM_CAPACITY, unset when empty
+		args []string
+		want int
+	}{
+		{name: "defaults", want: 2},
+		{name: "file over defaults", file: `{"room-capacity": 3}`, want: 3},
+		{name: "env over defaults", env: "4", want: 4},
+		{name: "env over file", file: `{"room-capacity": 3}`, env: "4", want: 4},
+		{name: "flag over defaults", args: []string{"-room-capacity", "5"}, want: 5},
+		{name: "flag over file", file: `{"room-capacity": 3}`, args: []string{"-room-capacity=5"}, want: 5},
+		{name: "flag over env and file", file: `{"room-capacity": 3}`, env: "4", args: []string{"-room-capacity", "5"}, want: 5},
+		{name: "file without the setting", file: `{"max-rooms": 7}`, env: "4", want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "CONFIG_FILE")
+			unsetenv(t, "ROOM_CAPACITY")
+			if tt.env != "" {
+				t.Setenv("ROOM_CAPACITY", tt.env)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			cfg, err := LoadConfig(args)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.RoomCapacity != tt.want {
+				t.Errorf("RoomCapacity = %d, want %d", cfg.RoomCapacity, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSources(t *testing.T) {
+	unsetenv(t, "ALLOWED_ORIGINS")
+	unsetenv(t, "CODE_RUNNER_ENGINE_API")
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, `{"allowed-origins": ["https://a.example", "https://b.example"], "room-idle-ttl": "5m"}`))
+	t.Setenv("CODE_RUNNER_ENGINE_API", "http://engine:8080")
+
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if got := strings.Join(cfg.AllowedOrigins, " "); got != "https://a.example https://b.example" {
+		t.Errorf("AllowedOrigins = %q from a JSON list", got)
+	}
+	if cfg.RoomIdleTTL != 5*time.Minute {
+		t.Errorf("RoomIdleTTL = %v from the file named by CONFIG_FILE", cfg.RoomIdleTTL)
+	}
+	if cfg.CodeRunnerEngine != "http://engine:8080" {
+		t.Errorf("CodeRunnerEngine = %q from its own variable name", cfg.CodeRunnerEngine)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string // MAX_ROOMS
+		args []string
+		want string
+	}{
+		{name: "unknown setting in the file", file: `{"rooms": 3}`, want: `unknown setting "rooms"`},
+		{name: "config file named in the file", file: `{"config": "other.json"}`, want: `unknown setting "config"`},
+		{name: "malformed file", file: `{"max-rooms": `, want: "parsing config file"},
+		{name: "bad value in the file", file: `{"max-rooms": "many"}`, want: "invalid max-rooms from"},
+		{name: "bad value in the environment", env: "many", want: "invalid max-rooms from $MAX_ROOMS"},
+		{name: "missing file", args: []string{"-config", "does-not-exist.json"}, want: "reading config file"},
+		{name: "invalid result", args: []string{"-max-rooms", "0"}, want: "max-rooms must be at least 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "CONFIG_FILE")
+			unsetenv(t, "MAX_ROOMS")
+			if tt.env != "" {
+				t.Setenv("MAX_ROOMS", tt.env)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			_, err := LoadConfig(args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // Part of the error, none when empty
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"port too low", func(c *Config) { c.Port = 0 }, "port must be between 1 and 65535"},
+		{"port too high", func(c *Config) { c.Port = 65536 }, "port must be between 1 and 65535"},
+		{"relative engine URL", func(c *Config) { c.CodeRunnerEngine = "localhost:8080" }, "code-runner-engine must be an absolute URL"},
+		{"relative fallback URL", func(c *Config) { c.EngineFallbackURL = "/engine" }, "engine-fallback-url must be an absolute URL"},
+		{"relative public origin", func(c *Config) { c.PublicOrigin = "example.com" }, "public-origin must be an absolute URL"},
+		{"relative leetcode URL", func(c *Config) { c.LeetcodeURL = "graphql" }, "leetcode-url must be an absolute URL"},
+		{"relative OTLP endpoint", func(c *Config) { c.OTLPEndpoint = "collector:4318" }, "otlp-endpoint must be an absolute URL"},
+		{"fallback engine only", func(c *Config) { c.CodeRunnerEngine = "" }, ""},
+		{"no engine", func(c *Config) { c.CodeRunnerEngine, c.EngineFallbackURL = "", "" }, "one of code-runner-engine and engine-fallback-url is required"},
+		{"no leetcode URL", func(c *Config) { c.LeetcodeURL = "" }, "leetcode-url is required"},
+		{"no leetcode retries", func(c *Config) { c.LeetcodeRetries = 0 }, ""},
+		{"negative leetcode retries", func(c *Config) { c.LeetcodeRetries = -1 }, "leetcode-retries must not be negative"},
+		{"zero leetcode rate", func(c *Config) { c.LeetcodeRate = 0 }, "leetcode-rate must be positive"},
+		{"zero breaker failures", func(c *Config) { c.LeetcodeBreakerFailures = 0 }, "leetcode-breaker-failures must be at least 1"},
+		{"zero max rooms", func(c *Config) { c.MaxRooms = 0 }, "max-rooms must be at least 1"},
+		{"zero room capacity", func(c *Config) { c.RoomCapacity = 0 }, "room-capacity must be at least 1"},
+		{"zero execute timeout", func(c *Config) { c.ExecuteTimeout = 0 }, "execute-timeout must be positive"},
+		{"zero leetcode timeout", func(c *Config) { c.LeetcodeTimeout = 0 }, "leetcode-timeout must be positive"},
+		{"zero breaker cooldown", func(c *Config) { c.LeetcodeBreakerCooldown = 0 }, "leetcode-breaker-cooldown must be positive"},
+		{"zero stale room age", func(c *Config) { c.StaleRoomAge = 0 }, "stale-room-age must be positive"},
+		{"zero shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown-timeout must be positive"},
+		{"zero ready timeout", func(c *Config) { c.ReadyTimeout = 0 }, "ready-timeout must be positive"},
+		{"zero handshake timeout", func(c *Config) { c.HandshakeTimeout = 0 }, "handshake-timeout must be positive"},
+		{"zero pong wait", func(c *Config) { c.PongWait = 0 }, "pong-wait must be positive"},
+		{"zero ping interval", func(c *Config) { c.PingInterval = 0 }, "ping-interval must be positive"},
+		{"zero write timeout", func(c *Config) { c.WriteTimeout = 0 }, "write-timeout must be positive"},
+		{"idle rooms kept", func(c *Config) { c.RoomIdleTTL = 0 }, ""},
+		{"negative room idle TTL", func(c *Config) { c.RoomIdleTTL = -time.Second }, "room-idle-ttl must not be negative"},
+		{"negative sample ratio", func(c *Config) { c.TraceSampleRatio = -0.1 }, "trace-sample-ratio must be between 0 and 1"},
+		{"sample ratio over 1", func(c *Config) { c.TraceSampleRatio = 1.5 }, "trace-sample-ratio must be between 0 and 1"},
+		{"unknown log format", func(c *Config) { c.LogFormat = "xml" }, "log-format must be text or json"},
+		{"ping interval as long as pong wait", func(c *Config) { c.PingInterval = c.PongWait }, "ping-interval (1m0s) must be shorter than pong-wait (1m0s)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Validate error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,46 @@
 package core
 
-import "log"
+import (
+	"crypto/rand"
+	"io"
+	"log/slog"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode"
+)
 
 type Core struct {
-	Port             int
-	CodeRunnerEngine string
-	Lo               *log.Logger
+	Config
+	TokenSecret []byte // HMAC key for join and invite tokens
+	Lo          *slog.Logger
+	Leetcode    *leetcode.Client // Shared by every request, so its rate limit and breaker are global
+}
+
+// New returns the core of a server running with cfg
+func New(cfg Config, lo *slog.Logger) *Core {
+	co := &Core{Config: cfg, TokenSecret: []byte(cfg.Secret), Lo: lo}
+	co.Leetcode = leetcode.NewClient(leetcode.Options{
+		BaseURL:         cfg.LeetcodeURL,
+		MaxRetries:      cfg.LeetcodeRetries,
+		DisableRetries:  cfg.LeetcodeRetries == 0,
+		RequestsPerSec:  cfg.LeetcodeRate,
+		BreakerFailures: cfg.LeetcodeBreakerFailures,
+		BreakerCooldown: cfg.LeetcodeBreakerCooldown,
+		Logger:          lo,
+	})
+
+	// Join tokens and invite links only survive restarts when the secret is configured
+	if len(co.TokenSecret) == 0 {
+		co.TokenSecret = make([]byte, 32)
+		rand.Read(co.TokenSecret)
+	}
+	return co
+}
+
+// NewLogger returns the logger described by the config, writing to w
+func NewLogger(cfg Config, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	if cfg.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
 }
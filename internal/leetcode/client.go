@@ -0,0 +1,362 @@
+package leetcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is LeetCode's GraphQL endpoint
+const DefaultBaseURL = "https://leetcode.com/graphql"
+
+var (
+	ErrCircuitOpen = fmt.Errorf("leetcode is unavailable, not calling it for a while")
+	errRetryable   = fmt.Errorf("retryable leetcode error")
+)
+
+// Options tune a Client. Zero fields take the defaults in parentheses.
+type Options struct {
+	BaseURL         string        // GraphQL endpoint (DefaultBaseURL)
+	HTTPClient      *http.Client  // Client of every attempt (5s timeout per attempt)
+	MaxRetries      int           // Retries after a 429, 5xx or network error (2)
+	DisableRetries  bool          // Gives up after the first failed attempt, ignoring MaxRetries
+	RetryBackoff    time.Duration // Backoff before the first retry, doubled for each next one (200ms)
+	MaxBackoff      time.Duration // Upper bound of one backoff, including Retry-After (2s)
+	RequestsPerSec  float64       // Requests sent per second across all callers (5)
+	BreakerFailures int           // Consecutive failed requests that open the circuit (5)
+	BreakerCooldown time.Duration // Time the circuit stays open before a trial request (30s)
+	Logger          *slog.Logger  // Logger of retries, failures and fetches (slog.Default())
+}
+
+// Client calls the LeetCode GraphQL API. It spaces requests out, retries
+// transient failures with jittered backoff, stops calling LeetCode for a
+// while after repeated failures and shares one request between callers
+// asking the same thing at the same time. A Client is safe for concurrent use.
+type Client struct {
+	baseURL      string
+	http         *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	limiter      *limiter
+	breaker      *breaker
+	log          *slog.Logger
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// NewClient returns a client tuned by opts
+func NewClient(opts Options) *Client {
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultBaseURL
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 2
+	}
+	if opts.DisableRetries {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 200 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 2 * time.Second
+	}
+	if opts.RequestsPerSec <= 0 {
+		opts.RequestsPerSec = 5
+	}
+	if opts.BreakerFailures <= 0 {
+		opts.BreakerFailures = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	lo := opts.Logger.With("component", "leetcode")
+
+	return &Client{
+		baseURL:      opts.BaseURL,
+		http:         opts.HTTPClient,
+		maxRetries:   opts.MaxRetries,
+		retryBackoff: opts.RetryBackoff,
+		maxBackoff:   opts.MaxBackoff,
+		limiter:      newLimiter(opts.RequestsPerSec),
+		breaker:      &breaker{failures: opts.BreakerFailures, cooldown: opts.BreakerCooldown, log: lo},
+		log:          lo,
+		flights:      make(map[string]*flight),
+	}
+}
+
+// BreakerState is "closed" while LeetCode is called, "open" after repeated
+// failures until a trial call starts and "half-open" while it runs
+func (c *Client) BreakerState() string {
+	return c.breaker.state()
+}
+
+// flight is a request shared by every caller asking the same query
+type flight struct {
+	done chan struct{}
+	resp GraphQLResponse
+	err  error
+}
+
+// query sends a GraphQL query and decodes the response into a GraphQLResponse.
+// Callers sending the same query while one is running share its response.
+// A non-2xx response that is not worth retrying returns an error with its status.
+func (c *Client) query(ctx context.Context, operation, query string, variables any) (GraphQLResponse, error) {
+	body, err := encodeQuery(operation, query, variables)
+	if err != nil {
+		return GraphQLResponse{}, err
+	}
+
+	key := operation + "\x00" + string(body)
+	c.mu.Lock()
+	f, shared := c.flights[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+	}
+	c.mu.Unlock()
+
+	if !shared {
+		// The request outlives a caller that gives up, since others may wait on it
+		go func() {
+			f.resp, f.err = c.send(context.WithoutCancel(ctx), operation, body)
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-f.done:
+		return f.resp, f.err
+	case <-ctx.Done():
+		return GraphQLResponse{}, ctx.Err()
+	}
+}
+
+// encodeQuery builds the request body of a GraphQL query
+func encodeQuery(operation, query string, variables any) ([]byte, error) {
+	body, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s query: %w", operation, err)
+	}
+	return body, nil
+}
+
+// send posts body through the breaker and the rate limiter, retrying
+// transient failures
+func (c *Client) send(ctx context.Context, operation string, body []byte) (GraphQLResponse, error) {
+	if !c.breaker.allow() {
+		return GraphQLResponse{}, ErrCircuitOpen
+	}
+
+	resp, err := c.retry(ctx, operation, body, c.limiter)
+	switch {
+	case errors.Is(err, errRetryable):
+		// Only failures to reach LeetCode count against the breaker
+		c.breaker.record(false)
+	case err == nil && len(resp.Errors) == 0:
+		c.breaker.record(true)
+	default:
+		// LeetCode answered, but it says nothing about whether it recovered
+		c.breaker.release()
+	}
+	return resp, err
+}
+
+// retry posts body until it gets an answer that is not worth retrying, the
+// retries run out or ctx is done. Every attempt waits for l first.
+func (c *Client) retry(ctx context.Context, operation string, body []byte, l *limiter) (GraphQLResponse, error) {
+	var resp GraphQLResponse
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		resp, retryAfter, err = c.attempt(ctx, operation, body, l)
+		if !errors.Is(err, errRetryable) || attempt == c.maxRetries {
+			break
+		}
+
+		backoff := min(c.retryBackoff<<attempt, c.maxBackoff)
+		backoff = rand.N(backoff) + 1
+		if retryAfter > 0 {
+			backoff = min(retryAfter, c.maxBackoff)
+		}
+		c.log.Warn("leetcode request failed, retrying", "operation", operation, "err", err, "backoff", backoff)
+		requestRetries.With(operation).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return GraphQLResponse{}, fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+	}
+	return resp, err
+}
+
+// attempt sends one request. Retryable failures wrap errRetryable and, for a
+// 429 or 5xx with a Retry-After in seconds, return how long LeetCode asked to wait.
+func (c *Client) attempt(ctx context.Context, operation string, body []byte, l *limiter) (GraphQLResponse, time.Duration, error) {
+	if err := l.wait(ctx); err != nil {
+		return GraphQLResponse{}, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL, bytes.NewReader(body))
+	if err != nil {
+		return GraphQLResponse{}, 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doGraphQL(c.http, req, operation)
+	if err != nil {
+		return GraphQLResponse{}, 0, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		io.Copy(io.Discard, resp.Body)
+		retryAfter := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return GraphQLResponse{}, retryAfter, fmt.Errorf("%w: leetcode api http error: status=%d", errRetryable, resp.StatusCode)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyErrMsg, _ := io.ReadAll(resp.Body)
+		c.log.Error("leetcode request failed", "operation", operation, "status", resp.StatusCode, "body", string(bodyErrMsg))
+		return GraphQLResponse{}, 0, fmt.Errorf("leetcode api http error: status=%d", resp.StatusCode)
+	}
+
+	var graphqlResponse GraphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&graphqlResponse); err != nil {
+		return GraphQLResponse{}, 0, fmt.Errorf("failed to parse response from leetcode: %v", err)
+	}
+	return graphqlResponse, 0, nil
+}
+
+// limiter spaces requests out evenly, letting a burst of up to a second's
+// worth through after a quiet period
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSec float64) *limiter {
+	interval := time.Duration(float64(time.Second) / perSec)
+	return &limiter{interval: interval, burst: max(time.Second, interval) - interval}
+}
+
+// wait blocks until the caller may send a request or ctx is done. A nil
+// limiter never waits.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-l.burst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// breaker opens after a run of failures, refusing calls for the cooldown, and
+// then lets one trial call decide whether to close again
+type breaker struct {
+	failures int
+	cooldown time.Duration
+	log      *slog.Logger
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a call may go out
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed < b.failures {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// release ends an allowed call that neither succeeded nor failed to reach
+// LeetCode, leaving the run of failures as it is
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// record takes the outcome of an allowed call
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasTrial := b.trial
+	b.trial = false
+	if ok {
+		b.failed = 0
+		return
+	}
+
+	b.failed++
+	if b.failed >= b.failures {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if b.failed == b.failures || wasTrial {
+			circuitOpened.Inc()
+			b.log.Warn("leetcode circuit opened", "failures", b.failed, "cooldown", b.cooldown)
+		}
+	}
+}
+
+func (b *breaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failed < b.failures:
+		return "closed"
+	case b.trial:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
@@ -0,0 +1,176 @@
+package leetcode_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode/leetcodetest"
+)
+
+var quiet = slog.New(slog.DiscardHandler)
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		opts     leetcode.Options
+		attempts int
+		wantErr  bool
+	}{
+		{"recovers within the default retries", http.StatusServiceUnavailable, 2, leetcode.Options{}, 3, false},
+		{"gives up after the default retries", http.StatusTooManyRequests, 3, leetcode.Options{}, 3, true},
+		{"more retries", http.StatusBadGateway, 4, leetcode.Options{MaxRetries: 5}, 5, false},
+		{"retries disabled", http.StatusInternalServerError, 1, leetcode.Options{DisableRetries: true}, 1, true},
+		{"client errors are not retried", http.StatusBadRequest, 1, leetcode.Options{}, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := leetcodetest.NewServer()
+			defer fake.Close()
+			fake.FailNext(tt.failures, tt.status)
+			tt.opts.RetryBackoff = time.Millisecond
+			tt.opts.Logger = quiet
+			client := fake.Client(tt.opts)
+
+			err := client.Ping(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Ping error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := fake.Requests(leetcodetest.KindList); got != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fake := leetcodetest.NewServer()
+	defer fake.Close()
+	fake.SetRetryAfter(1)
+
+	// Retry-After wins over the backoff, up to MaxBackoff
+	for _, tc := range []struct {
+		maxBackoff time.Duration
+		min, max   time.Duration
+	}{
+		{maxBackoff: 5 * time.Second, min: time.Second, max: 3 * time.Second},
+		{maxBackoff: 50 * time.Millisecond, min: 50 * time.Millisecond, max: 500 * time.Millisecond},
+	} {
+		fake.FailNext(1, http.StatusTooManyRequests)
+		client := fake.Client(leetcode.Options{RetryBackoff: time.Millisecond, MaxBackoff: tc.maxBackoff, Logger: quiet})
+		start := time.Now()
+		if err := client.Ping(context.Background()); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+		if took := time.Since(start); took < tc.min || took > tc.max {
+			t.Errorf("with MaxBackoff %v the retry took %v, want between %v and %v", tc.maxBackoff, took, tc.min, tc.max)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	fake := leetcodetest.NewServer()
+	defer fake.Close()
+	const cooldown = 100 * time.Millisecond
+	client := fake.Client(leetcode.Options{
+		DisableRetries:  true,
+		BreakerFailures: 2,
+		BreakerCooldown: cooldown,
+		Logger:          quiet,
+	})
+	ctx := context.Background()
+	state := func(want string) {
+		t.Helper()
+		if got := client.BreakerState(); got != want {
+			t.Fatalf("breaker state = %q, want %q", got, want)
+		}
+	}
+	search := func() error {
+		_, err := client.SearchQuestionsListFromLeetcode(ctx, "two sum")
+		return err
+	}
+
+	// A client error reaches LeetCode but does not end a run of failures
+	fake.FailNext(1, http.StatusInternalServerError)
+	search()
+	fake.FailNext(1, http.StatusBadRequest)
+	search()
+	state("closed")
+	fake.FailNext(1, http.StatusInternalServerError)
+	search()
+	state("open")
+
+	// An open circuit refuses calls without sending them
+	if err := search(); !errors.Is(err, leetcode.ErrCircuitOpen) {
+		t.Errorf("search on an open circuit = %v, want %v", err, leetcode.ErrCircuitOpen)
+	}
+	if got := fake.Requests(leetcodetest.KindList); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+
+	// Readiness probes bypass it
+	if err := client.Ping(ctx); err != nil {
+		t.Errorf("Ping on an open circuit: %v", err)
+	}
+	state("open")
+
+	// A failed trial opens the circuit again
+	time.Sleep(cooldown)
+	state("open")
+	fake.FailNext(1, http.StatusInternalServerError)
+	search()
+	state("open")
+
+	// A successful trial closes it
+	time.Sleep(cooldown)
+	if err := search(); err != nil {
+		t.Fatalf("trial search: %v", err)
+	}
+	state("closed")
+}
+
+func TestCoalescing(t *testing.T) {
+	fake := leetcodetest.NewServer()
+	defer fake.Close()
+	fake.SetLatency(100 * time.Millisecond)
+	client := fake.Client(leetcode.Options{Logger: quiet})
+
+	const callers = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.SearchQuestionsListFromLeetcode(context.Background(), "two sum")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("SearchQuestionsListFromLeetcode: %v", err)
+		}
+	}
+	if got := fake.Requests(leetcodetest.KindList); got != 1 {
+		t.Errorf("requests = %d, want the callers to share 1", got)
+	}
+
+	// A different question is a different request
+	if _, err := client.SearchQuestionsListFromLeetcode(context.Background(), "add two"); err != nil {
+		t.Fatalf("SearchQuestionsListFromLeetcode: %v", err)
+	}
+	if got := fake.Requests(leetcodetest.KindList); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
@@ -0,0 +1,52 @@
+package leetcode
+
+import (
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogramVec("plm_leetcode_request_duration_seconds",
+		"Latency of LeetCode GraphQL requests by operation.", metrics.DefaultBuckets, "operation")
+	requestErrors = metrics.NewCounterVec("plm_leetcode_request_errors_total",
+		"LeetCode GraphQL requests that failed or returned a non-2xx status, by operation.", "operation")
+	requestRetries = metrics.NewCounterVec("plm_leetcode_request_retries_total",
+		"LeetCode GraphQL requests retried after a 429, 5xx or network error, by operation.", "operation")
+	circuitOpened = metrics.NewCounter("plm_leetcode_circuit_opened_total",
+		"Times repeated failures stopped calls to LeetCode for the breaker cooldown.")
+)
+
+// tracer starts a span per LeetCode request
+var tracer = otel.Tracer("github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode")
+
+// doGraphQL sends a request to LeetCode and records its latency and failures
+// under operation. Trace context is not sent to LeetCode.
+func doGraphQL(client *http.Client, req *http.Request, operation string) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "leetcode "+operation, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	requestDuration.With(operation).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		requestErrors.With(operation).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "request failed")
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		requestErrors.With(operation).Inc()
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	return resp, err
+}
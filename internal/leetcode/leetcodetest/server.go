@@ -0,0 +1,349 @@
+// Package leetcodetest serves a fake LeetCode GraphQL API from recorded
+// fixtures, so the leetcode client and the handlers using it run without
+// network access.
+//
+// The fake answers the queries this app sends, recognised by the field they
+// select: questionList for search, suggestions and the catalog, question for
+// question details and activeDailyCodingChallengeQuestion for the daily
+// question. List results use the problemsetQuestionList and questions aliases
+// the leetcode package asks for.
+package leetcodetest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// Request kinds counted by Requests
+const (
+	KindList     = "questionList"
+	KindQuestion = "question"
+	KindDaily    = "daily"
+)
+
+// Server is a fake LeetCode GraphQL API. Its methods are safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	questions map[string]json.RawMessage // Recorded question payloads by slug
+	summaries []summary                  // Catalog order
+	daily     dailyFixture
+	failures  []int // Statuses returned by the next requests, in order
+	retry     int   // Retry-After seconds of failed answers, 0 for none
+	latency   time.Duration
+	requests  map[string]int
+}
+
+// summary is a catalog entry of a question
+type summary struct {
+	Title              string `json:"title"`
+	TitleSlug          string `json:"titleSlug"`
+	Difficulty         string `json:"difficulty"`
+	QuestionFrontendID string `json:"questionFrontendId"`
+	PaidOnly           bool   `json:"paidOnly"`
+}
+
+type dailyFixture struct {
+	Date      string `json:"date"`
+	TitleSlug string `json:"titleSlug"`
+}
+
+// NewServer starts a fake serving the recorded questions and daily question.
+// Callers must Close it.
+func NewServer() *Server {
+	s := &Server{questions: make(map[string]json.RawMessage), requests: make(map[string]int)}
+
+	files, err := fs.Glob(fixtures, "fixtures/questions/*.json")
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range files {
+		data, err := fixtures.ReadFile(name)
+		if err != nil {
+			panic(err)
+		}
+		if err := s.addRaw(data); err != nil {
+			panic(fmt.Sprintf("leetcodetest: fixture %s: %v", path.Base(name), err))
+		}
+	}
+	data, err := fixtures.ReadFile("fixtures/daily.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, &s.daily); err != nil {
+		panic(fmt.Sprintf("leetcodetest: fixture daily.json: %v", err))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /graphql", s.serveGraphQL)
+	mux.HandleFunc("POST /graphql/", s.serveGraphQL)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// GraphQLURL is the endpoint to configure as the LeetCode URL
+func (s *Server) GraphQLURL() string {
+	return s.URL + "/graphql"
+}
+
+// Client returns a leetcode client of the fake. BaseURL and HTTPClient are
+// set from the fake; a zero RequestsPerSec is raised so tests do not wait.
+func (s *Server) Client(opts leetcode.Options) *leetcode.Client {
+	opts.BaseURL = s.GraphQLURL()
+	opts.HTTPClient = s.Server.Client()
+	if opts.RequestsPerSec == 0 {
+		opts.RequestsPerSec = 1000
+	}
+	return leetcode.NewClient(opts)
+}
+
+// AddQuestion serves q besides the recorded questions, replacing any question
+// with the same slug
+func (s *Server) AddQuestion(q leetcode.Question) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.addRaw(data); err != nil {
+		panic(err)
+	}
+}
+
+// addRaw adds a question payload. Caller must hold s.mu or own s.
+func (s *Server) addRaw(data json.RawMessage) error {
+	var entry summary
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	if entry.TitleSlug == "" {
+		return fmt.Errorf("question has no titleSlug")
+	}
+
+	if _, exists := s.questions[entry.TitleSlug]; exists {
+		for i := range s.summaries {
+			if s.summaries[i].TitleSlug == entry.TitleSlug {
+				s.summaries = append(s.summaries[:i], s.summaries[i+1:]...)
+				break
+			}
+		}
+	}
+	s.questions[entry.TitleSlug] = data
+	s.summaries = append(s.summaries, entry)
+	sort.SliceStable(s.summaries, func(i, j int) bool {
+		a, _ := strconv.Atoi(s.summaries[i].QuestionFrontendID)
+		b, _ := strconv.Atoi(s.summaries[j].QuestionFrontendID)
+		return a < b
+	})
+	return nil
+}
+
+// SetDaily makes slug the daily question of date
+func (s *Server) SetDaily(date, slug string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daily = dailyFixture{Date: date, TitleSlug: slug}
+}
+
+// FailNext answers the next n requests with status and no body
+func (s *Server) FailNext(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// SetRetryAfter makes the failures of FailNext ask for a wait of seconds
+// in their Retry-After header; 0 leaves the header out
+func (s *Server) SetRetryAfter(seconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retry = seconds
+}
+
+// SetLatency delays every answer by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Requests returns how many requests of kind were received, failed ones included
+func (s *Server) Requests(kind string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[kind]
+}
+
+// graphQLRequest is a query with its variables
+type graphQLRequest struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables"`
+}
+
+var (
+	limitArg = regexp.MustCompile(`limit:\s*(\d+)`)
+	skipArg  = regexp.MustCompile(`skip:\s*(\d+)`)
+)
+
+func (s *Server) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	kind := ""
+	switch {
+	case strings.Contains(req.Query, "activeDailyCodingChallengeQuestion"):
+		kind = KindDaily
+	case strings.Contains(req.Query, "questionList("):
+		kind = KindList
+	case strings.Contains(req.Query, "question("):
+		kind = KindQuestion
+	}
+
+	s.mu.Lock()
+	s.requests[kind]++
+	latency, retry := s.latency, s.retry
+	status := 0
+	if len(s.failures) > 0 {
+		status, s.failures = s.failures[0], s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		if retry > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	switch kind {
+	case KindDaily:
+		s.serveDaily(w)
+	case KindList:
+		s.serveList(w, req)
+	case KindQuestion:
+		s.serveQuestion(w, req)
+	default:
+		writeErrors(w, http.StatusBadRequest, "leetcodetest: unsupported query")
+	}
+}
+
+// serveList searches the catalog like LeetCode's searchKeywords filter: by
+// title or slug substring, or by frontend ID
+func (s *Server) serveList(w http.ResponseWriter, req graphQLRequest) {
+	limit, skip := max(intArg(req, "limit", limitArg, 50), 0), max(intArg(req, "skip", skipArg, 0), 0)
+	keyword := ""
+	if filters, ok := req.Variables["filters"].(map[string]any); ok {
+		keyword, _ = filters["searchKeywords"].(string)
+	}
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+
+	s.mu.Lock()
+	var matches []summary
+	for _, q := range s.summaries {
+		if keyword == "" || q.QuestionFrontendID == keyword ||
+			strings.Contains(strings.ToLower(q.Title), keyword) || strings.Contains(q.TitleSlug, keyword) {
+			matches = append(matches, q)
+		}
+	}
+	s.mu.Unlock()
+
+	total := len(matches)
+	matches = matches[min(skip, len(matches)):]
+	matches = matches[:min(limit, len(matches))]
+	if matches == nil {
+		matches = []summary{}
+	}
+	writeData(w, map[string]any{
+		"problemsetQuestionList": map[string]any{"total": total, "questions": matches},
+	})
+}
+
+// serveQuestion answers like LeetCode does for unknown slugs: a null question
+func (s *Server) serveQuestion(w http.ResponseWriter, req graphQLRequest) {
+	slug, _ := req.Variables["titleSlug"].(string)
+	s.mu.Lock()
+	question, found := s.questions[slug]
+	s.mu.Unlock()
+
+	if !found {
+		question = json.RawMessage("null")
+	}
+	writeData(w, map[string]any{"question": question})
+}
+
+func (s *Server) serveDaily(w http.ResponseWriter) {
+	s.mu.Lock()
+	daily := s.daily
+	question, found := s.questions[daily.TitleSlug]
+	s.mu.Unlock()
+
+	if !found {
+		writeErrors(w, http.StatusOK, "leetcodetest: daily question "+daily.TitleSlug+" is not a fixture")
+		return
+	}
+	writeData(w, map[string]any{
+		"activeDailyCodingChallengeQuestion": map[string]any{
+			"date":     daily.Date,
+			"link":     "/problems/" + daily.TitleSlug + "/",
+			"question": question,
+		},
+	})
+}
+
+// intArg reads a numeric argument from the variables or, failing that, the query text
+func intArg(req graphQLRequest, name string, inline *regexp.Regexp, fallback int) int {
+	if v, ok := req.Variables[name].(float64); ok {
+		return int(v)
+	}
+	if m := inline.FindStringSubmatch(req.Query); m != nil {
+		if v, err := strconv.Atoi(m[1]); err == nil {
+			return v
+		}
+	}
+	return fallback
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func writeErrors(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"data":   nil,
+		"errors": []map[string]string{{"message": message}},
+	})
+}
@@ -0,0 +1,295 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets suit latencies in seconds from a millisecond to ten seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is one family of series in the registry
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// registry holds every metric of the process
+var registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, existing := range registry.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metrics: %s registered twice", m.name()))
+		}
+	}
+	registry.metrics = append(registry.metrics, m)
+}
+
+// WriteAll writes every registered metric in the text exposition format
+func WriteAll(w io.Writer) {
+	registry.mu.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteAll(w)
+	})
+}
+
+// desc is the name, help text and label names shared by a metric's series
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, kind)
+}
+
+// key joins label values into a series key
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats label values as {a="x",b="y"}, with extra pairs appended
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	var pairs []string
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// series holds the children of a vector by their label values
+type series[T any] struct {
+	mu     sync.RWMutex
+	byKey  map[string]T
+	keys   []string
+	values map[string][]string
+}
+
+func (s *series[T]) get(key string, values []string, create func() T) T {
+	s.mu.RLock()
+	child, ok := s.byKey[key]
+	s.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if child, ok := s.byKey[key]; ok {
+		return child
+	}
+	if s.byKey == nil {
+		s.byKey, s.values = make(map[string]T), make(map[string][]string)
+	}
+	child = create()
+	s.byKey[key] = child
+	s.keys = append(s.keys, key)
+	s.values[key] = append([]string(nil), values...)
+	return child
+}
+
+// each calls fn for every child in label order
+func (s *series[T]) each(fn func(values []string, child T)) {
+	s.mu.RLock()
+	keys := append([]string(nil), s.keys...)
+	s.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s.mu.RLock()
+		child, values := s.byKey[key], s.values[key]
+		s.mu.RUnlock()
+		fn(values, child)
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Add increases the counter by v, which must not be negative
+func (c *Counter) Add(v float64) {
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+// CounterVec is a counter per combination of label values
+type CounterVec struct {
+	desc
+	children series[*Counter]
+}
+
+// NewCounterVec registers a counter partitioned by labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{desc: desc{metricName: name, help: help, labels: labels}}
+	register(v)
+	return v
+}
+
+// With returns the counter of the label values, in the order of the labels
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.children.get(v.key(values), values, func() *Counter { return &Counter{} })
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.header(w, "counter")
+	v.children.each(func(values []string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labelPairs(values), formatFloat(c.value()))
+	})
+}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// funcMetric reads its value from fn when scraped
+type funcMetric struct {
+	desc
+	kind string
+	fn   func() float64
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	m.header(w, m.kind)
+	fmt.Fprintf(w, "%s %s\n", m.metricName, formatFloat(m.fn()))
+}
+
+// NewGaugeFunc registers a gauge whose value is fn at scrape time
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&funcMetric{desc: desc{metricName: name, help: help}, kind: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter kept elsewhere, read through fn
+func NewCounterFunc(name, help string, fn func() float64) {
+	register(&funcMetric{desc: desc{metricName: name, help: help}, kind: "counter", fn: fn})
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a histogram per combination of label values
+type HistogramVec struct {
+	desc
+	buckets  []float64
+	children series[*Histogram]
+}
+
+// NewHistogramVec registers a histogram partitioned by labels. Buckets are the
+// inclusive upper bounds, in increasing order; nil means DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	v := &HistogramVec{desc: desc{metricName: name, help: help, labels: labels}, buckets: buckets}
+	register(v)
+	return v
+}
+
+// With returns the histogram of the label values, in the order of the labels
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.children.get(v.key(values), values, func() *Histogram {
+		return &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+	})
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.header(w, "histogram")
+	v.children.each(func(values []string, h *Histogram) {
+		h.mu.Lock()
+		counts, count, sum := append([]uint64(nil), h.counts...), h.count, h.sum
+		h.mu.Unlock()
+
+		for i, upper := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.labelPairs(values, "le", formatFloat(upper)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.labelPairs(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.metricName, v.labelPairs(values), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.metricName, v.labelPairs(values), count)
+	})
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelEscaper escapes label values the way the exposition format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
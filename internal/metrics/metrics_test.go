@@ -0,0 +1,366 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// isolate gives the test an empty registry
+func isolate(t *testing.T) {
+	t.Helper()
+	registry.mu.Lock()
+	saved := registry.metrics
+	registry.metrics = nil
+	registry.mu.Unlock()
+	t.Cleanup(func() {
+		registry.mu.Lock()
+		registry.metrics = saved
+		registry.mu.Unlock()
+	})
+}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{.*\})? (\S+)$`)
+)
+
+// family is what the exposition says about one metric
+type family struct {
+	help    string
+	kind    string
+	samples []sample
+}
+
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseExposition checks text against the Prometheus text exposition format
+// and returns its families by name
+func parseExposition(t *testing.T, text string) map[string]*family {
+	t.Helper()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		t.Fatalf("exposition does not end with a newline")
+	}
+
+	families := make(map[string]*family)
+	var order []string
+	var current *family
+	var currentName string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...any) {
+			t.Helper()
+			t.Fatalf("line %d %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+
+		if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+			name, help, _ := strings.Cut(rest, " ")
+			if !metricName.MatchString(name) {
+				fail("invalid metric name")
+			}
+			if families[name] != nil {
+				fail("family described twice")
+			}
+			current, currentName = &family{help: help}, name
+			families[name] = current
+			order = append(order, name)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(rest, " ")
+			if name != currentName || current.kind != "" || len(current.samples) > 0 {
+				fail("TYPE must follow the HELP of its family, before its samples")
+			}
+			if !slices.Contains([]string{"counter", "gauge", "histogram"}, kind) {
+				fail("unknown type %q", kind)
+			}
+			current.kind = kind
+			continue
+		}
+
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			fail("not a sample")
+		}
+		if current == nil || current.kind == "" {
+			fail("sample before the TYPE of its family")
+		}
+		name := m[1]
+		switch {
+		case name == currentName:
+		case current.kind == "histogram" && slices.Contains([]string{currentName + "_bucket", currentName + "_sum", currentName + "_count"}, name):
+		default:
+			fail("sample outside its family %s", currentName)
+		}
+		labels := parseLabels(t, m[2])
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			fail("invalid value: %v", err)
+		}
+		if seen[name+m[2]] {
+			fail("series written twice")
+		}
+		seen[name+m[2]] = true
+		current.samples = append(current.samples, sample{name: name, labels: labels, value: value})
+	}
+
+	if !slices.IsSorted(order) {
+		t.Errorf("families are not sorted: %v", order)
+	}
+	for name, f := range families {
+		if f.kind == "histogram" {
+			checkHistogram(t, name, f)
+		}
+	}
+	return families
+}
+
+// parseLabels reads {a="x",b="y"}, allowing only the escapes of the format
+func parseLabels(t *testing.T, s string) map[string]string {
+	t.Helper()
+	labels := make(map[string]string)
+	if s == "" {
+		return labels
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	for s != "" {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok || !labelName.MatchString(name) {
+			t.Fatalf("invalid label in %q", s)
+		}
+		if _, dup := labels[name]; dup {
+			t.Fatalf("label %s repeated", name)
+		}
+
+		var value strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\n' {
+				t.Fatalf("raw newline in label %s", name)
+			}
+			if rest[i] != '\\' {
+				value.WriteByte(rest[i])
+				continue
+			}
+			i++
+			switch {
+			case i == len(rest):
+				t.Fatalf("unfinished escape in label %s", name)
+			case rest[i] == 'n':
+				value.WriteByte('\n')
+			case rest[i] == '\\' || rest[i] == '"':
+				value.WriteByte(rest[i])
+			default:
+				t.Fatalf("invalid escape \\%c in label %s", rest[i], name)
+			}
+		}
+		if i == len(rest) {
+			t.Fatalf("unterminated value of label %s", name)
+		}
+		labels[name] = value.String()
+
+		s = rest[i+1:]
+		if s != "" {
+			var ok bool
+			if s, ok = strings.CutPrefix(s, ","); !ok || s == "" {
+				t.Fatalf("labels not separated by commas near %q", s)
+			}
+		}
+	}
+	return labels
+}
+
+// checkHistogram checks that every series of a histogram has increasing,
+// cumulative buckets ending in +Inf, and a count equal to the +Inf bucket
+func checkHistogram(t *testing.T, name string, f *family) {
+	t.Helper()
+	type series struct {
+		bounds []float64
+		counts []float64
+		count  float64
+		hasSum bool
+	}
+	bySeries := make(map[string]*series)
+	get := func(labels map[string]string) *series {
+		var key []string
+		for k, v := range labels {
+			if k != "le" {
+				key = append(key, k+"="+v)
+			}
+		}
+		slices.Sort(key)
+		k := strings.Join(key, ",")
+		if bySeries[k] == nil {
+			bySeries[k] = &series{count: -1}
+		}
+		return bySeries[k]
+	}
+
+	for _, s := range f.samples {
+		ser := get(s.labels)
+		switch s.name {
+		case name + "_bucket":
+			le, ok := s.labels["le"]
+			if !ok {
+				t.Fatalf("%s bucket without le", name)
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				t.Fatalf("%s bucket le=%q: %v", name, le, err)
+			}
+			ser.bounds = append(ser.bounds, bound)
+			ser.counts = append(ser.counts, s.value)
+		case name + "_sum":
+			ser.hasSum = true
+		case name + "_count":
+			ser.count = s.value
+		default:
+			t.Fatalf("%s: plain sample in a histogram", name)
+		}
+	}
+
+	for key, ser := range bySeries {
+		if len(ser.bounds) == 0 || !math.IsInf(ser.bounds[len(ser.bounds)-1], 1) {
+			t.Errorf("%s{%s}: buckets do not end with +Inf: %v", name, key, ser.bounds)
+			continue
+		}
+		for i := 1; i < len(ser.bounds); i++ {
+			if ser.bounds[i] <= ser.bounds[i-1] || ser.counts[i] < ser.counts[i-1] {
+				t.Errorf("%s{%s}: buckets %v with counts %v are not increasing and cumulative", name, key, ser.bounds, ser.counts)
+			}
+		}
+		if !ser.hasSum || ser.count != ser.counts[len(ser.counts)-1] {
+			t.Errorf("%s{%s}: count %v, sum %v, +Inf bucket %v", name, key, ser.count, ser.hasSum, ser.counts[len(ser.counts)-1])
+		}
+	}
+}
+
+// value finds the sample of a family with exactly the given labels
+func (f *family) value(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	for _, s := range f.samples {
+		if s.name == name && len(s.labels) == len(labels) {
+			match := true
+			for k, v := range labels {
+				match = match && s.labels[k] == v
+			}
+			if match {
+				return s.value
+			}
+		}
+	}
+	t.Fatalf("no sample %s%v", name, labels)
+	return 0
+}
+
+func TestExposition(t *testing.T) {
+	isolate(t)
+	requests := NewCounterVec("test_requests_total", "Requests by route\nand \\ status.", "route", "status")
+	NewCounter("test_errors_total", "Errors.")
+	NewGaugeFunc("test_queue_depth", "Queue depth.", func() float64 { return 3.5 })
+	NewCounterFunc("test_dropped_total", "Dropped.", func() float64 { return 7 })
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	NewHistogramVec("test_idle_seconds", "Never observed.", nil, "route")
+
+	odd := "a \"quoted\" \\ path\nwith a newline"
+	requests.With("/", "200").Inc()
+	requests.With("/", "200").Add(1.5)
+	requests.With(odd, "500").Inc()
+	latency.With("/").Observe(0.1)
+	latency.With("/").Observe(0.5)
+	latency.With("/").Observe(3)
+	latency.With(odd).Observe(0.01)
+
+	var out strings.Builder
+	WriteAll(&out)
+	families := parseExposition(t, out.String())
+
+	if len(families) != 6 {
+		t.Errorf("%d families, want 6:\n%s", len(families), out.String())
+	}
+	for name, kind := range map[string]string{
+		"test_requests_total": "counter", "test_errors_total": "counter", "test_queue_depth": "gauge",
+		"test_dropped_total": "counter", "test_latency_seconds": "histogram", "test_idle_seconds": "histogram",
+	} {
+		if f := families[name]; f == nil || f.kind != kind {
+			t.Errorf("%s: %+v, want a %s", name, f, kind)
+		}
+	}
+	if help := families["test_requests_total"].help; help != `Requests by route\nand \\ status.` {
+		t.Errorf("help = %q, want it escaped", help)
+	}
+
+	f := families["test_requests_total"]
+	if got := f.value(t, "test_requests_total", map[string]string{"route": "/", "status": "200"}); got != 2.5 {
+		t.Errorf("requests to / = %v, want 2.5", got)
+	}
+	if got := f.value(t, "test_requests_total", map[string]string{"route": odd, "status": "500"}); got != 1 {
+		t.Errorf("requests to the odd route = %v, want 1", got)
+	}
+	if got := families["test_errors_total"].value(t, "test_errors_total", nil); got != 0 {
+		t.Errorf("errors = %v, want an unlabelled 0", got)
+	}
+	if got := families["test_queue_depth"].value(t, "test_queue_depth", nil); got != 3.5 {
+		t.Errorf("queue depth = %v, want 3.5", got)
+	}
+	if got := families["test_dropped_total"].value(t, "test_dropped_total", nil); got != 7 {
+		t.Errorf("dropped = %v, want 7", got)
+	}
+
+	// Bucket bounds are inclusive
+	h := families["test_latency_seconds"]
+	for le, want := range map[string]float64{"0.1": 1, "1": 2, "+Inf": 3} {
+		if got := h.value(t, "test_latency_seconds_bucket", map[string]string{"route": "/", "le": le}); got != want {
+			t.Errorf("bucket le=%s = %v, want %v", le, got, want)
+		}
+	}
+	if got := h.value(t, "test_latency_seconds_sum", map[string]string{"route": "/"}); got != 3.6 {
+		t.Errorf("sum = %v, want 3.6", got)
+	}
+	if len(families["test_idle_seconds"].samples) != 0 {
+		t.Errorf("a histogram without observations wrote %v", families["test_idle_seconds"].samples)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	isolate(t)
+	NewCounter("test_scrapes_total", "Scrapes.").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	families := parseExposition(t, rec.Body.String())
+	if got := families["test_scrapes_total"].value(t, "test_scrapes_total", nil); got != 1 {
+		t.Errorf("scrapes = %v, want 1", got)
+	}
+}
+
+func TestRegistrationMistakes(t *testing.T) {
+	isolate(t)
+	v := NewCounterVec("test_twice_total", "Twice.", "route")
+
+	mustPanic := func(what string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", what)
+			}
+		}()
+		fn()
+	}
+	mustPanic("registering a name twice", func() { NewCounter("test_twice_total", "Again.") })
+	mustPanic("missing label values", func() { v.With() })
+	mustPanic("extra label values", func() { v.With("/", "200") })
+}
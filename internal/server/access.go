@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+)
+
+var (
+	ErrPasscodeRequired = fmt.Errorf("this room is private. please enter the passcode")
+	ErrInvalidInvite    = fmt.Errorf("invite link is invalid")
+	ErrInviteExpired    = fmt.Errorf("invite link has expired")
+	ErrInviteUsedUp     = fmt.Errorf("invite link has already been used")
+)
+
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+// Invite is a limited-use pass into a private room
+type Invite struct {
+	ID        string    `json:"id"`
+	MaxUses   int       `json:"max_uses"` // 0 means unlimited until expiry
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// inviteClaims is the signed body of an invite token
+type inviteClaims struct {
+	Type     string `json:"typ"`
+	RoomID   string `json:"rid"`
+	InviteID string `json:"iid"`
+	Expires  int64  `json:"exp"`
+}
+
+// InviteResponse is returned to the owner after creating an invite
+type InviteResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	MaxUses   int       `json:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// hashPasscode salts and hashes a room passcode
+func hashPasscode(salt, passcode string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + passcode))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomSecret returns a hex encoded random value of n bytes
+func randomSecret(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SetPasscode makes the room private. An empty passcode makes it public again.
+func (r *Room) SetPasscode(passcode string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if passcode == "" {
+		r.passcodeHash, r.passcodeSalt = "", ""
+		return
+	}
+	r.passcodeSalt = randomSecret(16)
+	r.passcodeHash = hashPasscode(r.passcodeSalt, passcode)
+}
+
+// IsPrivate reports whether the room requires a passcode or invite
+func (r *Room) IsPrivate() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.passcodeHash != ""
+}
+
+// checkPasscode compares a passcode in constant time. Caller must hold r.mu.
+func (r *Room) checkPasscode(passcode string) bool {
+	if r.passcodeHash == "" {
+		return true
+	}
+	got := hashPasscode(r.passcodeSalt, passcode)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(r.passcodeHash)) == 1
+}
+
+// parseInvite verifies the signature and expiry of an invite token
+func parseInvite(secret []byte, token string) (inviteClaims, error) {
+	var claims inviteClaims
+	if !verifyToken(secret, token, &claims) || claims.Type != tokenTypeInvite {
+		return claims, ErrInvalidInvite
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, ErrInviteExpired
+	}
+	return claims, nil
+}
+
+// useInvite validates an invite token against the room and spends one of
+// its uses. Caller must hold r.mu.
+func (r *Room) useInvite(secret []byte, token string) error {
+	claims, err := parseInvite(secret, token)
+	if err != nil {
+		return err
+	}
+	if claims.RoomID != r.ID {
+		return ErrInvalidInvite
+	}
+	invite, ok := r.Invites[claims.InviteID]
+	if !ok {
+		return ErrInvalidInvite
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return ErrInviteExpired
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return ErrInviteUsedUp
+	}
+	invite.Uses++
+	return nil
+}
+
+// Authorize checks the passcode or invite token presented for a private room.
+// An invite use is spent for every room page handed out with it.
+func (r *Room) Authorize(secret []byte, passcode, invite string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.passcodeHash == "" {
+		return nil
+	}
+	if invite != "" {
+		return r.useInvite(secret, invite)
+	}
+	if passcode != "" && r.checkPasscode(passcode) {
+		return nil
+	}
+	return ErrPasscodeRequired
+}
+
+// CreateInviteHandler lets the room owner mint a signed, expiring invite link.
+// Form values: token (the owner page's join token), ttl (e.g. "30m"),
+// max_uses (0 = unlimited).
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	co := r.Context().Value("core").(*core.Core)
+
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if v := r.FormValue("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxInviteTTL {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("ttl must be a duration between 1s and %s", maxInviteTTL))
+			return
+		}
+		ttl = d
+	}
+	maxUses := 1
+	if v := r.FormValue("max_uses"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("max_uses must be a non-negative number"))
+			return
+		}
+		maxUses = n
+	}
+
+	room.mu.Lock()
+	if !room.ownerBySubject(requestJoinClaims(r).Subject) {
+		room.mu.Unlock()
+		SendErrorResponse(w, http.StatusForbidden, ErrNotRoomOwner)
+		return
+	}
+	invite := &Invite{
+		ID:        uuid.New().String(),
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedBy: room.OwnerID,
+	}
+	if room.Invites == nil {
+		room.Invites = make(map[string]*Invite)
+	}
+	room.Invites[invite.ID] = invite
+	room.mu.Unlock()
+
+	token := signToken(co.TokenSecret, inviteClaims{
+		Type:     tokenTypeInvite,
+		RoomID:   room.ID,
+		InviteID: invite.ID,
+		Expires:  invite.ExpiresAt.Unix(),
+	})
+
+	SendJSONResponse(w, http.StatusCreated, InviteResponse{
+		Token:     token,
+		URL:       "/?room_id=" + url.QueryEscape(room.ID) + "&invite=" + url.QueryEscape(token),
+		MaxUses:   invite.MaxUses,
+		ExpiresAt: invite.ExpiresAt,
+	})
+}
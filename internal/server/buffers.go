@@ -0,0 +1,92 @@
+package server
+
+import "strings"
+
+// normalizeLanguage maps the language names used by the UI onto buffer keys
+func normalizeLanguage(language string) string {
+	return strings.ToLower(strings.TrimSpace(language))
+}
+
+// setCode updates the code of the current language. Caller must hold r.mu.
+func (r *Room) setCode(code string) {
+	r.CodeState = code
+	if r.CodeBuffers == nil {
+		r.CodeBuffers = make(map[string]string)
+	}
+	r.CodeBuffers[r.CurrentLanguage] = code
+}
+
+// switchLanguage stashes the current draft and loads the buffer of the new
+// language, which is empty if nobody has written code in it yet.
+// Caller must hold r.mu.
+func (r *Room) switchLanguage(language string) {
+	language = normalizeLanguage(language)
+	if language == r.CurrentLanguage {
+		return
+	}
+	if r.CodeBuffers == nil {
+		r.CodeBuffers = make(map[string]string)
+	}
+	// Every language left keeps a draft, even an empty one, so late updates
+	// for it are recognised
+	if r.CodeState != "" || r.CurrentLanguage != "" {
+		r.CodeBuffers[r.CurrentLanguage] = r.CodeState
+	}
+	r.CurrentLanguage = language
+	r.CodeState = r.CodeBuffers[language]
+}
+
+// adoptLanguage moves the room to the language of a code update that no
+// language change announced: the room's first language, or one the sender
+// picked while disconnected. The other clients are told to follow.
+// Caller must hold r.mu.
+func (r *Room) adoptLanguage(language, userID string) {
+	if r.CurrentLanguage == "" {
+		// Code typed before the room had a language belongs to the first one
+		r.CurrentLanguage = language
+		if code, ok := r.CodeBuffers[""]; ok {
+			delete(r.CodeBuffers, "")
+			if _, exists := r.CodeBuffers[language]; !exists {
+				r.CodeBuffers[language] = code
+			}
+		}
+	} else {
+		r.switchLanguage(language)
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:     TypeLanguageChange,
+		RoomID:   r.ID,
+		UserID:   userID,
+		Language: r.CurrentLanguage,
+		Content:  r.CodeState,
+	}, userID)
+}
+
+// copyCodeBuffers returns a copy of every language draft. Caller must hold r.mu.
+func (r *Room) copyCodeBuffers() map[string]string {
+	if len(r.CodeBuffers) == 0 {
+		return nil
+	}
+	buffers := make(map[string]string, len(r.CodeBuffers))
+	for lang, code := range r.CodeBuffers {
+		buffers[lang] = code
+	}
+	return buffers
+}
+
+// handleLanguageChange switches the room to another language buffer and tells
+// every client, including the sender, which draft to load.
+// Caller must hold r.mu.
+func (r *Room) handleLanguageChange(message *WebSocketMessage) {
+	r.switchLanguage(message.Language)
+
+	r.fanout(&WebSocketMessage{
+		Type:     TypeLanguageChange,
+		RoomID:   r.ID,
+		UserID:   message.UserID,
+		Role:     message.Role,
+		Language: r.CurrentLanguage,
+		Content:  r.CodeState,
+	}, "")
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrChatEmpty     = fmt.Errorf("chat message is empty")
+	ErrChatTooLong   = fmt.Errorf("chat message is too long")
+	ErrChatMuted     = fmt.Errorf("you have been muted in this room")
+	ErrChatNotFound  = fmt.Errorf("chat message not found")
+	ErrChatForbidden = fmt.Errorf("you are not allowed to change this chat message")
+	ErrNotRoomOwner  = fmt.Errorf("only the room owner can do that")
+)
+
+const (
+	maxChatMessageLength = 2000 // characters per message
+	maxChatHistory       = 200  // messages kept per room
+)
+
+// Chat message formats
+const (
+	ChatFormatText = "text"
+	ChatFormatCode = "code"
+)
+
+// profanityList is a small blocklist; matches are masked, not rejected
+var profanityList = []string{"fuck", "shit", "bitch", "bastard", "asshole", "dick", "cunt"}
+
+var profanityPattern = regexp.MustCompile(`(?i)\b(` + strings.Join(profanityList, "|") + `)(s|es|ed|ing|er)?\b`)
+
+// codeFencePattern matches a message wrapped in a ``` fence with an optional language
+var codeFencePattern = regexp.MustCompile("(?s)^```([\\w+#-]*)\\n(.*?)\\n?```$")
+
+// ChatMessage is a single message in the room's chat history
+type ChatMessage struct {
+	ID        int        `json:"id"`
+	UserID    string     `json:"user_id"`
+	Role      string     `json:"role"`
+	Text      string     `json:"text"`
+	Format    string     `json:"format"`
+	Language  string     `json:"language,omitempty"` // Language of a code snippet
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+}
+
+// chatPayload is the content of chat, chat_edit and chat_delete messages
+type chatPayload struct {
+	ID     int    `json:"id"`
+	Text   string `json:"text"`
+	Format string `json:"format"`
+}
+
+// sanitizeChatText validates the size of a chat message and masks profanity
+func sanitizeChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", ErrChatEmpty
+	}
+	if utf8.RuneCountInString(text) > maxChatMessageLength {
+		return "", ErrChatTooLong
+	}
+	return profanityPattern.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), nil
+}
+
+// formatChatMessage fills in the text, format and language of a chat message
+func formatChatMessage(msg *ChatMessage, text, format string) {
+	msg.Format = ChatFormatText
+	msg.Language = ""
+	if m := codeFencePattern.FindStringSubmatch(text); m != nil {
+		msg.Format = ChatFormatCode
+		msg.Language = strings.ToLower(m[1])
+		text = m[2]
+	} else if format == ChatFormatCode {
+		msg.Format = ChatFormatCode
+	}
+	msg.Text = text
+}
+
+// chatPayloadFromContent accepts either a plain string or a chatPayload object
+func chatPayloadFromContent(content interface{}) (chatPayload, error) {
+	var payload chatPayload
+	if text, ok := content.(string); ok {
+		payload.Text = text
+		return payload, nil
+	}
+	err := decodeContent(content, &payload)
+	return payload, err
+}
+
+// findChatMessage looks up a chat message by ID. Caller must hold r.mu.
+func (r *Room) findChatMessage(id int) *ChatMessage {
+	for _, m := range r.Chat {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// copyChatHistory returns a copy of the chat history. Caller must hold r.mu.
+func (r *Room) copyChatHistory() []ChatMessage {
+	if len(r.Chat) == 0 {
+		return nil
+	}
+	history := make([]ChatMessage, 0, len(r.Chat))
+	for _, m := range r.Chat {
+		history = append(history, *m)
+	}
+	return history
+}
+
+// replyError sends a TypeError message back to a single user. Caller must hold r.mu.
+func (r *Room) replyError(userID string, err error) {
+	r.sendTo(userID, &WebSocketMessage{
+		Type:    TypeError,
+		RoomID:  r.ID,
+		Content: err.Error(),
+	})
+}
+
+// handleChat stores a new chat message and broadcasts it with its ID.
+// Caller must hold r.mu.
+func (r *Room) handleChat(message *WebSocketMessage) {
+	if r.isMuted(message.UserID) {
+		r.replyError(message.UserID, ErrChatMuted)
+		return
+	}
+
+	payload, err := chatPayloadFromContent(message.Content)
+	if err != nil {
+		r.replyError(message.UserID, ErrChatEmpty)
+		return
+	}
+	text, err := sanitizeChatText(payload.Text)
+	if err != nil {
+		r.replyError(message.UserID, err)
+		return
+	}
+
+	r.chatSeq++
+	chat := &ChatMessage{
+		ID:        r.chatSeq,
+		UserID:    message.UserID,
+		Role:      message.Role,
+		CreatedAt: time.Now(),
+	}
+	formatChatMessage(chat, text, payload.Format)
+
+	r.Chat = append(r.Chat, chat)
+	if len(r.Chat) > maxChatHistory {
+		r.Chat = r.Chat[len(r.Chat)-maxChatHistory:]
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeChat,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *chat,
+	}, "")
+}
+
+// handleChatEdit lets the sender of a chat message change its text.
+// Caller must hold r.mu.
+func (r *Room) handleChatEdit(message *WebSocketMessage) {
+	var payload chatPayload
+	if err := decodeContent(message.Content, &payload); err != nil {
+		r.replyError(message.UserID, ErrChatNotFound)
+		return
+	}
+
+	chat := r.findChatMessage(payload.ID)
+	if chat == nil || chat.Deleted {
+		r.replyError(message.UserID, ErrChatNotFound)
+		return
+	}
+	if chat.UserID != message.UserID {
+		r.replyError(message.UserID, ErrChatForbidden)
+		return
+	}
+	if r.isMuted(message.UserID) {
+		r.replyError(message.UserID, ErrChatMuted)
+		return
+	}
+
+	text, err := sanitizeChatText(payload.Text)
+	if err != nil {
+		r.replyError(message.UserID, err)
+		return
+	}
+	formatChatMessage(chat, text, payload.Format)
+	now := time.Now()
+	chat.EditedAt = &now
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeChatEdit,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *chat,
+	}, "")
+}
+
+// handleChatDelete removes the text of a chat message. The sender and the
+// room owner may delete a message. Caller must hold r.mu.
+func (r *Room) handleChatDelete(message *WebSocketMessage) {
+	var payload chatPayload
+	if id, ok := intFromContent(message.Content); ok {
+		payload.ID = id
+	} else if err := decodeContent(message.Content, &payload); err != nil {
+		r.replyError(message.UserID, ErrChatNotFound)
+		return
+	}
+
+	chat := r.findChatMessage(payload.ID)
+	if chat == nil || chat.Deleted {
+		r.replyError(message.UserID, ErrChatNotFound)
+		return
+	}
+	if chat.UserID != message.UserID && !r.isOwner(message.UserID) {
+		r.replyError(message.UserID, ErrChatForbidden)
+		return
+	}
+
+	chat.Deleted = true
+	chat.Text = ""
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeChatDelete,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *chat,
+	}, "")
+}
+
+// isMuted reports whether the member with userID may not post chat messages.
+// Caller must hold r.mu.
+func (r *Room) isMuted(userID string) bool {
+	client := r.findClient(userID)
+	if client == nil {
+		return false
+	}
+	return r.Muted[client.subject]
+}
+
+// handleChatMute toggles whether TargetUserID may post chat messages.
+// Only the room owner may mute. Caller must hold r.mu.
+func (r *Room) handleChatMute(message *WebSocketMessage) {
+	if !r.isOwner(message.UserID) {
+		r.replyError(message.UserID, ErrNotRoomOwner)
+		return
+	}
+	if message.TargetUserID == "" || message.TargetUserID == message.UserID {
+		r.replyError(message.UserID, ErrInvalidTarget)
+		return
+	}
+	target := r.findClient(message.TargetUserID)
+	if target == nil {
+		r.replyError(message.UserID, ErrUserNotHere)
+		return
+	}
+
+	muted := true
+	if b, ok := message.Content.(bool); ok {
+		muted = b
+	}
+	if r.Muted == nil {
+		r.Muted = make(map[string]bool)
+	}
+	// User IDs change on every connection; the page's token does not
+	if muted {
+		r.Muted[target.subject] = true
+	} else {
+		delete(r.Muted, target.subject)
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:         TypeChatMute,
+		RoomID:       r.ID,
+		UserID:       message.UserID,
+		Role:         message.Role,
+		TargetUserID: message.TargetUserID,
+		Content:      muted,
+	}, "")
+}
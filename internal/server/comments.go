@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/utils"
+)
+
+var (
+	ErrCommentNotFound = fmt.Errorf("comment thread not found")
+	ErrInvalidLines    = fmt.Errorf("invalid line range")
+)
+
+// Comment is a single entry in a review thread
+type Comment struct {
+	ID        int       `json:"id"`
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CommentThread is a review discussion anchored to a range of lines.
+// Lines are zero-based and inclusive, matching the editor's positions.
+type CommentThread struct {
+	ID         int       `json:"id"`
+	Language   string    `json:"language"`
+	StartLine  int       `json:"start_line"`
+	EndLine    int       `json:"end_line"`
+	Revision   int       `json:"revision"`    // Snapshot the thread was created against
+	AnchorText string    `json:"anchor_text"` // The commented lines at creation time
+	Outdated   bool      `json:"outdated"`    // The commented lines were removed or rewritten
+	Resolved   bool      `json:"resolved"`
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	Comments   []Comment `json:"comments"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// commentPayload is the content of comment, comment_reply and comment_resolve messages
+type commentPayload struct {
+	ThreadID  int    `json:"thread_id"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Text      string `json:"text"`
+	Resolved  *bool  `json:"resolved"`
+}
+
+// findThread looks up a comment thread by ID. Caller must hold r.mu.
+func (r *Room) findThread(id int) *CommentThread {
+	for _, t := range r.Comments {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// copyComments returns a deep copy of all comment threads. Caller must hold r.mu.
+func (r *Room) copyComments() []CommentThread {
+	if len(r.Comments) == 0 {
+		return nil
+	}
+	out := make([]CommentThread, 0, len(r.Comments))
+	for _, t := range r.Comments {
+		thread := *t
+		thread.Comments = append([]Comment(nil), t.Comments...)
+		out = append(out, thread)
+	}
+	return out
+}
+
+// latestRevision snapshots the code if needed and returns the ID of the most
+// recent snapshot of the current language. Caller must hold r.mu.
+func (r *Room) latestRevision() int {
+	r.autoSnapshot()
+	for i := len(r.Snapshots) - 1; i >= 0; i-- {
+		if r.Snapshots[i].Language == r.CurrentLanguage {
+			return r.Snapshots[i].ID
+		}
+	}
+	return 0
+}
+
+// newComment validates the text and appends a comment to a thread. Caller must hold r.mu.
+func (r *Room) newComment(thread *CommentThread, message *WebSocketMessage, text string) error {
+	text, err := sanitizeChatText(text)
+	if err != nil {
+		return err
+	}
+	r.commentSeq++
+	thread.Comments = append(thread.Comments, Comment{
+		ID:        r.commentSeq,
+		UserID:    message.UserID,
+		Role:      message.Role,
+		Text:      text,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// handleComment opens a new thread on a line range of the current code.
+// Caller must hold r.mu.
+func (r *Room) handleComment(message *WebSocketMessage) {
+	var payload commentPayload
+	if err := decodeContent(message.Content, &payload); err != nil {
+		r.replyError(message.UserID, ErrInvalidLines)
+		return
+	}
+
+	lines := utils.SplitLines(r.CodeState)
+	if payload.EndLine < payload.StartLine {
+		payload.EndLine = payload.StartLine
+	}
+	if payload.StartLine < 0 || payload.EndLine >= len(lines) {
+		r.replyError(message.UserID, ErrInvalidLines)
+		return
+	}
+
+	r.threadSeq++
+	thread := &CommentThread{
+		ID:         r.threadSeq,
+		Language:   r.CurrentLanguage,
+		StartLine:  payload.StartLine,
+		EndLine:    payload.EndLine,
+		Revision:   r.latestRevision(),
+		AnchorText: strings.Join(lines[payload.StartLine:payload.EndLine+1], "\n"),
+		CreatedAt:  time.Now(),
+	}
+	if err := r.newComment(thread, message, payload.Text); err != nil {
+		r.replyError(message.UserID, err)
+		return
+	}
+	r.Comments = append(r.Comments, thread)
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeComment,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *thread,
+	}, "")
+}
+
+// handleCommentReply appends a comment to an existing thread. Caller must hold r.mu.
+func (r *Room) handleCommentReply(message *WebSocketMessage) {
+	var payload commentPayload
+	if err := decodeContent(message.Content, &payload); err != nil {
+		r.replyError(message.UserID, ErrCommentNotFound)
+		return
+	}
+	thread := r.findThread(payload.ThreadID)
+	if thread == nil {
+		r.replyError(message.UserID, ErrCommentNotFound)
+		return
+	}
+	if err := r.newComment(thread, message, payload.Text); err != nil {
+		r.replyError(message.UserID, err)
+		return
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeCommentReply,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *thread,
+	}, "")
+}
+
+// handleCommentResolve resolves or reopens a thread. Caller must hold r.mu.
+func (r *Room) handleCommentResolve(message *WebSocketMessage) {
+	var payload commentPayload
+	if id, ok := intFromContent(message.Content); ok {
+		payload.ThreadID = id
+	} else if err := decodeContent(message.Content, &payload); err != nil {
+		r.replyError(message.UserID, ErrCommentNotFound)
+		return
+	}
+	thread := r.findThread(payload.ThreadID)
+	if thread == nil {
+		r.replyError(message.UserID, ErrCommentNotFound)
+		return
+	}
+
+	thread.Resolved = payload.Resolved == nil || *payload.Resolved
+	thread.ResolvedBy = ""
+	if thread.Resolved {
+		thread.ResolvedBy = message.UserID
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeCommentResolve,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: *thread,
+	}, "")
+}
+
+// maxReanchorLines bounds the edited lines diffed to re-anchor comments.
+// Lines of a larger edit are treated as rewritten, which keeps a code update
+// cheap while the room is locked.
+const maxReanchorLines = 200
+
+// reanchorComments shifts the open threads of the current language after the
+// code changed from oldCode to r.CodeState, and tells clients about threads
+// that moved. Only the lines between the common prefix and suffix of both
+// codes are diffed. Caller must hold r.mu.
+func (r *Room) reanchorComments(oldCode string) {
+	var open []*CommentThread
+	for _, t := range r.Comments {
+		if !t.Resolved && !t.Outdated && t.Language == r.CurrentLanguage {
+			open = append(open, t)
+		}
+	}
+	if len(open) == 0 || oldCode == r.CodeState {
+		return
+	}
+
+	mapping := utils.LineMapping(oldCode, r.CodeState, maxReanchorLines)
+	var moved []CommentThread
+	for _, t := range open {
+		start, end := reanchorRange(mapping, t.StartLine, t.EndLine)
+		if start < 0 {
+			t.Outdated = true
+		} else if start == t.StartLine && end == t.EndLine {
+			continue
+		} else {
+			t.StartLine, t.EndLine = start, end
+		}
+		moved = append(moved, *t)
+	}
+	if len(moved) == 0 {
+		return
+	}
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeCommentMove,
+		RoomID:  r.ID,
+		Content: moved,
+	}, "")
+}
+
+// reanchorRange maps an inclusive line range through a line mapping and
+// returns -1 when none of its lines survived the edit.
+func reanchorRange(mapping []int, start, end int) (int, int) {
+	newStart, newEnd := -1, -1
+	for i := start; i <= end && i < len(mapping); i++ {
+		if mapping[i] < 0 {
+			continue
+		}
+		if newStart < 0 {
+			newStart = mapping[i]
+		}
+		newEnd = mapping[i]
+	}
+	return newStart, newEnd
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode/utf16"
+)
+
+// Capabilities of the compact protocol
+const (
+	CapCodeDelta   = "code_delta"   // code updates arrive as splices of the previous text
+	CapCompact     = "compact"      // empty fields are left out of every message
+	CapQuestionRef = "question_ref" // question HTML is sent once and then referenced by ID
+)
+
+// Code delta message types
+const (
+	// TypeCodeDelta carries a codeDelta instead of the whole buffer
+	TypeCodeDelta MessageType = "code_delta"
+	// TypeCodeResync asks for the whole buffer after a delta did not apply
+	TypeCodeResync MessageType = "code_resync"
+)
+
+// codeDelta replaces Delete characters at Start with Insert. Offsets count
+// UTF-16 code units, as JavaScript strings do. BaseHash is the textHash of the
+// text the delta applies to, so a client that drifted can ask for a resync.
+type codeDelta struct {
+	Start    int    `json:"start"`
+	Delete   int    `json:"delete"`
+	Insert   string `json:"insert"`
+	BaseHash uint32 `json:"base_hash"`
+}
+
+// textHash is 32-bit FNV-1a over the UTF-16 code units of the text
+func textHash(units []uint16) uint32 {
+	h := uint32(2166136261)
+	for _, u := range units {
+		h ^= uint32(u)
+		h *= 16777619
+	}
+	return h
+}
+
+// computeDelta returns the single splice that turns base into next
+func computeDelta(base, next string) codeDelta {
+	a, b := utf16.Encode([]rune(base)), utf16.Encode([]rune(next))
+
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	// Never split a surrogate pair
+	if start > 0 && utf16.IsSurrogate(rune(a[start-1])) && a[start-1] < 0xdc00 {
+		start--
+	}
+	end := 0
+	for end < len(a)-start && end < len(b)-start && a[len(a)-1-end] == b[len(b)-1-end] {
+		end++
+	}
+	if end > 0 && utf16.IsSurrogate(rune(b[len(b)-end])) && b[len(b)-end] >= 0xdc00 {
+		end--
+	}
+
+	return codeDelta{
+		Start:    start,
+		Delete:   len(a) - start - end,
+		Insert:   string(utf16.Decode(b[start : len(b)-end])),
+		BaseHash: textHash(a),
+	}
+}
+
+// questionID identifies the question HTML of a room
+func questionID(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// updateQuestion stores the question fields sent with a message and returns
+// the ID of the room's question. Caller must hold r.mu.
+func (r *Room) updateQuestion(message *WebSocketMessage) string {
+	changed := false
+	for _, f := range []struct {
+		from string
+		to   *string
+	}{
+		{message.ProblemTitle, &r.ProblemTitle},
+		{message.ProblemDescription, &r.ProblemDescription},
+		{message.QuestionMeta, &r.QuestionMeta},
+		{message.QuestionHints, &r.QuestionHints},
+		{message.QuestionSnippets, &r.QuestionSnippets},
+	} {
+		if f.from != "" && f.from != *f.to {
+			*f.to = f.from
+			changed = true
+		}
+	}
+	if changed || r.QuestionID == "" {
+		r.QuestionID = questionID(r.ProblemTitle, r.ProblemDescription, r.QuestionMeta, r.QuestionHints, r.QuestionSnippets)
+	}
+	return r.QuestionID
+}
+
+// handleCodeResync sends the whole buffer to a client whose delta did not
+// apply. Caller must hold r.mu.
+func (r *Room) handleCodeResync(message *WebSocketMessage) {
+	r.sendTo(message.UserID, &WebSocketMessage{
+		Type:     TypeCode,
+		RoomID:   r.ID,
+		Content:  r.CodeState,
+		Language: r.CurrentLanguage,
+	})
+}
+
+// withoutQuestion returns a copy of message without its question HTML
+func withoutQuestion(message *WebSocketMessage) *WebSocketMessage {
+	out := *message
+	out.ProblemTitle, out.ProblemDescription = "", ""
+	out.QuestionMeta, out.QuestionHints, out.QuestionSnippets = "", "", ""
+	return &out
+}
+
+// compactCode rewrites a code or sync message for clients of the compact
+// protocol. It only runs on the client's writer goroutine.
+func (c *Client) compactCode(p *Protocol, message *WebSocketMessage) *WebSocketMessage {
+	if p.has(CapQuestionRef) && message.QuestionID != "" {
+		if message.QuestionID == c.seenQuestionID {
+			message = withoutQuestion(message)
+		} else if message.ProblemTitle != "" || message.ProblemDescription != "" {
+			c.seenQuestionID = message.QuestionID
+		}
+	}
+
+	if message.Type == TypeCode && p.has(CapCodeDelta) && message.codeBase != nil {
+		code, _ := message.Content.(string)
+		delta := computeDelta(*message.codeBase, code)
+		// A delta that rewrites most of the buffer saves nothing
+		if len(delta.Insert) <= len(code)/2 {
+			out := *message
+			out.Type = TypeCodeDelta
+			out.Content = delta
+			return &out
+		}
+	}
+	return message
+}
+
+// sentWhenEmpty lists the fields of WebSocketMessage that are encoded even
+// when empty, by JSON name. The compact protocol leaves them out.
+var sentWhenEmpty = func() map[string]int {
+	fields := make(map[string]int)
+	t := reflect.TypeOf(WebSocketMessage{})
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || strings.Contains(opts, "omitempty") {
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}()
+
+// encode serializes an outgoing message in the client's format. Compact
+// messages stay JSON rather than a binary framing: the event stream fallback
+// can only carry text, browsers parse JSON natively, and permessage-deflate
+// already squeezes out most of what a binary format would save.
+func (c *Client) encode(message *WebSocketMessage) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil || !c.protocol.Load().has(CapCompact) {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(message).Elem()
+	for name, i := range sentWhenEmpty {
+		if v.Field(i).IsZero() {
+			delete(fields, name)
+		}
+	}
+	return json.Marshal(fields)
+}
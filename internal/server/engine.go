@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/api/idtoken"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+)
+
+var ErrEngineAuth = fmt.Errorf("failed to authenticate with execution engine")
+
+// engineClient calls the execution engine. Its transport propagates the trace
+// context to the engine.
+var engineClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// engineURL returns the execution engine in use
+func engineURL(co *core.Core) string {
+	if co.CodeRunnerEngine == "" {
+		return co.EngineFallbackURL
+	}
+	return co.CodeRunnerEngine
+}
+
+// newEngineRequest builds a request to path on the execution engine, "" being
+// the engine URL itself. Engines not on localhost get a Google ID token with
+// the engine URL as audience; failing that the error wraps ErrEngineAuth.
+func newEngineRequest(ctx context.Context, co *core.Core, method, path string, body io.Reader) (*http.Request, error) {
+	base := engineURL(co)
+	target := base
+	if path != "" {
+		var err error
+		if target, err = url.JoinPath(base, path); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add Authorization header if not running locally
+	if !strings.Contains(base, "localhost") && !strings.Contains(base, "127.0.0.1") {
+		tokenSource, err := idtoken.NewTokenSource(ctx, base)
+		if err != nil {
+			return nil, fmt.Errorf("%w: creating token source: %v", ErrEngineAuth, err)
+		}
+		token, err := tokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%w: fetching ID token: %v", ErrEngineAuth, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+
+	// Set Origin header to satisfy the engine's domain check
+	req.Header.Set("Origin", co.PublicOrigin)
+	return req, nil
+}
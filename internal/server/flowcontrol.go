@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRateLimited = fmt.Errorf("you are sending messages too fast. slow down")
+	ErrSlowingDown = fmt.Errorf("your connection is falling behind the room. some updates may be skipped")
+)
+
+// TypeBackpressure warns a client that its send queue is filling up
+const TypeBackpressure MessageType = "backpressure"
+
+const (
+	codeCoalesceInterval = 50 * time.Millisecond // code updates fanned out per client at most this often
+	limitReplyInterval   = time.Second           // rate limit errors sent to a client at most this often
+	slowClientGrace      = 5 * time.Second       // how long a full send queue is tolerated
+)
+
+// rateLimit is the sustained rate and burst allowed for a message type
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// defaultRateLimit applies to message types missing from rateLimits
+var defaultRateLimit = rateLimit{perSecond: 5, burst: 10}
+
+// rateLimits are per client. Code updates are coalesced on top of their limit,
+// and the newest one the limit refused is still sent once the flood stops.
+var rateLimits = map[MessageType]rateLimit{
+	TypeCode:             {perSecond: 30, burst: 60},
+	TypePresence:         {perSecond: 30, burst: 30},
+	TypeChat:             {perSecond: 2, burst: 5},
+	TypeChatEdit:         {perSecond: 2, burst: 5},
+	TypeChatDelete:       {perSecond: 2, burst: 5},
+	TypeComment:          {perSecond: 2, burst: 5},
+	TypeCommentReply:     {perSecond: 2, burst: 5},
+	TypeWhiteboardStroke: {perSecond: 20, burst: 40},
+	TypeWhiteboardShape:  {perSecond: 20, burst: 40},
+	TypeIceCandidate:     {perSecond: 50, burst: 100},
+	TypeSnapshot:         {perSecond: 1, burst: 3},
+	TypeSnapshotRestore:  {perSecond: 1, burst: 3},
+}
+
+// SocketStats counts messages the server refused or skipped
+type SocketStats struct {
+	RateLimited     int64 `json:"rate_limited"`
+	Coalesced       int64 `json:"coalesced"`
+	Dropped         int64 `json:"dropped"`
+	SlowDisconnects int64 `json:"slow_disconnects"`
+}
+
+// socketStats are the process wide flow control counters
+var socketStats struct {
+	rateLimited     atomic.Int64
+	coalesced       atomic.Int64
+	dropped         atomic.Int64
+	slowDisconnects atomic.Int64
+}
+
+// Stats returns a copy of the flow control counters
+func Stats() SocketStats {
+	return SocketStats{
+		RateLimited:     socketStats.rateLimited.Load(),
+		Coalesced:       socketStats.coalesced.Load(),
+		Dropped:         socketStats.dropped.Load(),
+		SlowDisconnects: socketStats.slowDisconnects.Load(),
+	}
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  rateLimit
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = min(b.limit.burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter holds a client's token buckets. It is only used by readPump.
+type rateLimiter struct {
+	buckets     map[MessageType]*tokenBucket
+	lastReplied time.Time
+}
+
+// allow reports whether the client may send another message of type t
+func (l *rateLimiter) allow(t MessageType) bool {
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[MessageType]*tokenBucket)
+	}
+	b, ok := l.buckets[t]
+	if !ok {
+		limit, ok := rateLimits[t]
+		if !ok {
+			limit = defaultRateLimit
+		}
+		b = &tokenBucket{tokens: limit.burst, last: now, limit: limit}
+		l.buckets[t] = b
+	}
+	return b.allow(now)
+}
+
+// shouldReply reports whether a rate limited client should be told again
+func (l *rateLimiter) shouldReply() bool {
+	now := time.Now()
+	if now.Sub(l.lastReplied) < limitReplyInterval {
+		return false
+	}
+	l.lastReplied = now
+	return true
+}
+
+// codeCoalescer forwards at most one code update per interval and keeps
+// only the newest of the updates sent in between. Code messages carry the
+// whole document, so skipping the older ones loses nothing.
+type codeCoalescer struct {
+	mu       sync.Mutex
+	pending  *WebSocketMessage
+	timer    *time.Timer
+	lastSent time.Time
+}
+
+// submitCode queues a code update on the room, coalescing rapid updates.
+// It returns false when the room is closed.
+func (c *Client) submitCode(msg *WebSocketMessage) bool {
+	cc := &c.coalescer
+	cc.mu.Lock()
+	if cc.timer == nil && time.Since(cc.lastSent) >= codeCoalesceInterval {
+		cc.lastSent = time.Now()
+		cc.mu.Unlock()
+		return c.Room.Submit(msg)
+	}
+	c.holdCodeLocked(msg)
+	cc.mu.Unlock()
+	return true
+}
+
+// holdCode keeps a code update refused by the rate limiter as the one to
+// send next. The update carries the whole buffer, so dropping it could leave
+// the room without the client's final code.
+func (c *Client) holdCode(msg *WebSocketMessage) {
+	c.coalescer.mu.Lock()
+	defer c.coalescer.mu.Unlock()
+	c.holdCodeLocked(msg)
+}
+
+// holdCodeLocked replaces the held back code update with msg and schedules
+// its flush. Caller must hold c.coalescer.mu.
+func (c *Client) holdCodeLocked(msg *WebSocketMessage) {
+	cc := &c.coalescer
+	if cc.pending != nil {
+		socketStats.coalesced.Add(1)
+	}
+	cc.pending = msg
+	if cc.timer == nil {
+		cc.timer = time.AfterFunc(codeCoalesceInterval-time.Since(cc.lastSent), c.flushCode)
+	}
+}
+
+// flushCode submits the newest held back code update, if any
+func (c *Client) flushCode() {
+	cc := &c.coalescer
+	cc.mu.Lock()
+	if cc.timer != nil {
+		cc.timer.Stop()
+		cc.timer = nil
+	}
+	msg := cc.pending
+	cc.pending = nil
+	if msg != nil {
+		cc.lastSent = time.Now()
+	}
+	cc.mu.Unlock()
+
+	if msg != nil {
+		c.Room.Submit(msg)
+	}
+}
+
+// deliver queues a message for one client. A client whose queue fills up is
+// warned first, then loses messages, and is disconnected once it stayed
+// behind for slowClientGrace. Caller must hold r.mu.
+func (r *Room) deliver(client *Client, message *WebSocketMessage) {
+	queued, size := len(client.SendChan), cap(client.SendChan)
+	switch {
+	case queued < size/4:
+		client.backlogSince = time.Time{}
+	case queued >= size*3/4 && client.backlogSince.IsZero():
+		client.backlogSince = time.Now()
+		select {
+		case client.SendChan <- &WebSocketMessage{
+			Type:    TypeBackpressure,
+			RoomID:  r.ID,
+			Content: ErrSlowingDown.Error(),
+		}:
+		default:
+		}
+	}
+
+	select {
+	case client.SendChan <- message:
+	default:
+		socketStats.dropped.Add(1)
+		if client.backlogSince.IsZero() {
+			client.backlogSince = time.Now()
+		}
+		if time.Since(client.backlogSince) >= slowClientGrace {
+			socketStats.slowDisconnects.Add(1)
+			r.log.Warn("disconnecting slow client", "user_id", client.UserID, "queued", queued)
+			r.removeClient(client, TypeBackpressure)
+		}
+	}
+}
+
+// SocketStatsHandler reports the flow control counters
+func SocketStatsHandler(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(w, http.StatusOK, Stats())
+}
@@ -2,18 +2,20 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode"
-	"google.golang.org/api/idtoken"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"bytes"
 	"encoding/base64"
@@ -32,19 +34,52 @@ var (
 	ErrJoinFailed       = fmt.Errorf("failed to join room. please try again")
 )
 
+// executionsInFlight counts running executions, which shutdown waits for
+var executionsInFlight atomic.Int64
+
 func ExecuteCodeHandler(w http.ResponseWriter, r *http.Request) {
+	executionsInFlight.Add(1)
+	defer executionsInFlight.Add(-1)
+
 	var req ExecuteCodeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		SendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid request body"))
 		return
 	}
-	log.Printf("ExecuteCodeHandler: RoomID=%s, UserID=%s, Language=%s", req.RoomID, req.UserID, req.Language)
 
 	// Grab the templ from the context
 	co := r.Context().Value("core").(*core.Core)
 
-	// Context timeout of 3 seconds as requested
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	// Only a member holding the room's join token may share output with it
+	var room *Room
+	var member *Client
+	if req.RoomID != "" {
+		claims, err := verifyJoinToken(co.TokenSecret, requestToken(r), req.RoomID)
+		if err != nil {
+			SendErrorResponse(w, http.StatusUnauthorized, err)
+			return
+		}
+		var ok bool
+		if room, ok = lookupRoom(req.RoomID); !ok {
+			SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+			return
+		}
+		room.mu.RLock()
+		member = room.clientBySubject(claims.Subject)
+		room.mu.RUnlock()
+		if member == nil {
+			SendErrorResponse(w, http.StatusForbidden, ErrUserNotHere)
+			return
+		}
+	}
+
+	lo := logger(r).With("room_id", req.RoomID)
+	if member != nil {
+		lo = lo.With("user_id", member.UserID)
+	}
+	lo.Info("executing code", "language", req.Language)
+
+	ctx, cancel := context.WithTimeout(r.Context(), co.ExecuteTimeout)
 	defer cancel()
 
 	// Base64 encode the code
@@ -56,6 +91,12 @@ func ExecuteCodeHandler(w http.ResponseWriter, r *http.Request) {
 		lang = "cpp"
 	}
 
+	ctx, span := tracer.Start(ctx, "execute code", trace.WithAttributes(
+		attribute.String("code.language", lang),
+		attribute.String("room.id", req.RoomID),
+	))
+	defer span.End()
+
 	// Prepare payload for execution engine
 	engineReq := map[string]string{
 		"language": lang,
@@ -69,54 +110,29 @@ func ExecuteCodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	engineURL := co.CodeRunnerEngine // os.Getenv("CODE_RUNNER_ENGINE_API")
-	if engineURL == "" {
-		engineURL = "https://code-execution-engine-797087556919.asia-south1.run.app"
+	proxyReq, err := newEngineRequest(ctx, co, "POST", "", bytes.NewBuffer(payload))
+	if errors.Is(err, ErrEngineAuth) {
+		lo.Error("failed to authenticate with execution engine", "err", err)
+		SendErrorResponse(w, http.StatusInternalServerError, ErrEngineAuth)
+		return
 	}
-
-	proxyReq, err := http.NewRequestWithContext(ctx, "POST", engineURL, bytes.NewBuffer(payload))
 	if err != nil {
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("failed to create request"))
 		return
 	}
 	proxyReq.Header.Set("Content-Type", "application/json")
 
-	// Add Authorization header if not running locally
-	if !strings.Contains(engineURL, "localhost") && !strings.Contains(engineURL, "127.0.0.1") {
-		// Create an ID token source for the target audience (the engine URL)
-		tokenSource, err := idtoken.NewTokenSource(ctx, engineURL)
-		if err != nil {
-			log.Printf("Failed to create token source: %v", err)
-			SendErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("authentication configuration error"))
-			return
-		}
-
-		token, err := tokenSource.Token()
-		if err != nil {
-			log.Printf("Failed to fetch ID token: %v", err)
-			SendErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("failed to authenticate with execution engine"))
-			return
-		}
-
-		proxyReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-	}
-
-	// Set Origin header to satisfy the engine's domain check
-
-	proxyReq.Header.Set("Origin", "https://practice-leetcode-multiplayer-797087556919.asia-south1.run.app")
-
-	client := &http.Client{}
-
-	resp, err := client.Do(proxyReq)
+	start := time.Now()
+	resp, err := engineClient.Do(proxyReq)
 
 	if err != nil {
 
 		if ctx.Err() == context.DeadlineExceeded {
-
+			observeExecution(ctx, lang, "timeout", start)
 			SendErrorResponse(w, http.StatusGatewayTimeout, fmt.Errorf("execution timed out"))
 
 		} else {
+			observeExecution(ctx, lang, "error", start)
 			SendErrorResponse(w, http.StatusBadGateway, fmt.Errorf("failed to call execution engine: %v", err))
 		}
 		return
@@ -125,47 +141,37 @@ func ExecuteCodeHandler(w http.ResponseWriter, r *http.Request) {
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
+		observeExecution(ctx, lang, "error", start)
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("failed to read response"))
 		return
 	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		observeExecution(ctx, lang, "ok", start)
+	} else {
+		observeExecution(ctx, lang, "engine_error", start)
+	}
 
 	// Broadcast execution result to room
-	if req.RoomID != "" {
+	if room != nil {
 		var execResp map[string]interface{}
 		if err := json.Unmarshal(body, &execResp); err == nil {
-			log.Printf("Broadcasting execution output to room %s", req.RoomID)
-			roomManager.mu.RLock()
-			room, exists := roomManager.Rooms[req.RoomID]
-			roomManager.mu.RUnlock()
-
-			if exists {
-				var role string
-				// Find role of the user
-				room.mu.RLock()
-				for client := range room.Clients {
-					if client.UserID == req.UserID {
-						role = client.Role
-						break
-					}
-				}
-				room.mu.RUnlock()
-
-				msg := &WebSocketMessage{
-					Type:    TypeExecutionOutput,
-					RoomID:  req.RoomID,
-					UserID:  req.UserID,
-					Role:    role,
-					Content: execResp,
-				}
-				// Use non-blocking send to avoid hanging if channel is full
-				select {
-				case room.Broadcast <- msg:
-				default:
-					log.Printf("Warning: room %s broadcast channel full, dropping execution output", req.RoomID)
-				}
+			lo.Debug("broadcasting execution output")
+			msg := &WebSocketMessage{
+				Type:    TypeExecutionOutput,
+				RoomID:  room.ID,
+				UserID:  member.UserID,
+				Role:    member.Role,
+				Content: execResp,
+			}
+			// Use non-blocking send to avoid hanging if channel is full
+			select {
+			case room.Broadcast <- msg:
+			default:
+				broadcastsDropped.Inc()
+				lo.Warn("room broadcast channel full, dropping execution output")
 			}
 		} else {
-			log.Printf("Failed to unmarshal execution response for broadcast: %v", err)
+			lo.Error("failed to unmarshal execution response for broadcast", "err", err)
 		}
 	}
 
@@ -191,7 +197,10 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 			count := len(room.Clients)
 			room.mu.RUnlock()
 
-			if count < 2 {
+			co := r.Context().Value("core").(*core.Core)
+			canJoin := count < settings.Load().RoomCapacity && !room.IsLocked() && !room.IsBanned(clientIP(r))
+
+			if canJoin && room.Authorize(co.TokenSecret, r.FormValue("passcode"), r.FormValue("invite")) == nil {
 				// Prepare data for HomePage
 				data := CollaborativeRoomPageData{
 					Title:                     "Practice Leetcode Multiplayer",
@@ -200,7 +209,7 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 					Room: RoomResponse{
 						RoomID:       roomID,
 						Message:      "Joined via link",
-						WebSocketURL: "/ws?room_id=" + roomID,
+						WebSocketURL: joinWebSocketURL(co.TokenSecret, roomID),
 					},
 				}
 				if err := tmpl.ExecuteTemplate(w, "Index", data); err != nil {
@@ -239,7 +248,6 @@ func JoinCollaborativeSessionHandler(w http.ResponseWriter, r *http.Request) {
 	roomManager.mu.RLock()
 	room, exists := roomManager.Rooms[roomID]
 	roomManager.mu.RUnlock()
-	log.Println("room ==== ", room, "roomID=", roomID)
 	if !exists {
 		SendErrorResponse(w, http.StatusBadRequest, ErrInvalidRoomId)
 		return
@@ -248,11 +256,6 @@ func JoinCollaborativeSessionHandler(w http.ResponseWriter, r *http.Request) {
 	SendJSONResponse(w, http.StatusOK, room)
 }
 
-// HealthHandler handles the API healthz params.
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	SendJSONResponse(w, http.StatusOK, "hurray. api is working fine.")
-}
-
 type SearchSuggestionData struct {
 	Suggestions []leetcode.SearchQuestion
 }
@@ -266,12 +269,13 @@ func SearchSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	co := r.Context().Value("core").(*core.Core)
+	ctx, cancel := context.WithTimeout(r.Context(), co.LeetcodeTimeout)
 	defer cancel()
 
-	questions, err := leetcode.SearchQuestionsListFromLeetcode(ctx, keyword)
+	questions, err := co.Leetcode.SearchQuestionsListFromLeetcode(ctx, keyword)
 	if err != nil {
-		log.Printf("Error fetching suggestions: %v", err)
+		logger(r).Error("error fetching suggestions", "err", err)
 		return
 	}
 
@@ -301,12 +305,12 @@ func SearchSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
 
 	t, err := template.New("suggestions").Parse(suggestionsTmpl)
 	if err != nil {
-		log.Printf("Error parsing suggestions template: %v", err)
+		logger(r).Error("error parsing suggestions template", "err", err)
 		return
 	}
 
 	if err := t.Execute(w, data); err != nil {
-		log.Printf("Error executing suggestions template: %v", err)
+		logger(r).Error("error executing suggestions template", "err", err)
 	}
 }
 
@@ -323,10 +327,11 @@ func SearchQuestionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	co := r.Context().Value("core").(*core.Core)
+	ctx, cancel := context.WithTimeout(r.Context(), co.LeetcodeTimeout)
 	defer cancel()
 
-	graphQLOutput, err := leetcode.FetchQuestionByTitleSlugFromLeetcodeGql(ctx, questionSlug)
+	graphQLOutput, err := co.Leetcode.FetchQuestionByTitleSlugFromLeetcodeGql(ctx, questionSlug)
 	if err != nil {
 		data := QuestionData{Error: "Failed to fetch question: " + err.Error()}
 		if err := tmpl.ExecuteTemplate(w, "QuestionBlock", data); err != nil {
@@ -371,12 +376,13 @@ func SearchQuestionHandler(w http.ResponseWriter, r *http.Request) {
 func CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
 	// Grab the templ from the context
 	tmpl := r.Context().Value("template").(*template.Template)
+	co := r.Context().Value("core").(*core.Core)
 
 	// Generate a unique room ID
 	roomID := uuid.New().String()
 
 	roomManager.mu.Lock()
-	if len(roomManager.Rooms) >= roomManager.maxRooms {
+	if len(roomManager.Rooms) >= settings.Load().MaxRooms {
 		roomManager.cleanupOldRooms()
 	}
 
@@ -385,6 +391,11 @@ func CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
 	roomManager.Rooms[roomID] = room
 	roomManager.mu.Unlock()
 
+	// An optional passcode makes the room private
+	if passcode := r.FormValue("passcode"); passcode != "" {
+		room.SetPasscode(passcode)
+	}
+
 	// Setting up the data
 	data := CollaborativeRoomPageData{
 		Title:                     "Practice Leetcode Multiplayer",
@@ -393,7 +404,7 @@ func CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
 		Room: RoomResponse{
 			RoomID:       roomID,
 			Message:      "Room created successfully",
-			WebSocketURL: "/ws?room_id=" + roomID,
+			WebSocketURL: joinWebSocketURL(co.TokenSecret, roomID),
 		},
 	}
 
@@ -428,11 +439,26 @@ func JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 	clientCount := len(room.Clients)
 	room.mu.RUnlock()
 
-	if clientCount >= 2 {
+	if clientCount >= settings.Load().RoomCapacity {
 		SendErrorResponse(w, http.StatusConflict, ErrRoomFullMsg)
 		return
 	}
 
+	if room.IsBanned(clientIP(r)) {
+		SendErrorResponse(w, http.StatusForbidden, ErrBannedUser)
+		return
+	}
+	if room.IsLocked() {
+		SendErrorResponse(w, http.StatusLocked, ErrRoomLocked)
+		return
+	}
+
+	co := r.Context().Value("core").(*core.Core)
+	if err := room.Authorize(co.TokenSecret, r.FormValue("passcode"), r.FormValue("invite")); err != nil {
+		SendErrorResponse(w, http.StatusForbidden, err)
+		return
+	}
+
 	// Setting up the data
 	data := CollaborativeRoomPageData{
 		Title:                     "Practice Leetcode Multiplayer",
@@ -441,7 +467,7 @@ func JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 		Room: RoomResponse{
 			RoomID:       roomID,
 			Message:      "Room joined successfully",
-			WebSocketURL: "/ws?room_id=" + roomID,
+			WebSocketURL: joinWebSocketURL(co.TokenSecret, roomID),
 		},
 	}
 
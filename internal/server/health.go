@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+)
+
+// draining is set once shutdown starts, so load balancers stop routing here
+var draining atomic.Bool
+
+// roomStore is the store rooms are saved to, nil when persistence is off
+var roomStore RoomStore
+
+// requiredTemplates are the templates the handlers execute
+var requiredTemplates = []string{"Index", "HomePage", "QuestionBlock"}
+
+// CheckResult is the outcome of one dependency check
+type CheckResult struct {
+	Status    string  `json:"status"` // "ok", "failing" or "disabled"
+	Critical  bool    `json:"critical"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	State     string  `json:"state,omitempty"` // Circuit breaker state, for dependencies behind one
+}
+
+// Readiness is the readiness report. Status is "ok", "degraded" when only
+// non critical checks fail, "unavailable" when a critical one does and
+// "draining" during shutdown.
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// healthCheck probes one dependency. Critical dependencies make the server
+// unready when failing; the others only degrade it.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error // nil when the dependency is disabled
+	state    func() string                   // Breaker state after the check, if any
+}
+
+// LivenessHandler reports that the process is up and serving requests
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadinessHandler checks every dependency concurrently, each within the
+// ready timeout, and answers 503 unless the critical ones pass
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	co := r.Context().Value("core").(*core.Core)
+	tmpl, _ := r.Context().Value("template").(*template.Template)
+
+	checks := []healthCheck{
+		{name: "templates", critical: true, check: func(context.Context) error { return checkTemplates(tmpl) }},
+		{name: "store", critical: true},
+		{name: "engine", check: func(ctx context.Context) error { return checkEngine(ctx, co) }},
+		{name: "leetcode", check: co.Leetcode.Ping, state: co.Leetcode.BreakerState},
+	}
+	if roomStore != nil {
+		checks[1].check = func(context.Context) error { return roomStore.Check() }
+	}
+
+	report := Readiness{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runCheck(r.Context(), c, co.ReadyTimeout)
+			mu.Lock()
+			report.Checks[c.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status != "failing":
+		case result.Critical:
+			report.Status = "unavailable"
+		case report.Status == "ok":
+			report.Status = "degraded"
+		}
+	}
+	if draining.Load() {
+		report.Status = "draining"
+	}
+
+	status := http.StatusOK
+	if report.Status == "unavailable" || report.Status == "draining" {
+		status = http.StatusServiceUnavailable
+		logger(r).Warn("not ready", "status", report.Status)
+	}
+	SendJSONResponse(w, status, report)
+}
+
+// runCheck runs c within timeout and times it
+func runCheck(ctx context.Context, c healthCheck, timeout time.Duration) CheckResult {
+	result := CheckResult{Status: "disabled", Critical: c.critical}
+	if c.check == nil {
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.check(ctx)
+	result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	result.Status = "ok"
+	if err != nil {
+		result.Status, result.Error = "failing", err.Error()
+	}
+	if c.state != nil {
+		result.State = c.state()
+	}
+	return result
+}
+
+// checkTemplates makes sure every template a handler executes was parsed
+func checkTemplates(tmpl *template.Template) error {
+	if tmpl == nil {
+		return fmt.Errorf("templates are not loaded")
+	}
+	for _, name := range requiredTemplates {
+		if tmpl.Lookup(name) == nil {
+			return fmt.Errorf("template %s is missing", name)
+		}
+	}
+	return nil
+}
+
+// checkEngine calls the execution engine's /health
+func checkEngine(ctx context.Context, co *core.Core) error {
+	req, err := newEngineRequest(ctx, co, "GET", "/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := engineClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("engine health http error: status=%d", resp.StatusCode)
+	}
+	return nil
+}
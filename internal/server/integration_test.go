@@ -0,0 +1,1007 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server/servertest"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/utils"
+)
+
+func TestRoomJoinAndLeave(t *testing.T) {
+	h := servertest.Start(t)
+
+	alice := h.NewRoom()
+	if alice.RoomID == "" || alice.UserID == "" {
+		t.Fatalf("sync without room or user: %+v", alice.Sync)
+	}
+	if alice.Sync.OwnerID != alice.UserID {
+		t.Errorf("owner = %q, want the first member %q", alice.Sync.OwnerID, alice.UserID)
+	}
+
+	bob := h.Join(alice.RoomID)
+	if len(bob.Sync.ConnectedUsers) != 1 || bob.Sync.ConnectedUsers[0].UserID != alice.UserID {
+		t.Errorf("bob's sync lists %+v, want alice", bob.Sync.ConnectedUsers)
+	}
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	bob.Close()
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+}
+
+func TestCodeLanguageAndChat(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.SendCode("print('hi')")
+	if code := bob.ExpectFrom(server.TypeCode, alice.UserID); code.Content != "print('hi')" {
+		t.Errorf("bob got code %v", code.Content)
+	}
+
+	bob.SetLanguage("java")
+	for _, b := range []*servertest.Bot{alice, bob} {
+		if msg := b.Expect(server.TypeLanguageChange); msg.Language != "java" {
+			t.Errorf("%s: language = %q, want java", b.UserID, msg.Language)
+		}
+	}
+
+	bob.Chat("ready when you are")
+	var got server.ChatMessage
+	alice.Decode(alice.Expect(server.TypeChat), &got)
+	if got.Text != "ready when you are" || got.UserID != bob.UserID {
+		t.Errorf("alice got chat %+v", got)
+	}
+
+	// A late joiner gets everything in its sync
+	alice.SetLanguage("python")
+	alice.SendCode("x = 1")
+	bob.ExpectFunc(func(msg server.WebSocketMessage) bool {
+		return msg.Type == server.TypeCode && msg.Content == "x = 1"
+	}, "the python code")
+	bob.Close()
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+
+	carol := h.Join(alice.RoomID)
+	if carol.Sync.Content != "x = 1" || carol.Sync.Language != "python" {
+		t.Errorf("carol synced %q in %q", carol.Sync.Content, carol.Sync.Language)
+	}
+	if carol.Sync.CodeBuffers["java"] != "" {
+		t.Errorf("java draft = %q, want empty", carol.Sync.CodeBuffers["java"])
+	}
+	if len(carol.Sync.ChatHistory) != 1 {
+		t.Errorf("chat history has %d messages, want 1", len(carol.Sync.ChatHistory))
+	}
+}
+
+func TestExecutionOutputReachesRoom(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+
+	status, result := alice.Execute(h, "Python", "print(input())", "42\n")
+	if status != http.StatusOK || result.Stdout != "42\n" {
+		t.Fatalf("execute = %d %+v", status, result)
+	}
+	runs := h.Engine.Executions()
+	if len(runs) != 1 || runs[0].Language != "python" || runs[0].Code != "print(input())" {
+		t.Errorf("engine got %+v", runs)
+	}
+
+	for _, b := range []*servertest.Bot{alice, bob} {
+		out := b.Expect(server.TypeExecutionOutput)
+		var got servertest.Result
+		b.Decode(out, &got)
+		if out.UserID != alice.UserID || got.Stdout != "42\n" {
+			t.Errorf("%s: output %+v from %q", b.UserID, got, out.UserID)
+		}
+	}
+}
+
+func TestExecutionNeedsJoinToken(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+
+	if status, _ := h.Execute(alice.RoomID, "", "Python", "print(1)", ""); status != http.StatusUnauthorized {
+		t.Errorf("execute without a token = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if runs := h.Engine.Executions(); len(runs) != 0 {
+		t.Errorf("engine ran %d executions for a rejected request", len(runs))
+	}
+
+	// The output is attributed to the token's holder, whatever the body says
+	payload := fmt.Sprintf(`{"room_id": %q, "user_id": %q, "language": "Python", "code": "print(1)"}`, alice.RoomID, alice.UserID)
+	req, _ := http.NewRequest(http.MethodPost, h.URL+"/api/execute-code", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+bob.Token)
+	resp, err := h.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("execute with a member's token = %d", resp.StatusCode)
+	}
+	if out := alice.Expect(server.TypeExecutionOutput); out.UserID != bob.UserID {
+		t.Errorf("output from %q, want the token's holder %q", out.UserID, bob.UserID)
+	}
+}
+
+func TestFullRoomRefusesJoins(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	h.Join(alice.RoomID)
+
+	resp, err := h.Client().PostForm(h.URL+"/api/join-room", url.Values{"room_id": {alice.RoomID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("join status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestCodeBeforeLanguageChangeIsKept(t *testing.T) {
+	h := servertest.Start(t, func(cfg *core.Config) { cfg.RoomCapacity = 3 })
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	// The page sends its language with every keystroke, before anyone picked one
+	alice.Send(server.WebSocketMessage{Type: server.TypeCode, RoomID: alice.RoomID, Content: "x = 1", Language: "Python"})
+	if msg := bob.Expect(server.TypeLanguageChange); msg.Language != "python" {
+		t.Errorf("bob switched to %q, want python", msg.Language)
+	}
+	if code := bob.ExpectFrom(server.TypeCode, alice.UserID); code.Content != "x = 1" {
+		t.Errorf("bob got code %v", code.Content)
+	}
+
+	carol := h.Join(alice.RoomID)
+	if carol.Sync.Content != "x = 1" || carol.Sync.Language != "python" {
+		t.Errorf("carol synced %q in %q", carol.Sync.Content, carol.Sync.Language)
+	}
+}
+
+func TestLateCodeForLanguageLeftIsADraft(t *testing.T) {
+	h := servertest.Start(t, func(cfg *core.Config) { cfg.RoomCapacity = 3 })
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.SetLanguage("python")
+	alice.SendCode("x = 1")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	bob.SetLanguage("java")
+	alice.Expect(server.TypeLanguageChange)
+	bob.Drain()
+
+	// A keystroke typed before alice saw the switch
+	alice.Send(server.WebSocketMessage{Type: server.TypeCode, RoomID: alice.RoomID, Content: "x = 2", Language: "python"})
+	if msg := alice.Expect(server.TypeLanguageChange); msg.Language != "java" {
+		t.Errorf("alice was told the room is in %q, want java", msg.Language)
+	}
+	bob.ExpectNone(200*time.Millisecond, server.TypeCode)
+
+	carol := h.Join(alice.RoomID)
+	if carol.Sync.Language != "java" || carol.Sync.CodeBuffers["python"] != "x = 2" {
+		t.Errorf("carol synced %q with drafts %v", carol.Sync.Language, carol.Sync.CodeBuffers)
+	}
+}
+
+func TestRoomAPINeedsJoinToken(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	api := h.URL + "/api/rooms/" + alice.RoomID
+
+	resp, err := h.Client().Get(api + "/snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("snapshots without a token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp, err = h.Client().Get(api + "/snapshots?token=" + url.QueryEscape(bob.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("snapshots with a member's token = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Knowing the owner's user ID is not enough to act as the owner
+	for _, tc := range []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"member with owner id", url.Values{"token": {bob.Token}, "user_id": {alice.UserID}}, http.StatusForbidden},
+		{"owner", url.Values{"token": {alice.Token}}, http.StatusCreated},
+	} {
+		resp, err := h.Client().PostForm(api+"/invites", tc.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: invite status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.Send(server.WebSocketMessage{Type: server.TypeSnapshot, RoomID: alice.RoomID, Content: "empty"})
+	var snap struct {
+		ID int `json:"id"`
+	}
+	alice.Decode(alice.Expect(server.TypeSnapshot), &snap)
+
+	var code strings.Builder
+	for i := range utils.MaxDiffLines + 1 {
+		fmt.Fprintf(&code, "%d\n", i)
+	}
+	alice.SendCode(code.String())
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+
+	diff := fmt.Sprintf("%s/api/rooms/%s/snapshots/diff?from=%d&token=%s", h.URL, alice.RoomID, snap.ID, url.QueryEscape(alice.Token))
+	resp, err := h.Client().Get(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("diff of %d new lines = %d, want %d", utils.MaxDiffLines+1, resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestCommentsFollowTheirLines(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.SendCode("a = 1\nb = 2\nc = 3")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	alice.Send(server.WebSocketMessage{
+		Type:    server.TypeComment,
+		RoomID:  alice.RoomID,
+		Content: map[string]any{"start_line": 1, "end_line": 1, "text": "why 2?"},
+	})
+	var thread server.CommentThread
+	bob.Decode(bob.Expect(server.TypeComment), &thread)
+
+	moved := func(code string) server.CommentThread {
+		t.Helper()
+		alice.SendCode(code)
+		var threads []server.CommentThread
+		bob.Decode(bob.Expect(server.TypeCommentMove), &threads)
+		if len(threads) != 1 || threads[0].ID != thread.ID {
+			t.Fatalf("moved threads = %+v, want thread %d", threads, thread.ID)
+		}
+		return threads[0]
+	}
+
+	// Lines inserted above push the thread down
+	if got := moved("import os\n\na = 1\nb = 2\nc = 3"); got.StartLine != 3 || got.EndLine != 3 || got.Outdated {
+		t.Errorf("after inserting two lines: %+v, want line 3", got)
+	}
+	// Edits elsewhere leave it alone
+	alice.SendCode("import os\n\na = 1\nb = 2\nc = 4")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	bob.ExpectNone(100*time.Millisecond, server.TypeCommentMove)
+	// Rewriting the commented line outdates it
+	if got := moved("import os\n\na = 1\nb = 20\nc = 4"); !got.Outdated {
+		t.Errorf("after rewriting the line: %+v, want outdated", got)
+	}
+
+	// A final newline does not start a line that could be commented
+	alice.SendCode("a = 1\n")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	alice.Send(server.WebSocketMessage{
+		Type:    server.TypeComment,
+		RoomID:  alice.RoomID,
+		Content: map[string]any{"start_line": 1, "end_line": 1, "text": "nothing here"},
+	})
+	if msg := alice.Expect(server.TypeError); msg.Content != server.ErrInvalidLines.Error() {
+		t.Errorf("comment after the final newline: %v, want %q", msg.Content, server.ErrInvalidLines)
+	}
+}
+
+func TestDeleteAndResolveByID(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.Chat("typo")
+	var chat server.ChatMessage
+	bob.Decode(bob.Expect(server.TypeChat), &chat)
+	alice.SendCode("a = 1")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	alice.Send(server.WebSocketMessage{
+		Type:    server.TypeComment,
+		RoomID:  alice.RoomID,
+		Content: map[string]any{"start_line": 0, "end_line": 0, "text": "rename a"},
+	})
+	var thread server.CommentThread
+	bob.Decode(bob.Expect(server.TypeComment), &thread)
+
+	// Items are named by a bare ID or by the payload
+	for _, tc := range []struct {
+		typ     server.MessageType
+		content any
+	}{
+		{server.TypeChatDelete, chat.ID},
+		{server.TypeCommentResolve, thread.ID},
+		{server.TypeCommentResolve, map[string]any{"thread_id": thread.ID, "resolved": false}},
+	} {
+		alice.Send(server.WebSocketMessage{Type: tc.typ, RoomID: alice.RoomID, Content: tc.content})
+		bob.ExpectFrom(tc.typ, alice.UserID)
+	}
+	alice.ExpectNone(100*time.Millisecond, server.TypeError)
+}
+
+func TestCompactClearedCode(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID, server.CapCodeBuffers, server.CapCompact)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.SendCode("a = 1")
+	bob.ExpectFrom(server.TypeCode, alice.UserID)
+	alice.SendCode("")
+	if msg := bob.ExpectFrom(server.TypeCode, alice.UserID); msg.Content != "" {
+		t.Errorf("cleared code content = %#v, want an empty string", msg.Content)
+	}
+}
+
+func TestWhiteboardLimits(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	stroke := func(b *servertest.Bot, points int) {
+		t.Helper()
+		content := make([]server.Point, points)
+		for i := range content {
+			content[i] = server.Point{X: float64(i), Y: float64(i)}
+		}
+		b.Send(server.WebSocketMessage{
+			Type:    server.TypeWhiteboardStroke,
+			RoomID:  b.RoomID,
+			Content: map[string]any{"points": content},
+		})
+	}
+
+	erase := func(b *servertest.Bot, id int) {
+		b.Send(server.WebSocketMessage{Type: server.TypeWhiteboardErase, RoomID: b.RoomID, Content: id})
+	}
+	var element server.WhiteboardElement
+
+	// A member may erase their own drawings and clear a board with only those
+	stroke(bob, 2)
+	alice.Decode(alice.ExpectFrom(server.TypeWhiteboardStroke, bob.UserID), &element)
+	erase(bob, element.ID)
+	alice.ExpectFrom(server.TypeWhiteboardErase, bob.UserID)
+	stroke(bob, 2)
+	alice.ExpectFrom(server.TypeWhiteboardStroke, bob.UserID)
+	bob.Send(server.WebSocketMessage{Type: server.TypeWhiteboardClear, RoomID: bob.RoomID})
+	alice.ExpectFrom(server.TypeWhiteboardClear, bob.UserID)
+
+	// The board holds a fixed number of points in total
+	for range 10 {
+		stroke(alice, 5000)
+		bob.Decode(bob.ExpectFrom(server.TypeWhiteboardStroke, alice.UserID), &element)
+	}
+	stroke(bob, 1)
+	if msg := bob.Expect(server.TypeError); msg.Content != server.ErrWhiteboardFull.Error() {
+		t.Errorf("stroke on a full board: %v, want %q", msg.Content, server.ErrWhiteboardFull)
+	}
+
+	// Drawings of others are only erased or cleared by the owner
+	erase(bob, element.ID)
+	if msg := bob.Expect(server.TypeError); msg.Content != server.ErrClearForbidden.Error() {
+		t.Errorf("member erasing the owner's drawing: %v, want %q", msg.Content, server.ErrClearForbidden)
+	}
+	bob.Send(server.WebSocketMessage{Type: server.TypeWhiteboardClear, RoomID: bob.RoomID})
+	if msg := bob.Expect(server.TypeError); msg.Content != server.ErrClearForbidden.Error() {
+		t.Errorf("member clearing the owner's drawings: %v, want %q", msg.Content, server.ErrClearForbidden)
+	}
+	alice.Send(server.WebSocketMessage{Type: server.TypeWhiteboardClear, RoomID: alice.RoomID})
+	bob.ExpectFrom(server.TypeWhiteboardClear, alice.UserID)
+	stroke(bob, 1)
+	alice.Decode(alice.ExpectFrom(server.TypeWhiteboardStroke, bob.UserID), &element)
+	erase(alice, element.ID)
+	bob.ExpectFrom(server.TypeWhiteboardErase, alice.UserID)
+}
+
+func TestThrottledCursorArrivesAfterTheWindow(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+	alice.Drain()
+
+	cursor := func(line int) {
+		bob.Send(server.WebSocketMessage{
+			Type:    server.TypePresence,
+			RoomID:  bob.RoomID,
+			Content: map[string]any{"cursor": map[string]int{"line": line, "ch": 0}},
+		})
+	}
+	atLine := func(line int) func(server.WebSocketMessage) bool {
+		return func(msg server.WebSocketMessage) bool {
+			var p server.Presence
+			if msg.Type != server.TypePresence || msg.UserID != bob.UserID {
+				return false
+			}
+			alice.Decode(msg, &p)
+			return p.Cursor != nil && p.Cursor.Line == line
+		}
+	}
+
+	// The last of a burst is held back by the throttle, not by the status ticker
+	start := time.Now()
+	cursor(1)
+	cursor(2)
+	cursor(3)
+	alice.ExpectFunc(atLine(1), "the first cursor")
+	alice.ExpectFunc(atLine(3), "the last cursor")
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("the last cursor took %v", took)
+	}
+}
+
+func TestInviteTokenIsNotAJoinToken(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	api := h.URL + "/api/rooms/" + alice.RoomID
+
+	resp, err := h.Client().PostForm(api+"/invites", url.Values{"token": {alice.Token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Data server.InviteResponse `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	invite := body.Data
+	if invite.Token == "" {
+		t.Fatalf("no invite token, status %d", resp.StatusCode)
+	}
+
+	// Replaying the invite must not open a socket or the room APIs
+	conn, _, err := h.Dial("/ws?room_id="+url.QueryEscape(alice.RoomID)+"&token="+url.QueryEscape(invite.Token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(servertest.DefaultTimeout))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, server.CloseTokenInvalid) {
+		t.Errorf("socket with an invite token: %v, want close code %d", err, server.CloseTokenInvalid)
+	}
+
+	resp, err = h.Client().Get(api + "/snapshots?token=" + url.QueryEscape(invite.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("room API with an invite token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestMuteOutlivesReconnect(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bobPath := h.JoinPath(alice.RoomID)
+	bob := h.Connect(bobPath)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	mute := func(target string) {
+		alice.Send(server.WebSocketMessage{Type: server.TypeChatMute, RoomID: alice.RoomID, TargetUserID: target, Content: true})
+	}
+	muted := func(b *servertest.Bot) {
+		t.Helper()
+		b.Chat("still here")
+		if msg := b.Expect(server.TypeError); msg.Content != server.ErrChatMuted.Error() {
+			t.Errorf("chat of a muted member: %v, want %q", msg.Content, server.ErrChatMuted)
+		}
+	}
+
+	mute(bob.UserID)
+	bob.ExpectFunc(func(msg server.WebSocketMessage) bool {
+		return msg.Type == server.TypeChatMute && msg.TargetUserID == bob.UserID
+	}, "the mute")
+	muted(bob)
+
+	// Reloading the page connects with a new user ID but the same token
+	bob.Close()
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+	bob = h.Connect(bobPath)
+	muted(bob)
+
+	// A user who is not in the room cannot be muted ahead of time
+	mute("nobody")
+	if msg := alice.Expect(server.TypeError); msg.Content != server.ErrUserNotHere.Error() {
+		t.Errorf("muting a user who is not here: %v, want %q", msg.Content, server.ErrUserNotHere)
+	}
+}
+
+func TestIndexAndScrapesAreCounted(t *testing.T) {
+	h := servertest.Start(t)
+	scrape := func() string {
+		t.Helper()
+		resp, err := h.Client().Get(h.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		if _, err := io.Copy(&body, resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		return body.String()
+	}
+
+	resp, err := h.Client().Get(h.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	scrape()
+
+	text := scrape()
+	for _, series := range []string{
+		`plm_http_requests_total{route="GET /",method="GET",code="200"}`,
+		`plm_http_requests_total{route="GET /metrics",method="GET",code="200"}`,
+	} {
+		if !strings.Contains(text, series+" ") {
+			t.Errorf("no %s in the scrape", series)
+		}
+	}
+}
+
+func TestBannedMemberStaysOut(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bobPath := h.JoinPath(alice.RoomID)
+	bob := h.ConnectFrom("10.0.0.2", bobPath)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	alice.Send(server.WebSocketMessage{Type: server.TypeBan, RoomID: alice.RoomID, TargetUserID: bob.UserID})
+	bob.ExpectFrom(server.TypeBan, bob.UserID)
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+
+	// The same page is turned away from another address
+	conn, _, err := h.Dial(bobPath, http.Header{"X-Forwarded-For": {"10.0.0.3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(servertest.DefaultTimeout))
+	conn.WriteJSON(server.WebSocketMessage{
+		Type:    server.TypeHello,
+		Content: map[string]any{"version": server.MaxProtocolVersion, "capabilities": servertest.DefaultCapabilities},
+	})
+	for {
+		var msg server.WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("banned page rejoining: %v before an error", err)
+		}
+		if msg.Type == server.TypeSync {
+			t.Fatal("banned page rejoined the room")
+		}
+		if msg.Type == server.TypeError {
+			if msg.Content != server.ErrBannedUser.Error() {
+				t.Errorf("banned page rejoining: %v, want %q", msg.Content, server.ErrBannedUser)
+			}
+			break
+		}
+	}
+
+	// And a new page from the banned address never gets a socket
+	_, resp, err := h.Dial(h.JoinPath(alice.RoomID), http.Header{"X-Forwarded-For": {"10.0.0.2"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("new page from the banned address: %v, want status %d", err, http.StatusForbidden)
+	}
+	alice.ExpectNone(100*time.Millisecond, server.TypeJoin)
+}
+
+func TestOnlyTheOwnerModerates(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	notOwner := func(b *servertest.Bot) {
+		t.Helper()
+		if msg := b.Expect(server.TypeError); msg.Content != server.ErrNotRoomOwner.Error() {
+			t.Errorf("%s moderating: %v, want %q", b.UserID, msg.Content, server.ErrNotRoomOwner)
+		}
+	}
+
+	// A member cannot kick the owner
+	bob.Send(server.WebSocketMessage{Type: server.TypeKick, RoomID: bob.RoomID, TargetUserID: alice.UserID})
+	notOwner(bob)
+	alice.ExpectNone(100*time.Millisecond, server.TypeKick, server.TypeLeave)
+
+	// Ownership moves on transfer, and with it the right to moderate
+	alice.Send(server.WebSocketMessage{Type: server.TypeTransferOwner, RoomID: alice.RoomID, TargetUserID: bob.UserID})
+	for _, b := range []*servertest.Bot{alice, bob} {
+		if msg := b.Expect(server.TypeOwnerChange); msg.OwnerID != bob.UserID {
+			t.Errorf("%s: owner = %q after the transfer, want %q", b.UserID, msg.OwnerID, bob.UserID)
+		}
+	}
+	alice.Send(server.WebSocketMessage{Type: server.TypeKick, RoomID: alice.RoomID, TargetUserID: bob.UserID})
+	notOwner(alice)
+
+	// And to the longest connected member when the owner leaves
+	bob.Close()
+	if msg := alice.Expect(server.TypeOwnerChange); msg.OwnerID != alice.UserID {
+		t.Errorf("owner = %q after the owner left, want %q", msg.OwnerID, alice.UserID)
+	}
+}
+
+func TestCodeFloodKeepsTheFinalBuffer(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+
+	// Far more updates than the burst, each a whole buffer
+	const updates = 200
+	for i := range updates {
+		alice.SendCode(fmt.Sprintf("x = %d", i))
+	}
+	if msg := alice.Expect(server.TypeError); msg.Content != server.ErrRateLimited.Error() {
+		t.Errorf("flooding client got %v, want %q", msg.Content, server.ErrRateLimited)
+	}
+
+	final := fmt.Sprintf("x = %d", updates-1)
+	received := 0
+	bob.ExpectFunc(func(msg server.WebSocketMessage) bool {
+		if msg.Type != server.TypeCode {
+			return false
+		}
+		received++
+		return msg.Content == final
+	}, "the final buffer")
+	if received >= updates {
+		t.Errorf("bob got %d code updates, want the flood thinned out", received)
+	}
+	bob.ExpectNone(100*time.Millisecond, server.TypeCode)
+
+	bob.Close()
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+	late := h.Join(alice.RoomID)
+	if late.Sync.Content != final {
+		t.Errorf("late joiner synced %q, want %q", late.Sync.Content, final)
+	}
+}
+
+func TestEventStreamAndSocketShareARoom(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+	bob := h.ConnectSSE(h.JoinPath(alice.RoomID))
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+	if len(bob.Sync.ConnectedUsers) != 1 || bob.Sync.ConnectedUsers[0].UserID != alice.UserID {
+		t.Errorf("stream client's sync lists %+v, want alice", bob.Sync.ConnectedUsers)
+	}
+
+	// Messages cross between the transports both ways
+	alice.SendCode("a = 1")
+	if msg := bob.ExpectFrom(server.TypeCode, alice.UserID); msg.Content != "a = 1" {
+		t.Errorf("stream client got code %v", msg.Content)
+	}
+	bob.SendCode("a = 2")
+	if msg := alice.ExpectFrom(server.TypeCode, bob.UserID); msg.Content != "a = 2" {
+		t.Errorf("socket client got code %v", msg.Content)
+	}
+	bob.Chat("over the stream")
+	var got server.ChatMessage
+	alice.Decode(alice.Expect(server.TypeChat), &got)
+	if got.Text != "over the stream" || got.UserID != bob.UserID {
+		t.Errorf("socket client got chat %+v", got)
+	}
+
+	bob.Close()
+	alice.ExpectFrom(server.TypeLeave, bob.UserID)
+}
+
+func TestRoomsSurviveARestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "rooms.json")
+	withState := func(cfg *core.Config) { cfg.StateFile = stateFile }
+
+	h := servertest.Start(t, withState)
+	alice := h.NewRoom()
+	alice.SetLanguage("java")
+	alice.Expect(server.TypeLanguageChange)
+	alice.SendCode("class Solution {}")
+	alice.Chat("saved?")
+	alice.Expect(server.TypeChat)
+	alice.Send(server.WebSocketMessage{
+		Type:    server.TypeWhiteboardStroke,
+		RoomID:  alice.RoomID,
+		Content: map[string]any{"points": []server.Point{{X: 1, Y: 2}, {X: 3, Y: 4}}},
+	})
+	alice.Expect(server.TypeWhiteboardStroke)
+	roomID := alice.RoomID
+	h.Close()
+
+	// A new server on the same store brings the room back
+	h = servertest.Start(t, withState)
+	bob := h.Join(roomID)
+	if bob.Sync.Content != "class Solution {}" || bob.Sync.Language != "java" {
+		t.Errorf("restored code %q in %q", bob.Sync.Content, bob.Sync.Language)
+	}
+	if len(bob.Sync.ChatHistory) != 1 || bob.Sync.ChatHistory[0].Text != "saved?" {
+		t.Errorf("restored chat %+v", bob.Sync.ChatHistory)
+	}
+	if len(bob.Sync.Whiteboard) != 1 || len(bob.Sync.Whiteboard[0].Points) != 2 {
+		t.Errorf("restored whiteboard %+v", bob.Sync.Whiteboard)
+	}
+	if bob.Sync.OwnerID != bob.UserID {
+		t.Errorf("owner = %q, want the first member to return", bob.Sync.OwnerID)
+	}
+}
+
+// adminStatus sends an admin API request with token, none when empty, and
+// returns its status code
+func adminStatus(t *testing.T, h *servertest.Harness, method, path, token string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, h.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := h.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestIdleRoomsAreClosed(t *testing.T) {
+	const adminToken = "admin-secret"
+	h := servertest.Start(t, func(cfg *core.Config) {
+		cfg.RoomIdleTTL = 100 * time.Millisecond
+		cfg.AdminToken = adminToken
+	})
+	alice := h.NewRoom()
+	bob := h.Join(alice.RoomID)
+	alice.ExpectFrom(server.TypeJoin, bob.UserID)
+	room := "/api/admin/rooms/" + alice.RoomID
+
+	// A room with members is never idle
+	time.Sleep(300 * time.Millisecond)
+	if status := adminStatus(t, h, http.MethodGet, room, adminToken); status != http.StatusOK {
+		t.Fatalf("occupied room = %d, want %d", status, http.StatusOK)
+	}
+
+	alice.Close()
+	bob.Close()
+	deadline := time.Now().Add(servertest.DefaultTimeout)
+	for adminStatus(t, h, http.MethodGet, room, adminToken) != http.StatusNotFound {
+		if time.Now().After(deadline) {
+			t.Fatal("empty room still open after its idle TTL")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAdminAPINeedsAdminToken(t *testing.T) {
+	const adminToken = "admin-secret"
+	h := servertest.Start(t, func(cfg *core.Config) { cfg.AdminToken = adminToken })
+	alice := h.NewRoom()
+	room := "/api/admin/rooms/" + alice.RoomID
+
+	requests := []struct{ method, path string }{
+		{http.MethodGet, "/api/admin/rooms"},
+		{http.MethodGet, room},
+		{http.MethodDelete, room},
+		{http.MethodPost, room + "/announce?message=hi"},
+		{http.MethodPost, "/api/admin/announce?message=hi"},
+		{http.MethodGet, "/api/admin/socket-stats"},
+	}
+	for _, token := range []string{"", "wrong", alice.Token} {
+		for _, req := range requests {
+			if status := adminStatus(t, h, req.method, req.path, token); status != http.StatusUnauthorized {
+				t.Errorf("%s %s with token %q = %d, want %d", req.method, req.path, token, status, http.StatusUnauthorized)
+			}
+		}
+	}
+	alice.ExpectNone(100*time.Millisecond, server.TypeAnnouncement)
+
+	if status := adminStatus(t, h, http.MethodGet, "/api/admin/rooms", adminToken); status != http.StatusOK {
+		t.Errorf("rooms with the admin token = %d, want %d", status, http.StatusOK)
+	}
+	if status := adminStatus(t, h, http.MethodDelete, room, adminToken); status != http.StatusOK {
+		t.Errorf("closing a room with the admin token = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestAdminAPIOffWithoutToken(t *testing.T) {
+	h := servertest.Start(t)
+	if status := adminStatus(t, h, http.MethodGet, "/api/admin/rooms", ""); status != http.StatusUnauthorized {
+		t.Errorf("admin API without a configured token = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// readRaw reads frames from a raw socket until one of type typ and returns
+// it with its fields as sent, failing after DefaultTimeout. Types read on the
+// way are returned in seen.
+func readRaw(t *testing.T, conn *websocket.Conn, typ server.MessageType) (msg server.WebSocketMessage, fields map[string]json.RawMessage, seen []server.MessageType) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(servertest.DefaultTimeout))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		msg, fields = server.WebSocketMessage{}, nil
+		json.Unmarshal(data, &msg)
+		json.Unmarshal(data, &fields)
+		if msg.Type == typ {
+			return msg, fields, seen
+		}
+		seen = append(seen, msg.Type)
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	h := servertest.Start(t, func(cfg *core.Config) { cfg.HandshakeTimeout = 10 * time.Second })
+	alice := h.NewRoom()
+
+	tests := []struct {
+		name    string
+		hello   map[string]any
+		want    server.HelloReply
+		wantErr error
+	}{
+		{
+			name:  "newer client",
+			hello: map[string]any{"version": 99, "capabilities": []string{server.CapChat, "teleport"}},
+			want:  server.HelloReply{Version: 2, MinVersion: 1, MaxVersion: 2, Capabilities: []string{server.CapChat}},
+		},
+		{
+			name:  "version 1 ignores declared capabilities",
+			hello: map[string]any{"version": 1, "capabilities": []string{server.CapChat, server.CapWhiteboard}},
+			want:  server.HelloReply{Version: 1, MinVersion: 1, MaxVersion: 2, Capabilities: []string{server.CapCall}},
+		},
+		{
+			name:    "unsupported version",
+			hello:   map[string]any{"version": 0},
+			wantErr: server.ErrUnsupportedVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := h.Dial(h.JoinPath(alice.RoomID), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.WriteJSON(server.WebSocketMessage{Type: server.TypeHello, Content: tt.hello})
+
+			if tt.wantErr != nil {
+				msg, _, _ := readRaw(t, conn, server.TypeError)
+				if text, _ := msg.Content.(string); !strings.HasSuffix(text, tt.wantErr.Error()) {
+					t.Errorf("hello error = %v, want %q", msg.Content, tt.wantErr)
+				}
+				return
+			}
+			msg, _, _ := readRaw(t, conn, server.TypeHello)
+			var got server.HelloReply
+			alice.Decode(msg, &got)
+			if got.Version != tt.want.Version || got.MinVersion != tt.want.MinVersion || got.MaxVersion != tt.want.MaxVersion ||
+				strings.Join(got.Capabilities, ",") != strings.Join(tt.want.Capabilities, ",") {
+				t.Errorf("hello reply = %+v, want %+v", got, tt.want)
+			}
+			sync, _, _ := readRaw(t, conn, server.TypeSync)
+			conn.Close()
+			alice.ExpectFrom(server.TypeLeave, sync.UserID)
+		})
+	}
+}
+
+func TestVersion1ClientJoinsOnFirstMessage(t *testing.T) {
+	h := servertest.Start(t, func(cfg *core.Config) { cfg.HandshakeTimeout = 10 * time.Second })
+	alice := h.NewRoom()
+	alice.Chat("before you came")
+	alice.Expect(server.TypeChat)
+
+	conn, _, err := h.Dial(h.JoinPath(alice.RoomID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.WriteJSON(server.WebSocketMessage{Type: server.TypeCode, RoomID: alice.RoomID, Content: "old = True"})
+
+	// It joins at once, with only the state version 1 knows about
+	sync, fields, _ := readRaw(t, conn, server.TypeSync)
+	if took := time.Since(start); took > servertest.DefaultTimeout/2 {
+		t.Errorf("joining took %v", took)
+	}
+	for _, field := range []string{"chat_history", "code_buffers", "owner_id"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("version 1 sync has %s", field)
+		}
+	}
+	if msg := alice.ExpectFrom(server.TypeCode, sync.UserID); msg.Content != "old = True" {
+		t.Errorf("first message of the version 1 client = %v", msg.Content)
+	}
+
+	// Chat is left out and a language change brings the code along
+	alice.Chat("can you see this?")
+	alice.SetLanguage("java")
+	change, _, seen := readRaw(t, conn, server.TypeLanguageChange)
+	if slices.Contains(seen, server.TypeChat) {
+		t.Errorf("version 1 client got chat: %v", seen)
+	}
+	if change.Content != nil || change.Language != "java" {
+		t.Errorf("language change %+v, want java without drafts", change)
+	}
+	if code, _, _ := readRaw(t, conn, server.TypeCode); code.Language != "java" || code.Content != "" {
+		t.Errorf("code after the language change = %q in %q, want the empty java buffer", code.Content, code.Language)
+	}
+}
+
+func TestCompactLeavesOutEmptyFields(t *testing.T) {
+	h := servertest.Start(t)
+	alice := h.NewRoom()
+
+	conn, _, err := h.Dial(h.JoinPath(alice.RoomID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(server.WebSocketMessage{Type: server.TypeHello, Content: map[string]any{
+		"version":      2,
+		"capabilities": []string{server.CapCompact},
+	}})
+	sync, _, _ := readRaw(t, conn, server.TypeSync)
+	alice.ExpectFrom(server.TypeJoin, sync.UserID)
+
+	// Empty fields are left out, but an empty buffer is still content
+	alice.SendCode("")
+	_, fields, _ := readRaw(t, conn, server.TypeCode)
+	for _, field := range []string{"problem_title", "problem_description"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("compact code message has %s", field)
+		}
+	}
+	if content := string(fields["content"]); content != `""` {
+		t.Errorf("compact code content = %s, want an empty string", content)
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoomClosed        = fmt.Errorf("room has been closed")
+	ErrEmptyAnnouncement = fmt.Errorf("announcement message is empty")
+	ErrServerRestarting  = fmt.Errorf("the server is restarting. reload the page in a moment to continue where you left off")
+)
+
+// reaperInterval is how often idle rooms are looked for
+const reaperInterval = time.Minute
+
+// RoomSummary is the admin view of a room
+type RoomSummary struct {
+	ID           string     `json:"id"`
+	Users        []UserInfo `json:"users"`
+	OwnerID      string     `json:"owner_id,omitempty"`
+	Locked       bool       `json:"locked"`
+	Private      bool       `json:"private"`
+	Language     string     `json:"language,omitempty"`
+	ProblemTitle string     `json:"problem_title,omitempty"`
+	Snapshots    int        `json:"snapshots"`
+	ChatMessages int        `json:"chat_messages"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastActiveAt time.Time  `json:"last_active_at"`
+}
+
+// Summary returns the admin view of the room
+func (r *Room) Summary() RoomSummary {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]UserInfo, 0, len(r.Clients))
+	for c := range r.Clients {
+		users = append(users, UserInfo{UserID: c.UserID, Role: c.Role, Color: c.Color, Transport: c.Transport.Name()})
+	}
+	return RoomSummary{
+		ID:           r.ID,
+		Users:        users,
+		OwnerID:      r.OwnerID,
+		Locked:       r.Locked,
+		Private:      r.passcodeHash != "",
+		Language:     r.CurrentLanguage,
+		ProblemTitle: r.ProblemTitle,
+		Snapshots:    len(r.Snapshots),
+		ChatMessages: len(r.Chat),
+		CreatedAt:    r.CreatedAt,
+		LastActiveAt: r.LastActiveAt,
+	}
+}
+
+// isIdle reports whether the room has had no members for at least ttl
+func (r *Room) isIdle(ttl time.Duration) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.Clients) == 0 && time.Since(r.LastActiveAt) >= ttl
+}
+
+// Close stops the room's goroutine. Connected clients are told the room
+// closed and disconnected. It is safe to call Close more than once.
+func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// Closed returns a channel that is closed once the room shuts down
+func (r *Room) Closed() <-chan struct{} {
+	return r.done
+}
+
+// Submit queues a message on the room's broadcast loop. It returns false
+// when the room is already closed.
+func (r *Room) Submit(message *WebSocketMessage) bool {
+	select {
+	case r.Broadcast <- message:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// shutdown disconnects every client once the room is closed. Caller must hold r.mu.
+func (r *Room) shutdown() {
+	for client := range r.Clients {
+		select {
+		case client.SendChan <- &WebSocketMessage{
+			Type:    TypeRoomClosed,
+			RoomID:  r.ID,
+			Content: ErrRoomClosed.Error(),
+		}:
+		default:
+		}
+		close(client.SendChan)
+		delete(r.Clients, client)
+	}
+	r.Presence = nil
+}
+
+// removeRoom unregisters and closes a room. Caller must hold rm.mu.
+func (rm *RoomManager) removeRoom(id string) {
+	if room, ok := rm.Rooms[id]; ok {
+		delete(rm.Rooms, id)
+		room.Close()
+	}
+}
+
+// reapIdleRooms closes every room that has been empty for longer than idleTTL
+func (rm *RoomManager) reapIdleRooms(idleTTL time.Duration) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for id, room := range rm.Rooms {
+		if room.isIdle(idleTTL) {
+			room.log.Info("closing idle room", "idle_ttl", idleTTL)
+			rm.removeRoom(id)
+		}
+	}
+}
+
+// StartReaper periodically closes rooms that stayed empty for idleTTL until
+// the returned function is called
+func (rm *RoomManager) StartReaper(idleTTL time.Duration) (stop func()) {
+	if idleTTL <= 0 {
+		slog.Info("room reaper disabled", "idle_ttl", idleTTL)
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(min(reaperInterval, idleTTL))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rm.reapIdleRooms(idleTTL)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return sync.OnceFunc(func() { close(done) })
+}
+
+// summaries returns the admin view of every room, newest first
+func (rm *RoomManager) summaries() []RoomSummary {
+	rm.mu.RLock()
+	rooms := make([]*Room, 0, len(rm.Rooms))
+	for _, room := range rm.Rooms {
+		rooms = append(rooms, room)
+	}
+	rm.mu.RUnlock()
+
+	out := make([]RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		out = append(out, room.Summary())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// announcementFromRequest reads the announcement text of an admin request
+func announcementFromRequest(r *http.Request) (*WebSocketMessage, error) {
+	text := strings.TrimSpace(r.FormValue("message"))
+	if text == "" {
+		return nil, ErrEmptyAnnouncement
+	}
+	return &WebSocketMessage{
+		Type:    TypeAnnouncement,
+		Content: text,
+	}, nil
+}
+
+// AdminListRoomsHandler lists every active room
+func AdminListRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(w, http.StatusOK, roomManager.summaries())
+}
+
+// AdminGetRoomHandler inspects a single room
+func AdminGetRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, room.Summary())
+}
+
+// AdminCloseRoomHandler disconnects everyone and removes the room
+func AdminCloseRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("room_id")
+
+	roomManager.mu.Lock()
+	_, ok := roomManager.Rooms[roomID]
+	if ok {
+		roomManager.removeRoom(roomID)
+	}
+	roomManager.mu.Unlock()
+
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, "room closed")
+}
+
+// AdminAnnounceRoomHandler broadcasts an announcement to one room
+func AdminAnnounceRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+	msg, err := announcementFromRequest(r)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	msg.RoomID = room.ID
+	if !room.Submit(msg) {
+		SendErrorResponse(w, http.StatusGone, ErrRoomClosed)
+		return
+	}
+	SendJSONResponse(w, http.StatusAccepted, "announcement sent")
+}
+
+// AdminAnnounceAllHandler broadcasts an announcement to every room
+func AdminAnnounceAllHandler(w http.ResponseWriter, r *http.Request) {
+	msg, err := announcementFromRequest(r)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sent := 0
+	for _, room := range roomManager.rooms() {
+		roomMsg := *msg
+		roomMsg.RoomID = room.ID
+		if room.Submit(&roomMsg) {
+			sent++
+		}
+	}
+	SendJSONResponse(w, http.StatusAccepted, map[string]int{"rooms": sent})
+}
+
+// rooms returns every open room
+func (rm *RoomManager) rooms() []*Room {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	rooms := make([]*Room, 0, len(rm.Rooms))
+	for _, room := range rm.Rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// announceShutdown tells every member that the server is going away. The
+// notice is queued ahead of anything the rooms send afterwards.
+func (rm *RoomManager) announceShutdown() {
+	for _, room := range rm.rooms() {
+		room.mu.Lock()
+		room.fanout(&WebSocketMessage{
+			Type:    TypeAnnouncement,
+			RoomID:  room.ID,
+			Content: ErrServerRestarting.Error(),
+		}, "")
+		room.mu.Unlock()
+	}
+}
+
+// saveRooms writes the state of every room to store
+func (rm *RoomManager) saveRooms(store RoomStore) error {
+	rooms := rm.rooms()
+	states := make([]RoomState, 0, len(rooms))
+	for _, room := range rooms {
+		room.mu.RLock()
+		states = append(states, room.state())
+		room.mu.RUnlock()
+	}
+	if err := store.Save(states); err != nil {
+		return err
+	}
+	slog.Info("saved rooms", "rooms", len(states))
+	return nil
+}
+
+// closeAll disconnects everyone and removes every room
+func (rm *RoomManager) closeAll() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for id := range rm.Rooms {
+		rm.removeRoom(id)
+	}
+}
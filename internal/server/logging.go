@@ -0,0 +1,31 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+// requestIDHeader carries the request ID in both directions, so IDs from a
+// proxy in front of the server are kept
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits which incoming IDs are trusted into logs and headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the ID sent by the caller when it is well formed and a
+// new one otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	return randomSecret(8)
+}
+
+// logger returns the logger of a request, which carries its request ID
+func logger(r *http.Request) *slog.Logger {
+	if lo, ok := r.Context().Value("logger").(*slog.Logger); ok {
+		return lo
+	}
+	return slog.Default()
+}
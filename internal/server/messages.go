@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+)
+
+var (
+	ErrMalformedMessage   = fmt.Errorf("message is not valid JSON")
+	ErrUnknownMessageType = fmt.Errorf("unknown message type")
+	ErrMissingTarget      = fmt.Errorf("target_user_id is required")
+	ErrMissingLanguage    = fmt.Errorf("language is required")
+	ErrMissingSignal      = fmt.Errorf("signaling payload is required")
+	ErrInvalidContent     = fmt.Errorf("content has the wrong shape for this message type")
+	ErrCodeTooLarge       = fmt.Errorf("code is too large")
+	ErrQuestionTooLarge   = fmt.Errorf("question content is too large")
+)
+
+const (
+	maxCodeSize     = 256 * 1024 // bytes of code per update
+	maxQuestionSize = 256 * 1024 // bytes of problem and question HTML per update
+	maxLanguageName = 32
+)
+
+// Call readiness message types, relayed to the peer only
+const (
+	TypeCallReady MessageType = "call_ready"
+	TypeCallEnded MessageType = "call_ended"
+)
+
+// codePayload is the content of a code message
+type codePayload string
+
+// togglePayload is the content of room_lock and chat_mute messages; a missing
+// value switches the setting on
+type togglePayload *bool
+
+// snapshotPayload is the optional name of a snapshot message
+type snapshotPayload string
+
+// messageSchema describes a message type clients are allowed to send
+type messageSchema struct {
+	// payload returns a pointer the content must decode into, nil if the
+	// type carries no content
+	payload func() any
+	// validate checks the decoded envelope, if set
+	validate func(msg *WebSocketMessage) error
+}
+
+// clientMessages lists every message type a client may send. Everything else,
+// such as sync, join or owner_change, is produced by the server only.
+var clientMessages = map[MessageType]messageSchema{
+	TypeCode:             {payload: func() any { return new(codePayload) }, validate: validateCode},
+	TypeLanguageChange:   {validate: validateLanguage},
+	TypeChat:             {validate: validateChat},
+	TypeChatEdit:         {payload: func() any { return new(chatPayload) }},
+	TypeChatDelete:       {validate: idOrPayload(func() any { return new(chatPayload) })},
+	TypeChatMute:         {validate: requireTarget},
+	TypePresence:         {payload: func() any { return new(presencePayload) }},
+	TypeComment:          {payload: func() any { return new(commentPayload) }},
+	TypeCommentReply:     {payload: func() any { return new(commentPayload) }},
+	TypeCommentResolve:   {validate: idOrPayload(func() any { return new(commentPayload) })},
+	TypeWhiteboardStroke: {payload: func() any { return new(WhiteboardElement) }},
+	TypeWhiteboardShape:  {payload: func() any { return new(WhiteboardElement) }},
+	TypeWhiteboardErase:  {validate: validateID},
+	TypeWhiteboardClear:  {},
+	TypeSnapshot:         {payload: func() any { return new(snapshotPayload) }},
+	TypeSnapshotRestore:  {validate: validateID},
+	TypeKick:             {validate: requireTarget},
+	TypeBan:              {validate: requireTarget},
+	TypeTransferOwner:    {validate: requireTarget},
+	TypeRoomLock:         {payload: func() any { return new(togglePayload) }},
+	TypeOffer:            {validate: validateSignal},
+	TypeAnswer:           {validate: validateSignal},
+	TypeIceCandidate:     {validate: validateSignal},
+	TypeCallReady:        {},
+	TypeCallEnded:        {},
+	TypeHello:            {validate: validateHello},
+	TypeCodeResync:       {},
+}
+
+// parseClientMessage decodes a frame from a client and checks it against the
+// schema of its type
+func parseClientMessage(data []byte) (*WebSocketMessage, error) {
+	var msg WebSocketMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, ErrMalformedMessage
+	}
+	schema, ok := clientMessages[msg.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMessageType, msg.Type)
+	}
+	if schema.payload != nil && msg.Content != nil {
+		if err := decodeContent(msg.Content, schema.payload()); err != nil {
+			return nil, fmt.Errorf("invalid %s message: %w", msg.Type, ErrInvalidContent)
+		}
+	}
+	if schema.validate != nil {
+		if err := schema.validate(&msg); err != nil {
+			return nil, fmt.Errorf("invalid %s message: %w", msg.Type, err)
+		}
+	}
+	return &msg, nil
+}
+
+// validateCode limits the size of code and question updates
+func validateCode(msg *WebSocketMessage) error {
+	code, _ := msg.Content.(string)
+	if len(code) > maxCodeSize {
+		return ErrCodeTooLarge
+	}
+	if len(msg.Language) > maxLanguageName {
+		return ErrInvalidContent
+	}
+	question := len(msg.ProblemTitle) + len(msg.ProblemDescription) +
+		len(msg.QuestionMeta) + len(msg.QuestionHints) + len(msg.QuestionSnippets)
+	if question > maxQuestionSize {
+		return ErrQuestionTooLarge
+	}
+	return nil
+}
+
+// validateLanguage requires the language being switched to
+func validateLanguage(msg *WebSocketMessage) error {
+	lang := normalizeLanguage(msg.Language)
+	if lang == "" {
+		return ErrMissingLanguage
+	}
+	if len(lang) > maxLanguageName {
+		return ErrInvalidContent
+	}
+	return nil
+}
+
+// validateChat accepts chat content as plain text or a chatPayload
+func validateChat(msg *WebSocketMessage) error {
+	if _, err := chatPayloadFromContent(msg.Content); err != nil {
+		return ErrInvalidContent
+	}
+	return nil
+}
+
+// validateID requires content that names an item by its numeric ID
+func validateID(msg *WebSocketMessage) error {
+	if _, ok := intFromContent(msg.Content); !ok {
+		return ErrInvalidContent
+	}
+	return nil
+}
+
+// idOrPayload accepts content that names an item by its numeric ID or
+// decodes into the payload
+func idOrPayload(payload func() any) func(msg *WebSocketMessage) error {
+	return func(msg *WebSocketMessage) error {
+		if _, ok := intFromContent(msg.Content); ok {
+			return nil
+		}
+		if err := decodeContent(msg.Content, payload()); err != nil {
+			return ErrInvalidContent
+		}
+		return nil
+	}
+}
+
+// requireTarget requires the user an action applies to
+func requireTarget(msg *WebSocketMessage) error {
+	if msg.TargetUserID == "" {
+		return ErrMissingTarget
+	}
+	return nil
+}
+
+// validateSignal requires the peer and payload of a WebRTC signaling message
+func validateSignal(msg *WebSocketMessage) error {
+	if err := requireTarget(msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case TypeOffer, TypeAnswer:
+		if msg.SDP == nil {
+			return ErrMissingSignal
+		}
+	case TypeIceCandidate:
+		if msg.IceCandidate == nil {
+			return ErrMissingSignal
+		}
+	}
+	return nil
+}
+
+// replyError tells the client its last message was rejected. It is only
+// called by receive.
+func (c *Client) replyError(err error) {
+	c.Room.mu.RLock()
+	defer c.Room.mu.RUnlock()
+	// The room closes SendChan when the client leaves. Until the client
+	// joins, SendChan is only written by receive, like the hello reply.
+	if c.joined.Load() && !c.Room.Clients[c] {
+		return
+	}
+	select {
+	case c.SendChan <- &WebSocketMessage{
+		Type:    TypeError,
+		RoomID:  c.Room.ID,
+		Content: err.Error(),
+	}:
+	default:
+	}
+}
+
+// recoverPanic keeps a bad message from killing the room goroutine. It must be
+// deferred directly by the code it guards.
+func (r *Room) recoverPanic(event string) {
+	if p := recover(); p != nil {
+		r.log.Error("recovered from panic", "event", event, "panic", p, "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/metrics"
+)
+
+// Metrics served on /metrics. Socket flow control counters are read from
+// socketStats, so the admin socket stats and the metrics always agree.
+var (
+	messagesReceived = metrics.NewCounterVec("plm_socket_messages_received_total",
+		"Messages received from room members by type; malformed messages have type invalid.", "type")
+	broadcastsDropped = metrics.NewCounter("plm_room_broadcasts_dropped_total",
+		"Server side messages not queued because the room's broadcast channel was full.")
+	executionDuration = metrics.NewHistogramVec("plm_code_execution_duration_seconds",
+		"Latency of code executions by language and outcome.", metrics.DefaultBuckets, "language", "outcome")
+	httpRequests = metrics.NewCounterVec("plm_http_requests_total",
+		"HTTP requests by route pattern, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogramVec("plm_http_request_duration_seconds",
+		"Latency of HTTP requests by route pattern and method.", metrics.DefaultBuckets, "route", "method")
+)
+
+func init() {
+	metrics.NewGaugeFunc("plm_rooms_active", "Rooms held in memory.", func() float64 {
+		roomManager.mu.RLock()
+		defer roomManager.mu.RUnlock()
+		return float64(len(roomManager.Rooms))
+	})
+	metrics.NewGaugeFunc("plm_clients_active", "Clients joined to a room, on any transport.", func() float64 {
+		clients := 0
+		for _, room := range roomManager.rooms() {
+			room.mu.RLock()
+			clients += len(room.Clients)
+			room.mu.RUnlock()
+		}
+		return float64(clients)
+	})
+	metrics.NewGaugeFunc("plm_code_executions_in_flight", "Code executions waiting on the engine.", func() float64 {
+		return float64(executionsInFlight.Load())
+	})
+	metrics.NewCounterFunc("plm_socket_messages_dropped_total", "Messages dropped because a client's send queue was full.", func() float64 {
+		return float64(socketStats.dropped.Load())
+	})
+	metrics.NewCounterFunc("plm_socket_messages_rate_limited_total", "Client messages refused by the rate limiter.", func() float64 {
+		return float64(socketStats.rateLimited.Load())
+	})
+	metrics.NewCounterFunc("plm_socket_code_updates_coalesced_total", "Code updates replaced by a newer one before they were sent.", func() float64 {
+		return float64(socketStats.coalesced.Load())
+	})
+	metrics.NewCounterFunc("plm_socket_slow_disconnects_total", "Clients disconnected for falling behind their room.", func() float64 {
+		return float64(socketStats.slowDisconnects.Load())
+	})
+	metrics.NewGaugeFunc("plm_goroutines", "Goroutines of the process.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	metrics.NewGaugeFunc("plm_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return float64(mem.HeapAlloc)
+	})
+}
+
+// executionLanguages bounds the language label to the languages the engine runs
+var executionLanguages = map[string]bool{"python": true, "java": true, "javascript": true, "cpp": true}
+
+// observeExecution records the outcome of a code execution that started at
+// start, in the metrics and on the execution's span
+func observeExecution(ctx context.Context, lang, outcome string, start time.Time) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("execution.outcome", outcome))
+	if outcome != "ok" {
+		span.SetStatus(codes.Error, outcome)
+	}
+
+	if !executionLanguages[lang] {
+		lang = "other"
+	}
+	executionDuration.With(lang, outcome).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush on event streams
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands the connection to the WebSocket upgrader
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// MetricsMiddleware counts requests and their latency by route pattern
+func MetricsMiddleware() Middleware {
+	return func(hf http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			hf(rec, r)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			httpRequests.With(r.Pattern, r.Method, strconv.Itoa(rec.status)).Inc()
+			httpDuration.With(r.Pattern, r.Method).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// MetricsHandler serves every metric in the Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Handler().ServeHTTP(w, r)
+}
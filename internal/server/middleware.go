@@ -2,35 +2,56 @@ package server
 
 import (
 	"context"
-	"log"
+	"crypto/subtle"
+	"fmt"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
 )
 
+var ErrUnauthorized = fmt.Errorf("unauthorized")
+
+// tracer starts the spans of the server package
+var tracer = otel.Tracer("github.com/sounishnath003/practice-leetcode-multiplayer/internal/server")
+
 // DefaultMiddlwareTracker is a global middleware that logs every request.
 func DefaultMiddlwareTracker(next http.Handler, co *core.Core) http.Handler {
 
 	// Parse the templates and store
 	// Add template into the Request Context to be used by All routes
-	tmpl, err := ParseTemplates("templates/*.html")
+	tmpl, err := ParseTemplates(filepath.Join(co.TemplateDir, "*.html"))
 	if err != nil {
-		log.Printf("[ERROR]: error occurred while parsing the templates: %v", err)
+		co.Lo.Error("error occurred while parsing the templates", "err", err)
 		panic(err)
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		log.Printf("[DefaultMiddlwareTracker]: Started method=%s, path=%s, remoteAddr=%s", r.Method, r.URL.Path, r.RemoteAddr)
+
+		// Every response and log line of the request carries its ID
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+		w.Header().Set("X-Tracker-ID", id)
+		lo := co.Lo.With("request_id", id)
+		lo.Info("request started", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+
 		// Added template in request context
 		ctx := context.WithValue(r.Context(), "template", tmpl)
 		// Added Core in request context
 		ctx = context.WithValue(ctx, "core", co)
+		// Added the request's logger in request context
+		ctx = context.WithValue(ctx, "logger", lo)
 		newCtx := r.WithContext(ctx)
 
 		next.ServeHTTP(w, newCtx)
-		log.Printf("[DefaultMiddlwareTracker]: Completed remoteAddr=%s, method=%s, path=%s in time=%v", r.RemoteAddr, r.Method, r.URL.Path, time.Since(start))
+		lo.Info("request completed", "method", r.Method, "path", r.URL.Path, "duration", time.Since(start))
 	})
 }
 
@@ -39,9 +60,77 @@ type Middleware func(http.HandlerFunc) http.HandlerFunc
 func LoggerMiddleware() Middleware {
 	return func(hf http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("[LoggerMiddlware]: path=%s, remoteAddr=%s", r.URL.Path, r.RemoteAddr)
+			logger(r).Debug("handling request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			hf(w, r)
+		}
+	}
+}
+
+// AdminAuthMiddleware only lets requests carrying the configured admin token
+// through. The admin API is disabled when no token is configured.
+func AdminAuthMiddleware() Middleware {
+	return func(hf http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			co := r.Context().Value("core").(*core.Core)
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if co.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(co.AdminToken)) != 1 {
+				logger(r).Warn("admin request rejected", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+				SendErrorResponse(w, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			hf(w, r)
+		}
+	}
+}
+
+// RoomTokenMiddleware lets only members reach the API of a room: the request
+// must carry the join token of the room's page, as a token parameter or a
+// bearer token. Handlers read its claims with requestJoinClaims.
+func RoomTokenMiddleware() Middleware {
+	return func(hf http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			co := r.Context().Value("core").(*core.Core)
+			claims, err := verifyJoinToken(co.TokenSecret, requestToken(r), r.PathValue("room_id"))
+			if err != nil {
+				logger(r).Warn("room request rejected", "path", r.URL.Path, "err", err)
+				SendErrorResponse(w, http.StatusUnauthorized, err)
+				return
+			}
+			hf(w, r.WithContext(context.WithValue(r.Context(), "join_claims", claims)))
+		}
+	}
+}
+
+// requestToken returns the join token of a request, given as a token
+// parameter or a bearer token
+func requestToken(r *http.Request) string {
+	if token := r.FormValue("token"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// requestJoinClaims returns the join token claims checked by RoomTokenMiddleware
+func requestJoinClaims(r *http.Request) joinClaims {
+	claims, _ := r.Context().Value("join_claims").(joinClaims)
+	return claims
+}
+
+// TracingMiddleware starts a server span named after the route pattern,
+// continuing the caller's trace when the request carries one. The request's
+// log lines get the trace ID.
+func TracingMiddleware() Middleware {
+	return func(hf http.HandlerFunc) http.HandlerFunc {
+		traced := func(w http.ResponseWriter, r *http.Request) {
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				lo := logger(r).With("trace_id", sc.TraceID().String())
+				r = r.WithContext(context.WithValue(r.Context(), "logger", lo))
+			}
 			hf(w, r)
 		}
+		return otelhttp.NewHandler(http.HandlerFunc(traced), "http",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Pattern }),
+		).ServeHTTP
 	}
 }
 
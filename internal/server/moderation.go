@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrRoomLocked  = fmt.Errorf("room is locked. ask the owner to unlock it")
+	ErrBannedUser  = fmt.Errorf("you have been banned from this room")
+	ErrUserNotHere = fmt.Errorf("user is not in this room")
+)
+
+// clientIP returns the caller's address. Behind Cloud Run's load balancer
+// that is the last hop of X-Forwarded-For, the one the balancer appended;
+// earlier hops come from the client and cannot be trusted.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isOwner reports whether userID owns the room. Caller must hold r.mu.
+func (r *Room) isOwner(userID string) bool {
+	return userID != "" && userID == r.OwnerID
+}
+
+// ownerBySubject reports whether the holder of the join token with subject
+// is the room's connected owner. Unlike the owner ID, which every member
+// sees, the subject is only known to the owner's page. Caller must hold r.mu.
+func (r *Room) ownerBySubject(subject string) bool {
+	owner := r.findClient(r.OwnerID)
+	return owner != nil && subject != "" && owner.subject == subject
+}
+
+// clientBySubject returns the connected client holding the join token with
+// subject. Caller must hold r.mu.
+func (r *Room) clientBySubject(subject string) *Client {
+	if subject == "" {
+		return nil
+	}
+	for client := range r.Clients {
+		if client.subject == subject {
+			return client
+		}
+	}
+	return nil
+}
+
+// isBanned reports whether a join token subject or address was banned.
+// Caller must hold r.mu.
+func (r *Room) isBanned(subject, ip string) bool {
+	return (subject != "" && r.Banned[subject]) || (ip != "" && r.Banned[ip])
+}
+
+// IsBanned reports whether an address may not join the room
+func (r *Room) IsBanned(ip string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.isBanned("", ip)
+}
+
+// IsLocked reports whether the room accepts new members
+func (r *Room) IsLocked() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Locked
+}
+
+// findClient returns the connected client with userID. Caller must hold r.mu.
+func (r *Room) findClient(userID string) *Client {
+	for client := range r.Clients {
+		if client.UserID == userID {
+			return client
+		}
+	}
+	return nil
+}
+
+// removeClient disconnects a client and tells the others it left. Caller must hold r.mu.
+func (r *Room) removeClient(client *Client, reason MessageType) {
+	select {
+	case client.SendChan <- &WebSocketMessage{
+		Type:   reason,
+		RoomID: r.ID,
+		UserID: client.UserID,
+		Role:   client.Role,
+	}:
+	default:
+	}
+	delete(r.Clients, client)
+	delete(r.Presence, client.UserID)
+	close(client.SendChan)
+
+	r.fanout(&WebSocketMessage{
+		Type:   TypeLeave,
+		UserID: client.UserID,
+		Role:   client.Role,
+		RoomID: r.ID,
+	}, "")
+	r.transferOwnershipIfNeeded(client.UserID)
+}
+
+// setOwner makes userID the room owner and announces it. Caller must hold r.mu.
+func (r *Room) setOwner(userID string) {
+	r.OwnerID = userID
+	r.fanout(&WebSocketMessage{
+		Type:    TypeOwnerChange,
+		RoomID:  r.ID,
+		UserID:  userID,
+		OwnerID: userID,
+	}, "")
+}
+
+// transferOwnershipIfNeeded hands the room to the longest connected member
+// when the owner leaves. Caller must hold r.mu.
+func (r *Room) transferOwnershipIfNeeded(leftUserID string) {
+	if leftUserID != r.OwnerID {
+		return
+	}
+	var next *Client
+	for client := range r.Clients {
+		if next == nil || client.JoinedAt.Before(next.JoinedAt) {
+			next = client
+		}
+	}
+	if next == nil {
+		// Nobody is left; the next member to join becomes the owner
+		r.OwnerID = ""
+		return
+	}
+	r.setOwner(next.UserID)
+}
+
+// handleModeration runs the owner-only kick, ban, lock and transfer actions.
+// Caller must hold r.mu.
+func (r *Room) handleModeration(message *WebSocketMessage) {
+	if !r.isOwner(message.UserID) {
+		r.replyError(message.UserID, ErrNotRoomOwner)
+		return
+	}
+
+	switch message.Type {
+	case TypeRoomLock:
+		locked := true
+		if b, ok := message.Content.(bool); ok {
+			locked = b
+		}
+		r.Locked = locked
+		r.fanout(&WebSocketMessage{
+			Type:    TypeRoomLock,
+			RoomID:  r.ID,
+			UserID:  message.UserID,
+			Content: locked,
+		}, "")
+		return
+	}
+
+	if message.TargetUserID == "" || message.TargetUserID == message.UserID {
+		r.replyError(message.UserID, ErrInvalidTarget)
+		return
+	}
+	target := r.findClient(message.TargetUserID)
+	if target == nil {
+		r.replyError(message.UserID, ErrUserNotHere)
+		return
+	}
+
+	switch message.Type {
+	case TypeKick:
+		r.removeClient(target, TypeKick)
+	case TypeBan:
+		if r.Banned == nil {
+			r.Banned = make(map[string]bool)
+		}
+		// User IDs change on every connection; the page's token does not
+		if target.subject != "" {
+			r.Banned[target.subject] = true
+		}
+		if target.RemoteIP != "" {
+			r.Banned[target.RemoteIP] = true
+		}
+		r.removeClient(target, TypeBan)
+	case TypeTransferOwner:
+		r.setOwner(target.UserID)
+	}
+}
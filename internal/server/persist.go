@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RoomStore keeps room state across restarts
+type RoomStore interface {
+	// Save replaces the saved rooms with rooms
+	Save(rooms []RoomState) error
+	// Load returns the saved rooms and forgets them, so a crash never brings
+	// back state older than the last clean shutdown
+	Load() ([]RoomState, error)
+	// Check reports whether Save would work
+	Check() error
+}
+
+// RoomState is what a room keeps across a restart. Members are not kept;
+// they rejoin with new user IDs, so ownership goes to the first to return.
+type RoomState struct {
+	ID                 string               `json:"id"`
+	ProblemTitle       string               `json:"problem_title,omitempty"`
+	ProblemDescription string               `json:"problem_description,omitempty"`
+	QuestionMeta       string               `json:"question_meta,omitempty"`
+	QuestionHints      string               `json:"question_hints,omitempty"`
+	QuestionSnippets   string               `json:"question_snippets,omitempty"`
+	QuestionID         string               `json:"question_id,omitempty"`
+	Code               string               `json:"code"`
+	CodeBuffers        map[string]string    `json:"code_buffers,omitempty"`
+	Language           string               `json:"language,omitempty"`
+	Snapshots          []*Snapshot          `json:"snapshots,omitempty"`
+	LastSnapshotCode   map[string]string    `json:"last_snapshot_code,omitempty"`
+	Chat               []*ChatMessage       `json:"chat,omitempty"`
+	Muted              map[string]bool      `json:"muted,omitempty"`
+	Comments           []*CommentThread     `json:"comments,omitempty"`
+	Whiteboard         []*WhiteboardElement `json:"whiteboard,omitempty"`
+	Locked             bool                 `json:"locked,omitempty"`
+	Banned             map[string]bool      `json:"banned,omitempty"`
+	Invites            map[string]*Invite   `json:"invites,omitempty"`
+	PasscodeHash       string               `json:"passcode_hash,omitempty"`
+	PasscodeSalt       string               `json:"passcode_salt,omitempty"`
+	Sequences          map[string]int       `json:"sequences"`
+	CreatedAt          time.Time            `json:"created_at"`
+}
+
+// state captures the room for a RoomStore. Caller must hold r.mu.
+func (r *Room) state() RoomState {
+	return RoomState{
+		ID:                 r.ID,
+		ProblemTitle:       r.ProblemTitle,
+		ProblemDescription: r.ProblemDescription,
+		QuestionMeta:       r.QuestionMeta,
+		QuestionHints:      r.QuestionHints,
+		QuestionSnippets:   r.QuestionSnippets,
+		QuestionID:         r.QuestionID,
+		Code:               r.CodeState,
+		CodeBuffers:        r.CodeBuffers,
+		Language:           r.CurrentLanguage,
+		Snapshots:          r.Snapshots,
+		LastSnapshotCode:   r.lastSnapshotCode,
+		Chat:               r.Chat,
+		Muted:              r.Muted,
+		Comments:           r.Comments,
+		Whiteboard:         r.Whiteboard,
+		Locked:             r.Locked,
+		Banned:             r.Banned,
+		Invites:            r.Invites,
+		PasscodeHash:       r.passcodeHash,
+		PasscodeSalt:       r.passcodeSalt,
+		Sequences: map[string]int{
+			"snapshot":   r.snapshotSeq,
+			"chat":       r.chatSeq,
+			"thread":     r.threadSeq,
+			"comment":    r.commentSeq,
+			"whiteboard": r.whiteboardSeq,
+		},
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+// restore loads a saved state into a new room. Caller must hold r.mu.
+func (r *Room) restore(s RoomState) {
+	r.ProblemTitle, r.ProblemDescription = s.ProblemTitle, s.ProblemDescription
+	r.QuestionMeta, r.QuestionHints, r.QuestionSnippets = s.QuestionMeta, s.QuestionHints, s.QuestionSnippets
+	r.QuestionID = s.QuestionID
+	r.CodeState, r.CodeBuffers, r.CurrentLanguage = s.Code, s.CodeBuffers, s.Language
+	r.Snapshots, r.lastSnapshotCode = s.Snapshots, s.LastSnapshotCode
+	r.Chat, r.Muted = s.Chat, s.Muted
+	r.Comments, r.Whiteboard = s.Comments, s.Whiteboard
+	r.Locked, r.Banned, r.Invites = s.Locked, s.Banned, s.Invites
+	r.passcodeHash, r.passcodeSalt = s.PasscodeHash, s.PasscodeSalt
+	r.snapshotSeq = s.Sequences["snapshot"]
+	r.chatSeq = s.Sequences["chat"]
+	r.threadSeq = s.Sequences["thread"]
+	r.commentSeq = s.Sequences["comment"]
+	r.whiteboardSeq = s.Sequences["whiteboard"]
+	r.CreatedAt = s.CreatedAt
+}
+
+// FileStore saves every room into one JSON file
+type FileStore struct {
+	Path string
+}
+
+func (s *FileStore) Save(rooms []RoomState) error {
+	data, err := json.Marshal(rooms)
+	if err != nil {
+		return fmt.Errorf("encoding rooms: %w", err)
+	}
+
+	// Write next to the target and rename, so a crash mid-write keeps the old file
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("saving rooms: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("saving rooms: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("saving rooms: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("saving rooms: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Load() ([]RoomState, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading rooms: %w", err)
+	}
+
+	var rooms []RoomState
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", s.Path, err)
+	}
+	if err := os.Remove(s.Path); err != nil {
+		return nil, fmt.Errorf("loading rooms: %w", err)
+	}
+	return rooms, nil
+}
+
+// Check makes sure the file's directory takes new files
+func (s *FileStore) Check() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.check")
+	if err != nil {
+		return fmt.Errorf("state directory is not writable: %w", err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// restoreRooms recreates the rooms saved by the last shutdown
+func (rm *RoomManager) restoreRooms(store RoomStore) error {
+	states, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, s := range states {
+		if _, exists := rm.Rooms[s.ID]; exists || s.ID == "" {
+			continue
+		}
+		room := CreateRoom(s.ID)
+		room.mu.Lock()
+		room.restore(s)
+		room.mu.Unlock()
+		rm.Rooms[s.ID] = room
+	}
+	if len(states) > 0 {
+		slog.Info("restored rooms", "rooms", len(states))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"time"
+)
+
+// Presence statuses derived from activity timestamps
+const (
+	PresenceTyping = "typing"
+	PresenceIdle   = "idle"
+	PresenceAway   = "away"
+)
+
+const (
+	presenceThrottle = 50 * time.Millisecond // Minimum gap between fanned out cursor updates
+	typingWindow     = 3 * time.Second       // Code edits within this window mean "typing"
+	awayAfter        = 2 * time.Minute       // No activity for this long means "away"
+	presenceInterval = time.Second           // How often statuses are refreshed
+)
+
+// userColors is the palette handed out to users in join order
+var userColors = []string{"#2563eb", "#dc2626", "#16a34a", "#d97706", "#9333ea", "#0891b2", "#db2777", "#4b5563"}
+
+// CursorPosition is a zero-based line/column position in the editor
+type CursorPosition struct {
+	Line int `json:"line"`
+	Ch   int `json:"ch"`
+}
+
+// SelectionRange is a selection from anchor to head
+type SelectionRange struct {
+	Anchor CursorPosition `json:"anchor"`
+	Head   CursorPosition `json:"head"`
+}
+
+// Presence is the cursor, selections and activity status of one user
+type Presence struct {
+	UserID     string           `json:"user_id"`
+	Color      string           `json:"color"`
+	Status     string           `json:"status"`
+	Cursor     *CursorPosition  `json:"cursor,omitempty"`
+	Selections []SelectionRange `json:"selections,omitempty"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+
+	lastActivity time.Time // Any message from the user
+	lastTyped    time.Time // Last code edit from the user
+	lastSent     time.Time // Last cursor update fanned out
+	pending      bool      // A throttled cursor update is waiting to be sent
+}
+
+// presencePayload is the content of a presence message from a client
+type presencePayload struct {
+	Cursor     *CursorPosition  `json:"cursor"`
+	Selections []SelectionRange `json:"selections"`
+}
+
+// pickColor returns the first palette color not used in the room. Caller must hold r.mu.
+func (r *Room) pickColor() string {
+	used := make(map[string]bool, len(r.Presence))
+	for _, p := range r.Presence {
+		used[p.Color] = true
+	}
+	for _, c := range userColors {
+		if !used[c] {
+			return c
+		}
+	}
+	return userColors[len(r.Presence)%len(userColors)]
+}
+
+// addPresence starts tracking a newly registered client. Caller must hold r.mu.
+func (r *Room) addPresence(client *Client) *Presence {
+	if r.Presence == nil {
+		r.Presence = make(map[string]*Presence)
+	}
+	now := time.Now()
+	p := &Presence{
+		UserID:       client.UserID,
+		Color:        r.pickColor(),
+		Status:       PresenceIdle,
+		UpdatedAt:    now,
+		lastActivity: now,
+	}
+	r.Presence[client.UserID] = p
+	client.Color = p.Color
+	return p
+}
+
+// copyPresence returns the presence of every user. Caller must hold r.mu.
+func (r *Room) copyPresence() []Presence {
+	if len(r.Presence) == 0 {
+		return nil
+	}
+	out := make([]Presence, 0, len(r.Presence))
+	for _, p := range r.Presence {
+		out = append(out, *p)
+	}
+	return out
+}
+
+// touchActivity records activity for a user; code edits also count as typing.
+// Caller must hold r.mu.
+func (r *Room) touchActivity(message *WebSocketMessage) {
+	p, ok := r.Presence[message.UserID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p.lastActivity = now
+	if message.Type == TypeCode {
+		p.lastTyped = now
+	}
+	r.refreshStatus(p, now)
+}
+
+// derivedStatus computes a user's status from their activity timestamps
+func (p *Presence) derivedStatus(now time.Time) string {
+	switch {
+	case now.Sub(p.lastTyped) < typingWindow:
+		return PresenceTyping
+	case now.Sub(p.lastActivity) < awayAfter:
+		return PresenceIdle
+	default:
+		return PresenceAway
+	}
+}
+
+// refreshStatus broadcasts the user's presence if their status changed.
+// Caller must hold r.mu.
+func (r *Room) refreshStatus(p *Presence, now time.Time) {
+	status := p.derivedStatus(now)
+	if status == p.Status {
+		return
+	}
+	p.Status = status
+	p.UpdatedAt = now
+	r.sendPresence(p)
+}
+
+// sendPresence fans a user's presence out to everyone else. Caller must hold r.mu.
+func (r *Room) sendPresence(p *Presence) {
+	p.lastSent = time.Now()
+	p.pending = false
+	r.fanout(&WebSocketMessage{
+		Type:    TypePresence,
+		RoomID:  r.ID,
+		UserID:  p.UserID,
+		Content: *p,
+	}, p.UserID)
+}
+
+// handlePresence stores a cursor/selection update and fans it out, at most
+// once per presenceThrottle per user. Caller must hold r.mu.
+func (r *Room) handlePresence(message *WebSocketMessage) {
+	p, ok := r.Presence[message.UserID]
+	if !ok {
+		return
+	}
+
+	var payload presencePayload
+	if err := decodeContent(message.Content, &payload); err != nil {
+		return
+	}
+	now := time.Now()
+	p.Cursor = payload.Cursor
+	p.Selections = payload.Selections
+	p.UpdatedAt = now
+	p.lastActivity = now
+	p.Status = p.derivedStatus(now)
+
+	if wait := presenceThrottle - now.Sub(p.lastSent); wait > 0 {
+		// Sent when the throttle window ends, with the latest cursor by then
+		if !p.pending {
+			p.pending = true
+			time.AfterFunc(wait, func() { r.flushPendingPresence(p) })
+		}
+		return
+	}
+	r.sendPresence(p)
+}
+
+// flushPendingPresence sends the throttled cursor update of p unless it was
+// sent already or its user left
+func (r *Room) flushPendingPresence(p *Presence) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.recoverPanic("presence")
+	if p.pending && r.Presence[p.UserID] == p {
+		r.sendPresence(p)
+	}
+}
+
+// flushPresence sends throttled cursor updates and status changes such as
+// going away. Caller must hold r.mu.
+func (r *Room) flushPresence() {
+	now := time.Now()
+	for _, p := range r.Presence {
+		if p.pending {
+			p.Status = p.derivedStatus(now)
+			r.sendPresence(p)
+			continue
+		}
+		r.refreshStatus(p, now)
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrUnsupportedVersion = fmt.Errorf("protocol version is not supported")
+	ErrLateHello          = fmt.Errorf("hello must be the first message on the socket")
+)
+
+// Protocol versions. Version 1 is the implicit format of clients that predate
+// the handshake; they never send a hello.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	MinProtocolVersion = ProtocolV1
+	MaxProtocolVersion = ProtocolV2
+)
+
+// TypeHello opens the handshake from the client and carries the server's answer
+const TypeHello MessageType = "hello"
+
+// Capabilities a client may declare. Messages of a capability the client did
+// not negotiate are never sent to it.
+const (
+	CapCall        = "call"         // call readiness and WebRTC signaling
+	CapCodeBuffers = "code_buffers" // per-language drafts in sync and language_change
+	CapSnapshots   = "snapshots"
+	CapChat        = "chat"
+	CapPresence    = "presence"
+	CapComments    = "comments"
+	CapWhiteboard  = "whiteboard"
+	CapModeration  = "moderation"
+)
+
+// serverCapabilities lists every capability this server supports
+var serverCapabilities = []string{
+	CapCall, CapCodeBuffers, CapSnapshots, CapChat,
+	CapPresence, CapComments, CapWhiteboard, CapModeration,
+	CapCodeDelta, CapCompact, CapQuestionRef,
+}
+
+// versionCapabilities are what clients of versions without capabilities
+// understand, whether they skip the handshake or send a hello
+var versionCapabilities = map[int][]string{
+	ProtocolV1: {CapCall},
+}
+
+// messageCapabilities maps message types onto the capability they need.
+// Types missing here, like join, code or sync, are understood by every version.
+var messageCapabilities = map[MessageType]string{
+	TypeCallReady:        CapCall,
+	TypeCallEnded:        CapCall,
+	TypeOffer:            CapCall,
+	TypeAnswer:           CapCall,
+	TypeIceCandidate:     CapCall,
+	TypeSnapshot:         CapSnapshots,
+	TypeSnapshotRestore:  CapSnapshots,
+	TypeChat:             CapChat,
+	TypeChatEdit:         CapChat,
+	TypeChatDelete:       CapChat,
+	TypeChatMute:         CapChat,
+	TypePresence:         CapPresence,
+	TypeComment:          CapComments,
+	TypeCommentReply:     CapComments,
+	TypeCommentResolve:   CapComments,
+	TypeCommentMove:      CapComments,
+	TypeWhiteboardStroke: CapWhiteboard,
+	TypeWhiteboardShape:  CapWhiteboard,
+	TypeWhiteboardErase:  CapWhiteboard,
+	TypeWhiteboardClear:  CapWhiteboard,
+	TypeKick:             CapModeration,
+	TypeBan:              CapModeration,
+	TypeRoomLock:         CapModeration,
+	TypeTransferOwner:    CapModeration,
+	TypeOwnerChange:      CapModeration,
+}
+
+// Protocol is what a client negotiated for its socket. Capabilities follow
+// from the version: only version 2 and later clients declare their own.
+type Protocol struct {
+	Version      int
+	Capabilities map[string]bool
+}
+
+// helloPayload is the content of a hello message from a client
+type helloPayload struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// HelloReply is the content of the server's hello message
+type HelloReply struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	MaxVersion   int      `json:"max_version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// newProtocol returns the protocol of a client speaking version with caps.
+// Clients of a version that predates capabilities get that version's set
+// whatever they declare.
+func newProtocol(version int, caps []string) *Protocol {
+	if fixed, ok := versionCapabilities[version]; ok {
+		caps = fixed
+	}
+	p := &Protocol{Version: version, Capabilities: make(map[string]bool)}
+	for _, c := range caps {
+		if slices.Contains(serverCapabilities, c) {
+			p.Capabilities[c] = true
+		}
+	}
+	return p
+}
+
+// legacyProtocol is assumed for clients that never send a hello
+var legacyProtocol = newProtocol(ProtocolV1, versionCapabilities[ProtocolV1])
+
+// has reports whether the client negotiated a capability
+func (p *Protocol) has(capability string) bool {
+	return p.Capabilities[capability]
+}
+
+// capabilityList returns the negotiated capabilities in a stable order
+func (p *Protocol) capabilityList() []string {
+	caps := make([]string, 0, len(p.Capabilities))
+	for _, c := range serverCapabilities {
+		if p.Capabilities[c] {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// validateHello requires a version the server can speak
+func validateHello(msg *WebSocketMessage) error {
+	var hello helloPayload
+	if err := decodeContent(msg.Content, &hello); err != nil {
+		return ErrInvalidContent
+	}
+	if hello.Version < MinProtocolVersion {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+// negotiate settles the protocol for a hello and tells the client the outcome.
+// It must run before the client joins its room.
+func (c *Client) negotiate(msg *WebSocketMessage) {
+	var hello helloPayload
+	decodeContent(msg.Content, &hello)
+
+	p := newProtocol(min(hello.Version, MaxProtocolVersion), hello.Capabilities)
+	c.protocol.Store(p)
+
+	c.SendChan <- &WebSocketMessage{
+		Type:   TypeHello,
+		RoomID: c.Room.ID,
+		Content: HelloReply{
+			Version:      p.Version,
+			MinVersion:   MinProtocolVersion,
+			MaxVersion:   MaxProtocolVersion,
+			Capabilities: p.capabilityList(),
+		},
+	}
+}
+
+// translate rewrites an outgoing message for the client's protocol. It
+// returns no messages when the client cannot understand the message at all.
+func (c *Client) translate(message *WebSocketMessage) []*WebSocketMessage {
+	p := c.protocol.Load()
+	if capability, ok := messageCapabilities[message.Type]; ok && !p.has(capability) {
+		return nil
+	}
+	if message.Type == TypeCode || message.Type == TypeSync {
+		message = c.compactCode(p, message)
+	}
+
+	switch message.Type {
+	case TypeSync:
+		// Leave out the state of features the client does not know about
+		sync := *message
+		if !p.has(CapCodeBuffers) {
+			sync.CodeBuffers = nil
+		}
+		if !p.has(CapChat) {
+			sync.ChatHistory = nil
+		}
+		if !p.has(CapPresence) {
+			sync.Presence = nil
+		}
+		if !p.has(CapComments) {
+			sync.Comments = nil
+		}
+		if !p.has(CapWhiteboard) {
+			sync.Whiteboard = nil
+		}
+		if !p.has(CapModeration) {
+			sync.OwnerID, sync.RoomLocked = "", false
+		}
+		return []*WebSocketMessage{&sync}
+
+	case TypeJoin:
+		// The joining user's presence is only meaningful with cursors
+		if !p.has(CapPresence) {
+			join := *message
+			join.Content = nil
+			return []*WebSocketMessage{&join}
+		}
+
+	case TypeLanguageChange:
+		// Clients without drafts load the new language's code from a code message
+		if !p.has(CapCodeBuffers) {
+			change := *message
+			change.Content = nil
+			code := &WebSocketMessage{
+				Type:     TypeCode,
+				RoomID:   message.RoomID,
+				UserID:   message.UserID,
+				Role:     message.Role,
+				Language: message.Language,
+				Content:  message.Content,
+			}
+			if code.Content == nil {
+				code.Content = ""
+			}
+			return []*WebSocketMessage{&change, code}
+		}
+	}
+	return []*WebSocketMessage{message}
+}
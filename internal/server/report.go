@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SessionReport is an export of a room's session for interview debriefs
+type SessionReport struct {
+	RoomID       string            `json:"room_id"`
+	ProblemTitle string            `json:"problem_title"`
+	Language     string            `json:"language"`
+	CodeBuffers  map[string]string `json:"code_buffers"`
+	Snapshots    []Snapshot        `json:"snapshots"`
+	Comments     []CommentThread   `json:"comments"`
+	Chat         []ChatMessage     `json:"chat"`
+	CreatedAt    time.Time         `json:"created_at"`
+	ExportedAt   time.Time         `json:"exported_at"`
+}
+
+// buildReport collects the report of a room. Caller must hold r.mu.
+func (r *Room) buildReport() SessionReport {
+	buffers := r.copyCodeBuffers()
+	if buffers == nil && r.CodeState != "" {
+		buffers = map[string]string{r.CurrentLanguage: r.CodeState}
+	}
+
+	snapshots := make([]Snapshot, 0, len(r.Snapshots))
+	for _, s := range r.Snapshots {
+		if !s.Auto {
+			snapshots = append(snapshots, s.snapshotMeta())
+		}
+	}
+
+	return SessionReport{
+		RoomID:       r.ID,
+		ProblemTitle: r.ProblemTitle,
+		Language:     r.CurrentLanguage,
+		CodeBuffers:  buffers,
+		Snapshots:    snapshots,
+		Comments:     r.copyComments(),
+		Chat:         r.copyChatHistory(),
+		CreatedAt:    r.CreatedAt,
+		ExportedAt:   time.Now(),
+	}
+}
+
+// Markdown renders the report as a markdown document
+func (rep SessionReport) Markdown() string {
+	var sb strings.Builder
+	title := rep.ProblemTitle
+	if title == "" {
+		title = "Untitled problem"
+	}
+	fmt.Fprintf(&sb, "# Session report: %s\n\n", title)
+	fmt.Fprintf(&sb, "- Room: `%s`\n- Started: %s\n- Exported: %s\n\n", rep.RoomID, rep.CreatedAt.Format(time.RFC1123), rep.ExportedAt.Format(time.RFC1123))
+
+	languages := make([]string, 0, len(rep.CodeBuffers))
+	for lang := range rep.CodeBuffers {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	for _, lang := range languages {
+		fmt.Fprintf(&sb, "## Code (%s)\n\n```%s\n%s\n```\n\n", lang, lang, rep.CodeBuffers[lang])
+	}
+
+	if len(rep.Comments) > 0 {
+		sb.WriteString("## Review comments\n\n")
+		for _, t := range rep.Comments {
+			state := "open"
+			if t.Resolved {
+				state = "resolved"
+			} else if t.Outdated {
+				state = "outdated"
+			}
+			fmt.Fprintf(&sb, "### %s lines %d-%d (%s)\n\n", t.Language, t.StartLine+1, t.EndLine+1, state)
+			fmt.Fprintf(&sb, "```%s\n%s\n```\n\n", t.Language, t.AnchorText)
+			for _, c := range t.Comments {
+				fmt.Fprintf(&sb, "- **%s**: %s\n", c.Role, c.Text)
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	if len(rep.Snapshots) > 0 {
+		sb.WriteString("## Checkpoints\n\n")
+		for _, s := range rep.Snapshots {
+			fmt.Fprintf(&sb, "- #%d %s (%s) at %s\n", s.ID, s.Name, s.Language, s.CreatedAt.Format(time.Kitchen))
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// ExportReportHandler exports the session report of a room as JSON, or as
+// markdown with `?format=markdown`.
+func ExportReportHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	room.mu.RLock()
+	report := room.buildReport()
+	room.mu.RUnlock()
+
+	if r.URL.Query().Get("format") == "markdown" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="session-%s.md"`, report.RoomID))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(report.Markdown()))
+		return
+	}
+
+	SendJSONResponse(w, http.StatusOK, report)
+}
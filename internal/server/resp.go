@@ -9,7 +9,6 @@ import (
 func SendJSONResponse(w http.ResponseWriter, status int, data any) {
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-API-KEY", "some-api-secret-keys")
-	w.Header().Add("X-Tracker-ID", "tracker-123")
 	w.WriteHeader(status)
 
 	// Encode the data into a JSON response
@@ -23,7 +22,6 @@ func SendJSONResponse(w http.ResponseWriter, status int, data any) {
 func SendErrorResponse(w http.ResponseWriter, status int, err error) {
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-API-KEY", "some-api-secret-keys")
-	w.Header().Add("X-Tracker-ID", "tracker-123")
 	w.WriteHeader(status)
 
 	// Encode the error message into a JSON response
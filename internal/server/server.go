@@ -1,47 +1,181 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
 )
 
 type Server struct {
 	Co *core.Core
+	// Store keeps rooms across restarts. When nil, a FileStore is used if
+	// the config names a state file.
+	Store RoomStore
+
+	stopReaper func()
 }
 
 // StartServer helps to start the server based on the provided configuration.
-func (s *Server) StartServer() error {
+// It serves until ctx is done and then shuts down gracefully.
+func (s *Server) StartServer(ctx context.Context) error {
+	httpSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.Co.Port),
+		Handler: s.Handler(),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- httpSrv.ListenAndServe()
+	}()
+	s.Co.Lo.Info("trying to start the server", "addr", fmt.Sprintf("http://0.0.0.0:%d", s.Co.Port))
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+		return s.shutdown(httpSrv)
+	}
+}
+
+// Handler applies the configuration, restores saved rooms and returns every
+// route of the server. Callers serving it themselves call Drain before
+// closing their listener.
+func (s *Server) Handler() http.Handler {
 	srv := http.NewServeMux()
 
 	// Add routes
-	srv.HandleFunc("GET /", IndexHandler)
-	srv.HandleFunc("GET /api/healthz", MiddlewareChain(HealthHandler, LoggerMiddleware()))
-	srv.HandleFunc("POST /api/search", MiddlewareChain(SearchQuestionHandler, LoggerMiddleware()))
-	srv.HandleFunc("POST /api/suggestions", MiddlewareChain(SearchSuggestionsHandler, LoggerMiddleware()))
-	srv.HandleFunc("POST /api/execute-code", MiddlewareChain(ExecuteCodeHandler, LoggerMiddleware()))
+	srv.HandleFunc("GET /", MiddlewareChain(IndexHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/healthz", MiddlewareChain(LivenessHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/livez", MiddlewareChain(LivenessHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/readyz", MiddlewareChain(ReadinessHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/search", MiddlewareChain(SearchQuestionHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/suggestions", MiddlewareChain(SearchSuggestionsHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/execute-code", MiddlewareChain(ExecuteCodeHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
 
 	// Add a websocket server route
 	// Runs a websocket connection endpoint.
-	srv.HandleFunc("GET /ws", MiddlewareChain(HandleWebSocket, LoggerMiddleware()))
-	srv.HandleFunc("POST /api/create-room", MiddlewareChain(CreateRoomHandler, LoggerMiddleware()))
-	srv.HandleFunc("POST /api/join-room", MiddlewareChain(JoinRoomHandler, LoggerMiddleware()))
-	srv.HandleFunc("POST /rooms/{room_id}", MiddlewareChain(JoinCollaborativeSessionHandler, LoggerMiddleware()))
+	srv.HandleFunc("GET /ws", MiddlewareChain(HandleWebSocket, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	// Server-Sent Events and HTTP POST fallback for networks that block WebSockets
+	srv.HandleFunc("GET /sse", MiddlewareChain(HandleEventStream, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /sse/send", MiddlewareChain(HandleEventStreamSend, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/create-room", MiddlewareChain(CreateRoomHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/join-room", MiddlewareChain(JoinRoomHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /rooms/{room_id}", MiddlewareChain(JoinCollaborativeSessionHandler, LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+
+	// Room code snapshots and checkpoints. Room APIs take the join token of
+	// the room's page.
+	srv.HandleFunc("GET /api/rooms/{room_id}/snapshots", MiddlewareChain(ListSnapshotsHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/rooms/{room_id}/snapshots", MiddlewareChain(CreateSnapshotHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/rooms/{room_id}/snapshots/diff", MiddlewareChain(DiffSnapshotsHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/rooms/{room_id}/snapshots/{snapshot_id}", MiddlewareChain(GetSnapshotHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/rooms/{room_id}/report", MiddlewareChain(ExportReportHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/rooms/{room_id}/whiteboard.svg", MiddlewareChain(ExportWhiteboardHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/rooms/{room_id}/invites", MiddlewareChain(CreateInviteHandler, RoomTokenMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+
+	// Admin API, enabled by setting ADMIN_TOKEN
+	srv.HandleFunc("GET /api/admin/rooms", MiddlewareChain(AdminListRoomsHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/admin/announce", MiddlewareChain(AdminAnnounceAllHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/admin/rooms/{room_id}", MiddlewareChain(AdminGetRoomHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("DELETE /api/admin/rooms/{room_id}", MiddlewareChain(AdminCloseRoomHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("POST /api/admin/rooms/{room_id}/announce", MiddlewareChain(AdminAnnounceRoomHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+	srv.HandleFunc("GET /api/admin/socket-stats", MiddlewareChain(SocketStatsHandler, AdminAuthMiddleware(), LoggerMiddleware(), MetricsMiddleware(), TracingMiddleware()))
+
+	// Prometheus metrics. Scrapes are counted but neither logged nor traced.
+	srv.HandleFunc("GET /metrics", MiddlewareChain(MetricsHandler, MetricsMiddleware()))
+
+	cfg := s.Co.Config
+	settings.Store(&cfg)
+	draining.Store(false)
+
+	// Bring back the rooms saved by the last shutdown
+	if s.Store == nil && s.Co.StateFile != "" {
+		s.Store = &FileStore{Path: s.Co.StateFile}
+	}
+	roomStore = s.Store
+	if s.Store != nil {
+		if err := roomManager.restoreRooms(s.Store); err != nil {
+			s.Co.Lo.Error("failed to restore rooms", "err", err)
+		}
+	}
+
+	// Close rooms that stayed empty for too long
+	s.stopReaper = roomManager.StartReaper(s.Co.RoomIdleTTL)
 
 	// Serve the static assets
-	staticFileServer := http.FileServer(http.Dir("./templates"))
+	staticFileServer := http.FileServer(http.Dir(s.Co.TemplateDir))
 	srv.Handle("GET /static/", http.StripPrefix("/static/", staticFileServer))
 
-	s.Co.Lo.Printf("trying to start the server on http://0.0.0.0:%d\n", s.Co.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.Co.Port), DefaultMiddlwareTracker(srv, s.Co))
+	return DefaultMiddlwareTracker(srv, s.Co)
+}
+
+// shutdown stops the server within the configured timeout. The listener
+// closes while the rooms drain.
+func (s *Server) shutdown(httpSrv *http.Server) error {
+	s.Co.Lo.Info("shutting down", "timeout", s.Co.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.Co.ShutdownTimeout)
+	defer cancel()
+
+	// Requests already running carry on while the listener closes
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- httpSrv.Shutdown(ctx)
+	}()
+
+	s.Drain(ctx)
+	if err := <-stopped; err != nil {
+		return fmt.Errorf("shutting down the http server: %w", err)
+	}
+	s.Co.Lo.Info("server stopped")
+	return nil
+}
+
+// Drain winds every room down for a shutdown: it warns the rooms, lets
+// running executions finish so their output still reaches the room, saves
+// the rooms and then disconnects everyone. It gives up waiting when ctx is done.
+func (s *Server) Drain(ctx context.Context) {
+	draining.Store(true)
+	if s.stopReaper != nil {
+		s.stopReaper()
+	}
+	roomManager.announceShutdown()
+	if err := waitForZero(ctx, &executionsInFlight); err != nil {
+		s.Co.Lo.Warn("executions still running at the shutdown deadline", "executions", executionsInFlight.Load())
+	}
+	if s.Store != nil {
+		if err := roomManager.saveRooms(s.Store); err != nil {
+			s.Co.Lo.Error("failed to save rooms", "err", err)
+		}
+	}
+
+	// Closing the rooms ends their sockets and event streams
+	roomManager.closeAll()
+	if err := waitForZero(ctx, &openClients); err != nil {
+		s.Co.Lo.Warn("clients still connected at the shutdown deadline", "clients", openClients.Load())
+	}
+}
+
+// waitForZero waits until counter drops to zero or ctx is done
+func waitForZero(ctx context.Context, counter *atomic.Int64) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for counter.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
 
 // ParseTemplates parses all template files in the specified directory and returns a compiled template.
 func ParseTemplates(templateDirPattern string) (*template.Template, error) {
-	log.Printf("parsing the templates from template directory %s", templateDirPattern)
+	slog.Info("parsing the templates", "pattern", templateDirPattern)
 	tmpl, err := template.ParseGlob(templateDirPattern)
 	return tmpl, err
 }
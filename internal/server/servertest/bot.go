@@ -0,0 +1,378 @@
+package servertest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
+)
+
+// DefaultTimeout bounds every wait of a bot
+const DefaultTimeout = 2 * time.Second
+
+// DefaultCapabilities are declared by bots created without capabilities.
+// They keep messages in their plain form: no code deltas, question
+// references or compact encoding.
+var DefaultCapabilities = []string{
+	server.CapCodeBuffers, server.CapSnapshots, server.CapChat, server.CapPresence,
+	server.CapComments, server.CapWhiteboard, server.CapModeration,
+}
+
+// Bot is a scripted room member speaking the socket protocol, over a
+// WebSocket or the event stream fallback. A bot belongs to one test goroutine.
+type Bot struct {
+	RoomID string
+	UserID string
+	Role   string
+	// Token is the join token of the bot's room page, taken by the room API
+	Token string
+	// Sync is the room state the server sent when the bot joined
+	Sync server.WebSocketMessage
+	// Hello is the protocol the server negotiated
+	Hello server.HelloReply
+
+	t        testing.TB
+	write    func(data []byte) error // sends one message over the transport
+	stop     func()                  // closes the transport
+	received chan server.WebSocketMessage
+	closed   chan struct{}
+}
+
+// newBot returns a bot holding the join token of wsPath, closed at the end
+// of the test
+func (h *Harness) newBot(wsPath string) *Bot {
+	b := &Bot{
+		Token:    joinToken(wsPath),
+		t:        h.t,
+		received: make(chan server.WebSocketMessage, 256),
+		closed:   make(chan struct{}),
+	}
+	h.t.Cleanup(b.Close)
+	return b
+}
+
+// Connect opens a socket on wsPath, completes the hello handshake with
+// capabilities (DefaultCapabilities when none) and waits until the bot joined
+func (h *Harness) Connect(wsPath string, capabilities ...string) *Bot {
+	h.t.Helper()
+	return h.ConnectFrom("", wsPath, capabilities...)
+}
+
+// ConnectFrom is Connect for a client at addr, as the load balancer reports
+// it in X-Forwarded-For. An empty addr connects from the test's own address.
+func (h *Harness) ConnectFrom(addr, wsPath string, capabilities ...string) *Bot {
+	h.t.Helper()
+	conn, resp, err := h.Dial(wsPath, forwardedFor(addr))
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		h.t.Fatalf("servertest: dial %s: %v (status %d)", wsPath, err, status)
+	}
+	b := h.newBot(wsPath)
+	b.write = func(data []byte) error { return conn.WriteMessage(websocket.TextMessage, data) }
+	b.stop = func() { conn.Close() }
+	go b.readSocket(conn)
+
+	b.handshake(capabilities)
+	return b
+}
+
+// ConnectSSE is Connect over the event stream fallback: the bot reads the
+// room from /sse and posts its messages to /sse/send
+func (h *Harness) ConnectSSE(wsPath string, capabilities ...string) *Bot {
+	h.t.Helper()
+	u, err := url.Parse(wsPath)
+	if err != nil {
+		h.t.Fatalf("servertest: bad socket path %q", wsPath)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL+"/sse?"+u.RawQuery, nil)
+	if err != nil {
+		cancel()
+		h.t.Fatalf("servertest: event stream: %v", err)
+	}
+	resp, err := h.Client().Do(req)
+	if err != nil {
+		cancel()
+		h.t.Fatalf("servertest: event stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		resp.Body.Close()
+		h.t.Fatalf("servertest: event stream: status %d", resp.StatusCode)
+	}
+
+	// The first event names the session the bot posts with
+	events := bufio.NewReader(resp.Body)
+	event, data, err := readEvent(events)
+	var session struct {
+		Session string `json:"session"`
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &session)
+	}
+	if err != nil || event != "session" || session.Session == "" {
+		cancel()
+		resp.Body.Close()
+		h.t.Fatalf("servertest: event stream: no session event (%q %s: %v)", event, data, err)
+	}
+
+	b := h.newBot(wsPath)
+	sendURL := h.URL + "/sse/send?session=" + url.QueryEscape(session.Session)
+	b.write = func(data []byte) error {
+		resp, err := h.Client().Post(sendURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	b.stop = cancel
+	go b.readEvents(events, resp.Body)
+
+	b.handshake(capabilities)
+	return b
+}
+
+// handshake sends the hello with capabilities (DefaultCapabilities when
+// none) and waits until the bot joined
+func (b *Bot) handshake(capabilities []string) {
+	b.t.Helper()
+	if len(capabilities) == 0 {
+		capabilities = DefaultCapabilities
+	}
+	b.Send(server.WebSocketMessage{
+		Type:    server.TypeHello,
+		Content: map[string]any{"version": server.MaxProtocolVersion, "capabilities": capabilities},
+	})
+	hello := b.Expect(server.TypeHello)
+	b.decode(hello.Content, &b.Hello)
+
+	b.Sync = b.Expect(server.TypeSync)
+	b.RoomID, b.UserID, b.Role = b.Sync.RoomID, b.Sync.UserID, b.Sync.Role
+}
+
+// Dial opens a raw socket on wsPath with header, which may be nil, for tests
+// of what bots never do
+func (h *Harness) Dial(wsPath string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial(h.wsURL(wsPath), header)
+}
+
+// forwardedFor returns the header of a request forwarded for addr, or nil
+func forwardedFor(addr string) http.Header {
+	if addr == "" {
+		return nil
+	}
+	return http.Header{"X-Forwarded-For": {addr}}
+}
+
+// joinToken reads the join token from a socket path
+func joinToken(wsPath string) string {
+	u, err := url.Parse(wsPath)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("token")
+}
+
+// readSocket queues every message from the server until the socket closes
+func (b *Bot) readSocket(conn *websocket.Conn) {
+	defer close(b.closed)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		b.queue(data)
+	}
+}
+
+// readEvents queues every message event of a stream until it ends
+func (b *Bot) readEvents(events *bufio.Reader, body io.Closer) {
+	defer close(b.closed)
+	defer body.Close()
+	for {
+		event, data, err := readEvent(events)
+		if err != nil {
+			return
+		}
+		if event == "" {
+			b.queue(data)
+		}
+	}
+}
+
+// readEvent reads the next event of a stream, skipping comments
+func readEvent(r *bufio.Reader) (event string, data []byte, err error) {
+	var lines [][]byte
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if lines != nil {
+				return event, bytes.Join(lines, []byte("\n")), nil
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			lines = append(lines, []byte(strings.TrimPrefix(line, "data: ")))
+		}
+	}
+}
+
+// queue hands a message from the server to the test
+func (b *Bot) queue(data []byte) {
+	var msg server.WebSocketMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	b.received <- msg
+}
+
+// Close leaves the room
+func (b *Bot) Close() {
+	if b.stop != nil {
+		b.stop()
+	}
+}
+
+// Send writes msg to the server as is
+func (b *Bot) Send(msg server.WebSocketMessage) {
+	b.t.Helper()
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = b.write(data)
+	}
+	if err != nil {
+		b.t.Fatalf("servertest: bot %s: send %s: %v", b.UserID, msg.Type, err)
+	}
+}
+
+// SendCode replaces the room's code of the current language
+func (b *Bot) SendCode(code string) {
+	b.t.Helper()
+	b.Send(server.WebSocketMessage{Type: server.TypeCode, RoomID: b.RoomID, Content: code})
+}
+
+// SetLanguage switches the room to language
+func (b *Bot) SetLanguage(language string) {
+	b.t.Helper()
+	b.Send(server.WebSocketMessage{Type: server.TypeLanguageChange, RoomID: b.RoomID, Language: language})
+}
+
+// Chat posts a chat message
+func (b *Bot) Chat(text string) {
+	b.t.Helper()
+	b.Send(server.WebSocketMessage{Type: server.TypeChat, RoomID: b.RoomID, Content: map[string]string{"text": text}})
+}
+
+// Execute runs code through the HTTP API as this bot
+func (b *Bot) Execute(h *Harness, language, code, stdin string) (int, Result) {
+	b.t.Helper()
+	return h.Execute(b.RoomID, b.Token, language, code, stdin)
+}
+
+// Expect waits for the next message of one of types, skipping others, and
+// fails the test after DefaultTimeout
+func (b *Bot) Expect(types ...server.MessageType) server.WebSocketMessage {
+	b.t.Helper()
+	return b.ExpectFunc(func(msg server.WebSocketMessage) bool {
+		return slices.Contains(types, msg.Type)
+	}, "a message of type %v", types)
+}
+
+// ExpectFrom waits for the next message of type typ sent by or about userID
+func (b *Bot) ExpectFrom(typ server.MessageType, userID string) server.WebSocketMessage {
+	b.t.Helper()
+	return b.ExpectFunc(func(msg server.WebSocketMessage) bool {
+		return msg.Type == typ && msg.UserID == userID
+	}, "a message of type %s from %s", typ, userID)
+}
+
+// ExpectFunc waits for the next message match accepts, skipping others, and
+// fails the test with the description after DefaultTimeout
+func (b *Bot) ExpectFunc(match func(server.WebSocketMessage) bool, format string, args ...any) server.WebSocketMessage {
+	b.t.Helper()
+	timeout := time.After(DefaultTimeout)
+	for {
+		select {
+		case msg := <-b.received:
+			if match(msg) {
+				return msg
+			}
+		case <-b.closed:
+			b.t.Fatalf("servertest: bot %s: socket closed while waiting for "+format, append([]any{b.UserID}, args...)...)
+		case <-timeout:
+			b.t.Fatalf("servertest: bot %s: timed out waiting for "+format, append([]any{b.UserID}, args...)...)
+		}
+	}
+}
+
+// ExpectNone fails the test when a message of one of types arrives within d
+func (b *Bot) ExpectNone(d time.Duration, types ...server.MessageType) {
+	b.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case msg := <-b.received:
+			if slices.Contains(types, msg.Type) {
+				b.t.Fatalf("servertest: bot %s: unexpected %s message: %+v", b.UserID, msg.Type, msg)
+			}
+		case <-b.closed:
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Drain drops every message received so far
+func (b *Bot) Drain() {
+	for {
+		select {
+		case <-b.received:
+		default:
+			return
+		}
+	}
+}
+
+// decode converts a message's content into v
+func (b *Bot) decode(content any, v any) {
+	b.t.Helper()
+	data, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		b.t.Fatalf("servertest: bot %s: decoding %T: %v", b.UserID, v, err)
+	}
+}
+
+// Decode converts a message's content into v, failing the test when it does not fit
+func (b *Bot) Decode(msg server.WebSocketMessage, v any) {
+	b.t.Helper()
+	b.decode(msg.Content, v)
+}
@@ -0,0 +1,113 @@
+package servertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Execution is a run the fake engine received, with the code decoded
+type Execution struct {
+	Language string
+	Code     string
+	Stdin    string
+}
+
+// Result is what the engine answers for a run. The page shows Stdout, or
+// Stderr and Message when Error is set.
+type Result struct {
+	Stdout  string `json:"stdout"`
+	Stderr  string `json:"stderr,omitempty"`
+	Error   bool   `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// Engine is a fake code execution engine. Unless Run is replaced it prints
+// the stdin of every run back. Its methods are safe for concurrent use.
+type Engine struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	run        func(Execution) (Result, int)
+	executions []Execution
+	healthy    bool
+}
+
+// NewEngine starts a fake engine. Callers must Close it.
+func NewEngine() *Engine {
+	e := &Engine{
+		run: func(ex Execution) (Result, int) {
+			return Result{Stdout: ex.Stdin}, http.StatusOK
+		},
+		healthy: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", e.serveExecute)
+	mux.HandleFunc("GET /health", e.serveHealth)
+	e.Server = httptest.NewServer(mux)
+	return e
+}
+
+// SetRun makes fn answer every following run with a result and status code
+func (e *Engine) SetRun(fn func(Execution) (Result, int)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.run = fn
+}
+
+// SetHealthy makes /health answer 200 when healthy and 503 otherwise
+func (e *Engine) SetHealthy(healthy bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = healthy
+}
+
+// Executions returns every run received so far
+func (e *Engine) Executions() []Execution {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Execution(nil), e.executions...)
+}
+
+func (e *Engine) serveExecute(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+		Stdin    string `json:"stdin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	code, err := base64.StdEncoding.DecodeString(req.Code)
+	if err != nil {
+		http.Error(w, "code is not base64", http.StatusBadRequest)
+		return
+	}
+
+	ex := Execution{Language: req.Language, Code: string(code), Stdin: req.Stdin}
+	e.mu.Lock()
+	e.executions = append(e.executions, ex)
+	run := e.run
+	e.mu.Unlock()
+
+	result, status := run(ex)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (e *Engine) serveHealth(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	healthy := e.healthy
+	e.mu.Unlock()
+
+	if !healthy {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,197 @@
+// Package servertest runs the whole server in-process against a fake
+// LeetCode and a fake execution engine, with scriptable bots speaking
+// WebSocket or Server-Sent Events for integration tests.
+//
+// The server keeps its rooms in package state, so only one Harness may run
+// at a time: tests using it must not call t.Parallel.
+package servertest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/leetcode/leetcodetest"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
+)
+
+// Harness is a running server with its fake backends
+type Harness struct {
+	*httptest.Server
+	Co       *core.Core
+	LeetCode *leetcodetest.Server
+	Engine   *Engine
+
+	t         testing.TB
+	srv       *server.Server
+	closeOnce sync.Once
+	closed    atomic.Bool
+}
+
+// Start runs a server for the rest of the test. Every configure function may
+// change the configuration before the server starts; by default the server
+// uses the fakes, the repository's templates and no idle room reaper.
+func Start(t testing.TB, configure ...func(*core.Config)) *Harness {
+	t.Helper()
+	h := &Harness{t: t, LeetCode: leetcodetest.NewServer(), Engine: NewEngine()}
+
+	cfg := core.DefaultConfig()
+	cfg.CodeRunnerEngine = h.Engine.URL
+	cfg.LeetcodeURL = h.LeetCode.GraphQLURL()
+	cfg.LeetcodeRate = 1000
+	cfg.TemplateDir = templateDir()
+	cfg.RoomIdleTTL = 0
+	cfg.ShutdownTimeout = 2 * time.Second
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("servertest: invalid config: %v", err)
+	}
+
+	lo := slog.New(slog.NewTextHandler(testWriter{t, &h.closed}, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	h.Co = core.New(cfg, lo)
+	h.srv = &server.Server{Co: h.Co}
+	h.Server = httptest.NewServer(h.srv.Handler())
+	t.Cleanup(h.Close)
+	return h
+}
+
+// Close drains the rooms and stops the server and its fakes. Tests of a
+// restart call it early; later calls do nothing.
+func (h *Harness) Close() {
+	h.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.Co.ShutdownTimeout)
+		defer cancel()
+		h.srv.Drain(ctx)
+		h.Server.Close()
+		h.LeetCode.Close()
+		h.Engine.Close()
+		h.closed.Store(true)
+	})
+}
+
+// templateDir locates the repository's templates from this file
+func templateDir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "..", "templates")
+}
+
+// wsURLAttr finds the socket URL the room page hands to its script
+var wsURLAttr = regexp.MustCompile(`data-ws-url="([^"]+)"`)
+
+// CreateRoom creates a room like the home page does and returns its ID and
+// the socket path with a join token
+func (h *Harness) CreateRoom() (roomID, wsPath string) {
+	h.t.Helper()
+	return h.roomPage("/api/create-room", url.Values{})
+}
+
+// JoinPath asks to join roomID like the join form does and returns the
+// socket path with a join token
+func (h *Harness) JoinPath(roomID string) string {
+	h.t.Helper()
+	_, wsPath := h.roomPage("/api/join-room", url.Values{"room_id": {roomID}})
+	return wsPath
+}
+
+// roomPage posts form to path and reads the socket path from the room page
+func (h *Harness) roomPage(path string, form url.Values) (roomID, wsPath string) {
+	h.t.Helper()
+	resp, err := h.Client().PostForm(h.URL+path, form)
+	if err != nil {
+		h.t.Fatalf("servertest: POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("servertest: POST %s: status %d: %s", path, resp.StatusCode, body)
+	}
+
+	m := wsURLAttr.FindSubmatch(body)
+	if m == nil {
+		h.t.Fatalf("servertest: POST %s: no socket URL in the room page", path)
+	}
+	wsPath = html.UnescapeString(string(m[1]))
+	u, err := url.Parse(wsPath)
+	if err != nil {
+		h.t.Fatalf("servertest: POST %s: bad socket URL %q", path, wsPath)
+	}
+	return u.Query().Get("room_id"), wsPath
+}
+
+// NewRoom creates a room and connects its first bot
+func (h *Harness) NewRoom(capabilities ...string) *Bot {
+	h.t.Helper()
+	_, wsPath := h.CreateRoom()
+	return h.Connect(wsPath, capabilities...)
+}
+
+// Join connects a bot to an existing room through the join form
+func (h *Harness) Join(roomID string, capabilities ...string) *Bot {
+	h.t.Helper()
+	return h.Connect(h.JoinPath(roomID), capabilities...)
+}
+
+// Execute runs code through /api/execute-code in roomID as the member holding
+// the join token and returns the status code and the engine's answer
+func (h *Harness) Execute(roomID, token, language, code, stdin string) (int, Result) {
+	h.t.Helper()
+	payload, _ := json.Marshal(map[string]string{
+		"room_id":  roomID,
+		"language": language,
+		"code":     code,
+		"stdin":    stdin,
+	})
+	req, err := http.NewRequest(http.MethodPost, h.URL+"/api/execute-code", bytes.NewReader(payload))
+	if err != nil {
+		h.t.Fatalf("servertest: execute: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := h.Client().Do(req)
+	if err != nil {
+		h.t.Fatalf("servertest: execute: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result Result
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+// wsURL turns a socket path into an absolute ws:// URL of the server
+func (h *Harness) wsURL(path string) string {
+	return "ws" + strings.TrimPrefix(h.URL, "http") + path
+}
+
+// testWriter sends the server's log lines to the test log until the harness
+// is closed, since goroutines of the server may still log after the test
+type testWriter struct {
+	t      testing.TB
+	closed *atomic.Bool
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	if !w.closed.Load() {
+		w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	}
+	return len(p), nil
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/utils"
+)
+
+var (
+	ErrSnapshotNotFound = fmt.Errorf("snapshot not found")
+	ErrInvalidSnapshot  = fmt.Errorf("invalid snapshot id")
+)
+
+// maxAutoSnapshots caps how many periodic snapshots are kept per room.
+// Named checkpoints are never evicted.
+const maxAutoSnapshots = 50
+
+// Snapshot is a point-in-time copy of the room's code for one language
+type Snapshot struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Language  string    `json:"language"`
+	Code      string    `json:"code,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Auto      bool      `json:"auto"`
+}
+
+// takeSnapshot records the current code state. Caller must hold r.mu.
+func (r *Room) takeSnapshot(name, userID string, auto bool) *Snapshot {
+	r.snapshotSeq++
+	snap := &Snapshot{
+		ID:        r.snapshotSeq,
+		Name:      name,
+		Language:  r.CurrentLanguage,
+		Code:      r.CodeState,
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+		Auto:      auto,
+	}
+	r.Snapshots = append(r.Snapshots, snap)
+	if r.lastSnapshotCode == nil {
+		r.lastSnapshotCode = make(map[string]string)
+	}
+	r.lastSnapshotCode[snap.Language] = snap.Code
+
+	// Evict the oldest periodic snapshot once we are above the cap
+	autoCount := 0
+	for _, s := range r.Snapshots {
+		if s.Auto {
+			autoCount++
+		}
+	}
+	if autoCount > maxAutoSnapshots {
+		for i, s := range r.Snapshots {
+			if s.Auto {
+				r.Snapshots = append(r.Snapshots[:i], r.Snapshots[i+1:]...)
+				break
+			}
+		}
+	}
+	return snap
+}
+
+// autoSnapshot takes a periodic snapshot if the code changed since the last one.
+// Caller must hold r.mu.
+func (r *Room) autoSnapshot() {
+	if r.CodeState == "" {
+		return
+	}
+	if last, ok := r.lastSnapshotCode[r.CurrentLanguage]; ok && last == r.CodeState {
+		return
+	}
+	r.takeSnapshot("", "", true)
+}
+
+// findSnapshot looks up a snapshot by ID. Caller must hold r.mu.
+func (r *Room) findSnapshot(id int) *Snapshot {
+	for _, s := range r.Snapshots {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// snapshotMeta returns a copy of the snapshot without its code body
+func (s *Snapshot) snapshotMeta() Snapshot {
+	meta := *s
+	meta.Code = ""
+	return meta
+}
+
+// handleSnapshotMessage creates a named checkpoint and announces it to the room.
+// Caller must hold r.mu.
+func (r *Room) handleSnapshotMessage(message *WebSocketMessage) {
+	name, _ := message.Content.(string)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = fmt.Sprintf("Checkpoint %d", r.snapshotSeq+1)
+	}
+	snap := r.takeSnapshot(name, message.UserID, false)
+
+	r.fanout(&WebSocketMessage{
+		Type:    TypeSnapshot,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: snap.snapshotMeta(),
+	}, "")
+}
+
+// handleSnapshotRestore replaces the room's code with a snapshot and pushes
+// it to every client, including the one that asked for the restore.
+// Caller must hold r.mu.
+func (r *Room) handleSnapshotRestore(message *WebSocketMessage) {
+	id, ok := intFromContent(message.Content)
+	snap := r.findSnapshot(id)
+	if !ok || snap == nil {
+		r.replyError(message.UserID, ErrSnapshotNotFound)
+		return
+	}
+
+	// Keep the pre-restore state around so the restore itself can be undone
+	r.takeSnapshot(fmt.Sprintf("Before restoring #%d", snap.ID), message.UserID, false)
+
+	r.switchLanguage(snap.Language)
+	oldCode := r.CodeState
+	r.setCode(snap.Code)
+	r.reanchorComments(oldCode)
+
+	r.fanout(&WebSocketMessage{
+		Type:     TypeLanguageChange,
+		RoomID:   r.ID,
+		UserID:   message.UserID,
+		Language: r.CurrentLanguage,
+		Content:  r.CodeState,
+	}, "")
+	r.fanout(&WebSocketMessage{
+		Type:     TypeSnapshotRestore,
+		RoomID:   r.ID,
+		UserID:   message.UserID,
+		Role:     message.Role,
+		Content:  snap.Code,
+		Language: snap.Language,
+	}, "")
+}
+
+// ListSnapshotsHandler returns the snapshot metadata of a room
+func ListSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	room.mu.RLock()
+	snapshots := make([]Snapshot, 0, len(room.Snapshots))
+	for _, s := range room.Snapshots {
+		snapshots = append(snapshots, s.snapshotMeta())
+	}
+	room.mu.RUnlock()
+
+	SendJSONResponse(w, http.StatusOK, snapshots)
+}
+
+// GetSnapshotHandler returns a single snapshot including its code
+func GetSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("snapshot_id"))
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, ErrInvalidSnapshot)
+		return
+	}
+
+	room.mu.RLock()
+	snap := room.findSnapshot(id)
+	var out Snapshot
+	if snap != nil {
+		out = *snap
+	}
+	room.mu.RUnlock()
+
+	if snap == nil {
+		SendErrorResponse(w, http.StatusNotFound, ErrSnapshotNotFound)
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, out)
+}
+
+// DiffSnapshotsHandler returns a unified diff between two snapshots.
+// Use `to=current` to diff against the live code state.
+func DiffSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	fromID, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, ErrInvalidSnapshot)
+		return
+	}
+	to := r.URL.Query().Get("to")
+
+	room.mu.RLock()
+	from := room.findSnapshot(fromID)
+	var toName, toCode string
+	var toFound bool
+	if to == "" || to == "current" {
+		toName, toCode, toFound = "current", room.CodeState, true
+	} else if toID, err := strconv.Atoi(to); err == nil {
+		if s := room.findSnapshot(toID); s != nil {
+			toName, toCode, toFound = fmt.Sprintf("snapshot/%d", s.ID), s.Code, true
+		}
+	}
+	var fromCode string
+	if from != nil {
+		fromCode = from.Code
+	}
+	room.mu.RUnlock()
+
+	if from == nil || !toFound {
+		SendErrorResponse(w, http.StatusNotFound, ErrSnapshotNotFound)
+		return
+	}
+
+	diff, err := utils.UnifiedDiff(fmt.Sprintf("snapshot/%d", fromID), toName, fromCode, toCode)
+	if err != nil {
+		SendErrorResponse(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(diff))
+}
+
+// CreateSnapshotHandler takes an on-demand named checkpoint through the room
+// loop, on behalf of the connected member holding the request's join token
+func CreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	room.mu.RLock()
+	member := room.clientBySubject(requestJoinClaims(r).Subject)
+	room.mu.RUnlock()
+	if member == nil {
+		SendErrorResponse(w, http.StatusForbidden, ErrUserNotHere)
+		return
+	}
+
+	ok = room.Submit(&WebSocketMessage{
+		Type:    TypeSnapshot,
+		RoomID:  room.ID,
+		UserID:  member.UserID,
+		Content: r.FormValue("name"),
+	})
+	if !ok {
+		SendErrorResponse(w, http.StatusGone, ErrRoomClosed)
+		return
+	}
+	SendJSONResponse(w, http.StatusAccepted, "snapshot requested")
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
+)
+
+var (
+	ErrStreamingUnsupported = fmt.Errorf("streaming is not supported by this connection")
+	ErrSessionNotFound      = fmt.Errorf("event stream session not found. reconnect to the room")
+	ErrMessageTooLarge      = fmt.Errorf("message is too large")
+)
+
+const (
+	sseKeepAliveInterval = 25 * time.Second // comment lines keep proxies from closing idle streams
+	sseWriteTimeout      = 10 * time.Second
+)
+
+// sseSessions maps session IDs to the clients of open event streams. The
+// session ID lets the matching POST requests speak for the stream's client.
+var sseSessions = struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}{clients: make(map[string]*Client)}
+
+// sseTransport carries a client over a Server-Sent Events stream for
+// messages to the client and HTTP POSTs for messages from it
+type sseTransport struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (t *sseTransport) Name() string {
+	return "sse"
+}
+
+func (t *sseTransport) Ping() error {
+	return t.ctx.Err()
+}
+
+func (t *sseTransport) Close() error {
+	t.cancel()
+	return nil
+}
+
+// writeEvent writes one event to the stream and flushes it
+func writeEvent(w io.Writer, rc *http.ResponseController, event string, body []byte) error {
+	rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", body); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// HandleEventStream is the fallback for networks that block WebSockets. It
+// streams room messages as Server-Sent Events; the client sends its own
+// messages to HandleEventStreamSend with the session ID of the first event.
+func HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		http.Error(w, "room_id is required", http.StatusBadRequest)
+		return
+	}
+
+	co := r.Context().Value("core").(*core.Core)
+	lo := logger(r).With("room_id", roomID)
+
+	ip := clientIP(r)
+	if status, err := checkRoomAccess(roomID, ip); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	claims, err := verifyJoinToken(co.TokenSecret, r.URL.Query().Get("token"), roomID)
+	if err != nil {
+		lo.Warn("event stream join rejected", "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		http.Error(w, ErrStreamingUnsupported.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	client := newClient(roomID, ip, claims.Subject, &sseTransport{ctx: ctx, cancel: cancel}, lo)
+
+	session := randomSecret(16)
+	sseSessions.mu.Lock()
+	sseSessions.clients[session] = client
+	sseSessions.mu.Unlock()
+
+	client.startHandshake()
+	defer func() {
+		sseSessions.mu.Lock()
+		delete(sseSessions.clients, session)
+		sseSessions.mu.Unlock()
+		client.leave()
+	}()
+
+	hello, _ := json.Marshal(map[string]string{"session": session})
+	if err := writeEvent(w, rc, "session", hello); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.SendChan:
+			if !ok {
+				return
+			}
+			for _, out := range client.translate(message) {
+				data, err := client.encode(out)
+				if err != nil {
+					client.log.Error("error encoding message", "type", out.Type, "err", err)
+					continue
+				}
+				if err := writeEvent(w, rc, "", data); err != nil {
+					return
+				}
+			}
+
+		case <-ticker.C:
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// HandleEventStreamSend accepts one message from an event stream client
+func HandleEventStreamSend(w http.ResponseWriter, r *http.Request) {
+	sseSessions.mu.RLock()
+	client, ok := sseSessions.clients[r.URL.Query().Get("session")]
+	sseSessions.mu.RUnlock()
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrSessionNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		SendErrorResponse(w, http.StatusRequestEntityTooLarge, ErrMessageTooLarge)
+		return
+	}
+	if !client.receive(body) {
+		SendErrorResponse(w, http.StatusGone, ErrRoomClosed)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
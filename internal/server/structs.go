@@ -49,8 +49,7 @@ type ExecuteCodeRequest struct {
 	Language string `json:"language"`
 	Code     string `json:"code"`
 	Stdin    string `json:"stdin"`
-	RoomID   string `json:"room_id"`
-	UserID   string `json:"user_id"`
+	RoomID   string `json:"room_id"` // Output is shared with the room; needs the room's join token
 }
 
 type ExecuteCodeResponse struct {
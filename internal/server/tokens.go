@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinTokenTTL is how long a page may wait before opening its room socket
+const joinTokenTTL = 2 * time.Hour
+
+// WebSocket close codes sent when a join token is rejected
+const (
+	CloseTokenMissing = 4001
+	CloseTokenInvalid = 4002
+	CloseTokenExpired = 4003
+	CloseTokenRoom    = 4004
+)
+
+// JoinTokenError is a rejected join token with the close code to send
+type JoinTokenError struct {
+	Code   int
+	Reason string
+}
+
+func (e *JoinTokenError) Error() string {
+	return e.Reason
+}
+
+var (
+	ErrJoinTokenMissing = &JoinTokenError{CloseTokenMissing, "join token is required"}
+	ErrJoinTokenInvalid = &JoinTokenError{CloseTokenInvalid, "join token is invalid"}
+	ErrJoinTokenExpired = &JoinTokenError{CloseTokenExpired, "join token has expired. please rejoin the room"}
+	ErrJoinTokenRoom    = &JoinTokenError{CloseTokenRoom, "join token was issued for another room"}
+)
+
+// Token types, so a token of one kind is never accepted as another
+const (
+	tokenTypeJoin   = "join"
+	tokenTypeInvite = "invite"
+)
+
+// joinClaims is the signed body of a WebSocket join token. The subject is
+// random per room page and outlives the user ID of any one connection; it is
+// never shown to other members.
+type joinClaims struct {
+	Type    string `json:"typ"`
+	RoomID  string `json:"rid"`
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// signToken encodes claims and signs them with the server secret
+func signToken(secret []byte, claims any) string {
+	body, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks the signature of a token and decodes its claims.
+// It reports false when the token was not signed with secret.
+func verifyToken(secret []byte, token string, claims any) bool {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return false
+	}
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(body, claims) == nil
+}
+
+// issueJoinToken signs a token that lets its holder open a socket into roomID
+func issueJoinToken(secret []byte, roomID string) string {
+	return signToken(secret, joinClaims{
+		Type:    tokenTypeJoin,
+		RoomID:  roomID,
+		Subject: randomSecret(16),
+		Expires: time.Now().Add(joinTokenTTL).Unix(),
+	})
+}
+
+// verifyJoinToken checks a join token against the room being joined and
+// returns its claims
+func verifyJoinToken(secret []byte, token, roomID string) (joinClaims, error) {
+	var claims joinClaims
+	if token == "" {
+		return claims, ErrJoinTokenMissing
+	}
+	if !verifyToken(secret, token, &claims) || claims.Type != tokenTypeJoin || claims.Subject == "" {
+		return claims, ErrJoinTokenInvalid
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, ErrJoinTokenExpired
+	}
+	if claims.RoomID != roomID {
+		return claims, ErrJoinTokenRoom
+	}
+	return claims, nil
+}
+
+// joinWebSocketURL returns the socket URL for a room with a fresh join token
+func joinWebSocketURL(secret []byte, roomID string) string {
+	q := url.Values{}
+	q.Set("room_id", roomID)
+	q.Set("token", issueJoinToken(secret, roomID))
+	return "/ws?" + q.Encode()
+}
+
+// rejectConn closes an upgraded connection with the close code of err
+func rejectConn(conn *websocket.Conn, err *JoinTokenError) {
+	msg := websocket.FormatCloseMessage(err.Code, err.Reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
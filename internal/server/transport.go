@@ -0,0 +1,180 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxMessageSize is the largest message a client may send, on any transport
+const maxMessageSize = 512 * 1024
+
+// Transport is the connection a client is reached through. Room.Run only
+// checks that it is alive; the transport's own goroutines drain SendChan and
+// feed received messages to Client.receive.
+type Transport interface {
+	// Name identifies the transport in logs and room summaries
+	Name() string
+	// Ping reports an error once the client can no longer be reached
+	Ping() error
+	// Close drops the connection
+	Close() error
+}
+
+// wsTransport carries a client over a WebSocket
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) Name() string {
+	return "websocket"
+}
+
+func (t *wsTransport) Ping() error {
+	return t.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+// checkRoomAccess turns away banned addresses and locked rooms before a
+// transport is set up
+func checkRoomAccess(roomID, ip string) (int, error) {
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		return http.StatusOK, nil
+	}
+	if room.IsBanned(ip) {
+		return http.StatusForbidden, ErrBannedUser
+	}
+	if room.IsLocked() {
+		return http.StatusLocked, ErrRoomLocked
+	}
+	return http.StatusOK, nil
+}
+
+// openClients counts clients whose transport is still open
+var openClients atomic.Int64
+
+// newClient creates a client of roomID for the holder of the join token with
+// subject, creating the room on first use. Its log lines extend lo with the
+// user and transport.
+func newClient(roomID, ip, subject string, transport Transport, lo *slog.Logger) *Client {
+	client := &Client{
+		Transport: transport,
+		SendChan:  make(chan *WebSocketMessage, 100),
+		UserID:    generateUserID(),
+		RemoteIP:  ip,
+		JoinedAt:  time.Now(),
+		subject:   subject,
+	}
+	client.protocol.Store(legacyProtocol)
+	openClients.Add(1)
+	client.log = lo.With("user_id", client.UserID, "transport", transport.Name())
+
+	roomManager.mu.Lock()
+	room, exists := roomManager.Rooms[roomID]
+	if !exists {
+		if len(roomManager.Rooms) >= settings.Load().MaxRooms {
+			roomManager.cleanupOldRooms()
+		}
+		room = CreateRoom(roomID)
+		roomManager.Rooms[roomID] = room
+		client.Role = "Author"
+	} else {
+		// Check if there are any existing clients in the room
+		if len(room.Clients) == 0 {
+			client.Role = "Author"
+		} else {
+			client.Role = "Collaborator"
+		}
+	}
+	client.Room = room
+	roomManager.mu.Unlock()
+
+	return client
+}
+
+// startHandshake joins the client as a version 1 client unless it sends a
+// hello within the handshake timeout. Clients that predate the handshake never do.
+func (c *Client) startHandshake() {
+	c.handshake = time.AfterFunc(settings.Load().HandshakeTimeout, c.join)
+}
+
+// leave takes the client out of its room once its transport is gone
+func (c *Client) leave() {
+	defer openClients.Add(-1)
+	c.handshake.Stop()
+	c.flushCode()
+	if c.abandonJoin() {
+		select {
+		case c.Room.Unregister <- c:
+		case <-c.Room.Closed():
+		}
+	}
+}
+
+// receive handles one raw message from the client, whatever transport it came
+// over. It returns false once the room is closed.
+func (c *Client) receive(data []byte) bool {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	msg, err := parseClientMessage(data)
+	if err != nil {
+		messagesReceived.With("invalid").Inc()
+		// Error replies share a bucket so junk floods are not echoed back in full
+		if c.limiter.allow(TypeError) {
+			c.replyError(err)
+		}
+		return true
+	}
+	messagesReceived.With(string(msg.Type)).Inc()
+	msg.UserID = c.UserID
+	msg.Role = c.Role
+	msg.sender = c
+
+	if msg.Type == TypeHello {
+		// A hello is only accepted while the client waits to join
+		if c.joined.Load() || !c.handshake.Stop() {
+			c.replyError(ErrLateHello)
+			return true
+		}
+		c.negotiate(msg)
+		c.join()
+		return true
+	}
+	// A client that starts with anything else speaks version 1 and joins now
+	// rather than at the end of the handshake timeout
+	c.handshake.Stop()
+	c.join()
+
+	if !c.limiter.allow(msg.Type) {
+		socketStats.rateLimited.Add(1)
+		if c.limiter.shouldReply() {
+			c.replyError(ErrRateLimited)
+		}
+		if msg.Type == TypeCode {
+			c.holdCode(msg)
+		}
+		return true
+	}
+
+	// Handle WebRTC signaling messages
+	if msg.Type == TypeOffer || msg.Type == TypeAnswer || msg.Type == TypeIceCandidate {
+		if !c.relaySignal(msg) {
+			c.replyError(ErrUserNotHere)
+		}
+		return true
+	}
+	if msg.Type == TypeCode {
+		return c.submitCode(msg)
+	}
+	// Keep the room's view of the code ahead of anything sent after it
+	c.flushCode()
+	return c.Room.Submit(msg)
+}
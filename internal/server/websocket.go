@@ -3,17 +3,23 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
 )
 
 var (
 	ErrInvalidRoomId = fmt.Errorf("invalid room_id or no room id provided")
+	ErrInvalidTarget = fmt.Errorf("invalid target user")
 )
 
 // MessageType represents different types of WebSocket messages
@@ -34,11 +40,42 @@ const (
 	TypeIceCandidate MessageType = "ice-candidate"
 	// Execution output message type
 	TypeExecutionOutput MessageType = "execution_output"
+	// Snapshot message types
+	TypeSnapshot        MessageType = "snapshot"
+	TypeSnapshotRestore MessageType = "snapshot_restore"
+	// Chat moderation message types
+	TypeChatEdit   MessageType = "chat_edit"
+	TypeChatDelete MessageType = "chat_delete"
+	TypeChatMute   MessageType = "chat_mute"
+	// Cursor and selection presence message type
+	TypePresence MessageType = "presence"
+	// Code review comment message types
+	TypeComment        MessageType = "comment"
+	TypeCommentReply   MessageType = "comment_reply"
+	TypeCommentResolve MessageType = "comment_resolve"
+	TypeCommentMove    MessageType = "comment_move"
+	// Whiteboard message types
+	TypeWhiteboardStroke MessageType = "wb_stroke"
+	TypeWhiteboardShape  MessageType = "wb_shape"
+	TypeWhiteboardErase  MessageType = "wb_erase"
+	TypeWhiteboardClear  MessageType = "wb_clear"
+	// Room ownership and moderation message types
+	TypeKick          MessageType = "kick"
+	TypeBan           MessageType = "ban"
+	TypeRoomLock      MessageType = "room_lock"
+	TypeTransferOwner MessageType = "transfer_owner"
+	TypeOwnerChange   MessageType = "owner_change"
+	// Room lifecycle message types
+	TypeAnnouncement MessageType = "announcement"
+	TypeRoomClosed   MessageType = "room_closed"
 )
 
 type UserInfo struct {
 	UserID string `json:"user_id"`
 	Role   string `json:"role"`
+	Color  string `json:"color,omitempty"`
+	// Transport the user is connected over, only set for admins
+	Transport string `json:"transport,omitempty"`
 }
 
 // WebSocketMessage represents the structure of messages
@@ -51,14 +88,31 @@ type WebSocketMessage struct {
 	QuestionMeta       string      `json:"question_meta,omitempty"`
 	QuestionHints      string      `json:"question_hints,omitempty"`
 	QuestionSnippets   string      `json:"question_snippets,omitempty"`
+	QuestionID         string      `json:"question_id,omitempty"` // Identifies the question HTML
 	UserID             string      `json:"user_id"`
 	Role               string      `json:"role"`
 	ConnectedUsers     []UserInfo  `json:"connected_users,omitempty"`
 	Language           string      `json:"language,omitempty"`
+	// Room ownership state
+	OwnerID    string `json:"owner_id,omitempty"`
+	RoomLocked bool   `json:"room_locked,omitempty"`
+	// Drafts of every language in the room, sent with TypeSync
+	CodeBuffers map[string]string `json:"code_buffers,omitempty"`
+	// Chat history of the room, sent with TypeSync
+	ChatHistory []ChatMessage `json:"chat_history,omitempty"`
+	// Cursor presence of every user, sent with TypeSync
+	Presence []Presence `json:"presence,omitempty"`
+	// Code review threads of the room, sent with TypeSync
+	Comments []CommentThread `json:"comments,omitempty"`
+	// Whiteboard drawing of the room, sent with TypeSync
+	Whiteboard []WhiteboardElement `json:"whiteboard,omitempty"`
 	// WebRTC specific fields
 	TargetUserID string      `json:"target_user_id,omitempty"`
 	SDP          interface{} `json:"sdp,omitempty"`
 	IceCandidate interface{} `json:"ice_candidate,omitempty"`
+
+	codeBase *string // Code a TypeCode message replaces, for code deltas
+	sender   *Client // Client the message came from; nil for server messages
 }
 
 // Room represents a WebSocket room with a maximum of 2 participants
@@ -68,55 +122,135 @@ type Room struct {
 	Broadcast          chan *WebSocketMessage
 	Register           chan *Client
 	Unregister         chan *Client
-	ProblemTitle       string // Current problem title
-	ProblemDescription string // Current problem description
-	QuestionMeta       string // Current question meta HTML
-	QuestionHints      string // Current question hints HTML
-	QuestionSnippets   string // Current question snippets HTML
-	CodeState          string // Current code state
-	CurrentLanguage    string // Current programming language
+	ProblemTitle       string            // Current problem title
+	ProblemDescription string            // Current problem description
+	QuestionMeta       string            // Current question meta HTML
+	QuestionHints      string            // Current question hints HTML
+	QuestionSnippets   string            // Current question snippets HTML
+	QuestionID         string            // Hash of the current question HTML
+	CodeState          string            // Code of the current language
+	CodeBuffers        map[string]string // Code drafts keyed by language
+	CurrentLanguage    string            // Current programming language
+	Snapshots          []*Snapshot
+	Chat               []*ChatMessage
+	Muted              map[string]bool // Join token subjects that may not post chat messages
+	Presence           map[string]*Presence
+	Comments           []*CommentThread
+	Whiteboard         []*WhiteboardElement
+	OwnerID            string          // User who may moderate the room
+	Locked             bool            // Locked rooms accept no new members
+	Banned             map[string]bool // Banned join token subjects and addresses
+	Invites            map[string]*Invite
 	CreatedAt          time.Time
+	LastActiveAt       time.Time // Last join, leave or message
 	mu                 sync.RWMutex
+	done               chan struct{}
+	closeOnce          sync.Once
+
+	snapshotSeq      int
+	lastSnapshotCode map[string]string // Last snapshotted code per language
+	chatSeq          int
+	threadSeq        int
+	commentSeq       int
+	whiteboardSeq    int
+	passcodeHash     string // Empty for public rooms
+	passcodeSalt     string
+
+	log *slog.Logger // Carries the room ID
 }
 
 // Client represents a connected user
 type Client struct {
-	Conn     *websocket.Conn
-	Room     *Room
-	UserID   string
-	Role     string // "Author" or "Collaborator"
-	SendChan chan *WebSocketMessage
+	Transport Transport
+	Room      *Room
+	UserID    string
+	Role      string // "Author" or "Collaborator"
+	Color     string // Cursor color shown to other users
+	RemoteIP  string
+	JoinedAt  time.Time
+	subject   string // Subject of the join token, secret to this client
+	SendChan  chan *WebSocketMessage
+
+	protocol  atomic.Pointer[Protocol] // Negotiated by the hello handshake
+	handshake *time.Timer              // Joins the client if no hello arrives
+	joinOnce  sync.Once
+	joined    atomic.Bool
+	recvMu    sync.Mutex // Serializes messages received from the client
+
+	seenQuestionID string // Last question HTML sent, used by the writer only
+
+	limiter      rateLimiter
+	coalescer    codeCoalescer
+	backlogSince time.Time // When SendChan started to fill up, guarded by Room.mu
+
+	log *slog.Logger // Carries the room, user and request IDs
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     checkOrigin,
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Negotiate permessage-deflate; code and question HTML compress well
+	EnableCompression: true,
+}
+
+// checkOrigin allows same-origin sockets plus the configured allowed origins
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Non-browser clients do not send an Origin
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if co, ok := r.Context().Value("core").(*core.Core); ok {
+		for _, allowed := range co.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+				return true
+			}
+		}
+	}
+	logger(r).Warn("websocket origin rejected", "origin", origin, "host", r.Host)
+	return false
 }
 
 // RoomManager manages all active rooms with cleanup
 type RoomManager struct {
-	Rooms    map[string]*Room
-	mu       sync.RWMutex
-	maxRooms int
+	Rooms map[string]*Room
+	mu    sync.RWMutex
 }
 
 var roomManager = &RoomManager{
-	Rooms:    make(map[string]*Room),
-	maxRooms: 100, // Adjust based on your server capacity
+	Rooms: make(map[string]*Room),
+}
+
+// settings are the room and socket limits of the server, set by
+// Server.Handler before any connection is accepted. The pointer is swapped
+// atomically since sockets of a drained server may still be winding down.
+var settings atomic.Pointer[core.Config]
+
+func init() {
+	defaults := core.DefaultConfig()
+	settings.Store(&defaults)
 }
 
 // CreateRoom creates a new room with improved initialization
 func CreateRoom(roomID string) *Room {
 	room := &Room{
-		ID:         roomID,
-		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan *WebSocketMessage, 100), // Buffered channel
-		Register:   make(chan *Client, 5),
-		Unregister: make(chan *Client, 5),
-		CreatedAt:  time.Now(),
+		ID:           roomID,
+		Clients:      make(map[*Client]bool),
+		Broadcast:    make(chan *WebSocketMessage, 100), // Buffered channel
+		Register:     make(chan *Client, 5),
+		Unregister:   make(chan *Client, 5),
+		CreatedAt:    time.Now(),
+		LastActiveAt: time.Now(),
+		done:         make(chan struct{}),
+		log:          slog.Default().With("room_id", roomID),
 	}
 	go room.Run()
 	return room
@@ -126,177 +260,380 @@ func CreateRoom(roomID string) *Room {
 func (r *Room) Run() {
 	ticker := time.NewTicker(30 * time.Second) // Periodic cleanup
 	defer ticker.Stop()
+	presenceTicker := time.NewTicker(presenceInterval)
+	defer presenceTicker.Stop()
 
 	for {
 		select {
-		case client := <-r.Register:
+		case <-r.done:
 			r.mu.Lock()
-			if len(r.Clients) < 2 {
-				r.Clients[client] = true
-
-				// Get list of existing users
-				var connectedUsers []UserInfo
-				for c := range r.Clients {
-					if c.UserID != client.UserID {
-						connectedUsers = append(connectedUsers, UserInfo{
-							UserID: c.UserID,
-							Role:   c.Role,
-						})
-					}
-				}
-
-				// Send current state to new client
-				syncMsg := &WebSocketMessage{
-					Type:               TypeSync,
-					Content:            r.CodeState,
-					ProblemTitle:       r.ProblemTitle,
-					ProblemDescription: r.ProblemDescription,
-					QuestionMeta:       r.QuestionMeta,
-					QuestionHints:      r.QuestionHints,
-					QuestionSnippets:   r.QuestionSnippets,
-					RoomID:             r.ID,
-					UserID:             client.UserID,
-					Role:               client.Role,
-					ConnectedUsers:     connectedUsers,
-					Language:           r.CurrentLanguage,
-				}
-				client.SendChan <- syncMsg
-
-				// Broadcast join event
-				joinMsg := &WebSocketMessage{
-					Type:   TypeJoin,
-					UserID: client.UserID,
-					Role:   client.Role,
-					RoomID: r.ID,
-				}
-				r.Broadcast <- joinMsg
-			} else {
-				client.SendChan <- &WebSocketMessage{
-					Type:    TypeError,
-					Content: "Room is full",
-				}
-				close(client.SendChan)
-			}
+			r.shutdown()
 			r.mu.Unlock()
+			r.log.Info("room closed")
+			return
+
+		case client := <-r.Register:
+			r.register(client)
 
 		case client := <-r.Unregister:
-			r.mu.Lock()
-			if _, ok := r.Clients[client]; ok {
-				delete(r.Clients, client)
-				close(client.SendChan)
-
-				// Broadcast leave event
-				leaveMsg := &WebSocketMessage{
-					Type:   TypeLeave,
-					UserID: client.UserID,
-					Role:   client.Role,
-					RoomID: r.ID,
-				}
-				r.Broadcast <- leaveMsg
-			}
-			r.mu.Unlock()
+			r.unregister(client)
 
 		case message := <-r.Broadcast:
+			r.dispatch(message)
+
+		case <-presenceTicker.C:
 			r.mu.Lock()
-			if message.Type == TypeCode {
-				r.CodeState = message.Content.(string)
-				// Persist granular question state if present in the message
-				if message.ProblemTitle != "" {
-					r.ProblemTitle = message.ProblemTitle
-				}
-				if message.ProblemDescription != "" {
-					r.ProblemDescription = message.ProblemDescription
-				}
-				if message.QuestionMeta != "" {
-					r.QuestionMeta = message.QuestionMeta
-				}
-				if message.QuestionHints != "" {
-					r.QuestionHints = message.QuestionHints
-				}
-				if message.QuestionSnippets != "" {
-					r.QuestionSnippets = message.QuestionSnippets
-				}
-			} else if message.Type == TypeLanguageChange {
-				r.CurrentLanguage = message.Language
-			}
+			r.flushPresence()
+			r.mu.Unlock()
 
-			for client := range r.Clients {
-				// Don't send code updates or language changes back to the sender
-				if client.UserID == message.UserID && (message.Type == TypeCode || message.Type == TypeLanguageChange) {
-					continue
-				}
+		case <-ticker.C:
+			r.cleanup()
+		}
+	}
+}
 
-				select {
-				case client.SendChan <- message:
-				default:
-					close(client.SendChan)
-					delete(r.Clients, client)
-				}
+// register admits a client into the room or turns it away
+func (r *Room) register(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.recoverPanic("register")
+
+	r.LastActiveAt = time.Now()
+	if r.Locked || r.isBanned(client.subject, client.RemoteIP) {
+		reason := ErrRoomLocked
+		if !r.Locked {
+			reason = ErrBannedUser
+		}
+		r.log.Info("user turned away", "user_id", client.UserID, "reason", reason)
+		client.SendChan <- &WebSocketMessage{
+			Type:    TypeError,
+			Content: reason.Error(),
+		}
+		close(client.SendChan)
+	} else if len(r.Clients) < settings.Load().RoomCapacity {
+		r.Clients[client] = true
+		r.log.Info("user joined", "user_id", client.UserID, "role", client.Role, "transport", client.Transport.Name())
+		if r.OwnerID == "" {
+			r.OwnerID = client.UserID
+		}
+		presence := r.addPresence(client)
+
+		// Get list of existing users
+		var connectedUsers []UserInfo
+		for c := range r.Clients {
+			if c.UserID != client.UserID {
+				connectedUsers = append(connectedUsers, UserInfo{
+					UserID: c.UserID,
+					Role:   c.Role,
+					Color:  c.Color,
+				})
 			}
-			r.mu.Unlock()
+		}
 
-		case <-ticker.C:
-			r.mu.Lock()
-			// Cleanup inactive clients
-			for client := range r.Clients {
-				if err := client.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second)); err != nil {
-					client.Conn.Close()
-					delete(r.Clients, client)
-				}
+		// Send current state to new client
+		syncMsg := &WebSocketMessage{
+			Type:               TypeSync,
+			Content:            r.CodeState,
+			ProblemTitle:       r.ProblemTitle,
+			ProblemDescription: r.ProblemDescription,
+			QuestionMeta:       r.QuestionMeta,
+			QuestionHints:      r.QuestionHints,
+			QuestionSnippets:   r.QuestionSnippets,
+			QuestionID:         r.QuestionID,
+			RoomID:             r.ID,
+			UserID:             client.UserID,
+			Role:               client.Role,
+			ConnectedUsers:     connectedUsers,
+			Language:           r.CurrentLanguage,
+			CodeBuffers:        r.copyCodeBuffers(),
+			ChatHistory:        r.copyChatHistory(),
+			Presence:           r.copyPresence(),
+			Comments:           r.copyComments(),
+			Whiteboard:         r.copyWhiteboard(),
+			OwnerID:            r.OwnerID,
+			RoomLocked:         r.Locked,
+		}
+		client.SendChan <- syncMsg
+
+		// Broadcast join event
+		joinMsg := &WebSocketMessage{
+			Type:    TypeJoin,
+			UserID:  client.UserID,
+			Role:    client.Role,
+			RoomID:  r.ID,
+			Content: *presence,
+		}
+		r.Broadcast <- joinMsg
+	} else {
+		r.log.Info("user turned away", "user_id", client.UserID, "reason", ErrRoomFull)
+		client.SendChan <- &WebSocketMessage{
+			Type:    TypeError,
+			Content: "Room is full",
+		}
+		close(client.SendChan)
+	}
+}
+
+// unregister removes a client that disconnected
+func (r *Room) unregister(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.recoverPanic("unregister")
+
+	r.LastActiveAt = time.Now()
+	delete(r.Presence, client.UserID)
+	if _, ok := r.Clients[client]; ok {
+		delete(r.Clients, client)
+		close(client.SendChan)
+		r.log.Info("user left", "user_id", client.UserID)
+
+		// Broadcast leave event
+		leaveMsg := &WebSocketMessage{
+			Type:   TypeLeave,
+			UserID: client.UserID,
+			Role:   client.Role,
+			RoomID: r.ID,
+		}
+		r.Broadcast <- leaveMsg
+		r.transferOwnershipIfNeeded(client.UserID)
+	}
+}
+
+// dispatch routes a message to the handler of its type
+func (r *Room) dispatch(message *WebSocketMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.recoverPanic(string(message.Type) + " message")
+
+	// Clients kicked, banned or turned away may still have messages queued
+	if message.sender != nil && !r.Clients[message.sender] {
+		return
+	}
+
+	r.LastActiveAt = time.Now()
+	r.touchActivity(message)
+	switch message.Type {
+	case TypeSnapshot:
+		r.handleSnapshotMessage(message)
+	case TypeSnapshotRestore:
+		r.handleSnapshotRestore(message)
+	case TypeLanguageChange:
+		r.handleLanguageChange(message)
+	case TypeChat:
+		r.handleChat(message)
+	case TypeChatEdit:
+		r.handleChatEdit(message)
+	case TypeChatDelete:
+		r.handleChatDelete(message)
+	case TypeChatMute:
+		r.handleChatMute(message)
+	case TypePresence:
+		r.handlePresence(message)
+	case TypeComment:
+		r.handleComment(message)
+	case TypeCommentReply:
+		r.handleCommentReply(message)
+	case TypeCommentResolve:
+		r.handleCommentResolve(message)
+	case TypeWhiteboardStroke, TypeWhiteboardShape:
+		r.handleWhiteboardDraw(message)
+	case TypeWhiteboardErase:
+		r.handleWhiteboardErase(message)
+	case TypeWhiteboardClear:
+		r.handleWhiteboardClear(message)
+	case TypeKick, TypeBan, TypeRoomLock, TypeTransferOwner:
+		r.handleModeration(message)
+	case TypeCodeResync:
+		r.handleCodeResync(message)
+	default:
+		r.handleBroadcast(message)
+	}
+}
+
+// cleanup takes the periodic snapshot and drops clients that stopped answering pings
+func (r *Room) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.recoverPanic("cleanup")
+
+	// Take a periodic snapshot of the code
+	r.autoSnapshot()
+	// Cleanup inactive clients
+	for client := range r.Clients {
+		if err := client.Transport.Ping(); err != nil {
+			client.Transport.Close()
+			delete(r.Clients, client)
+		}
+	}
+}
+
+// handleBroadcast persists the room state carried by a message and fans it
+// out to the other clients. Caller must hold r.mu.
+func (r *Room) handleBroadcast(message *WebSocketMessage) {
+	if message.Type == TypeCode {
+		code, ok := message.Content.(string)
+		if !ok {
+			r.replyError(message.UserID, ErrInvalidContent)
+			return
+		}
+		if lang := normalizeLanguage(message.Language); lang != "" && lang != r.CurrentLanguage {
+			// A late update for a language the room already switched away
+			// from only refreshes that language's draft, and the sender is
+			// told which language the room is in.
+			if _, left := r.CodeBuffers[lang]; left && r.CurrentLanguage != "" {
+				r.CodeBuffers[lang] = code
+				r.sendTo(message.UserID, &WebSocketMessage{
+					Type:     TypeLanguageChange,
+					RoomID:   r.ID,
+					Language: r.CurrentLanguage,
+					Content:  r.CodeState,
+				})
+				return
 			}
-			r.mu.Unlock()
+			r.adoptLanguage(lang, message.UserID)
+		}
+		oldCode := r.CodeState
+		r.setCode(code)
+		r.reanchorComments(oldCode)
+		message.codeBase = &oldCode
+		// Persist granular question state if present in the message
+		message.QuestionID = r.updateQuestion(message)
+	}
+
+	// Don't send code updates or call readiness back to the sender
+	skipUserID := ""
+	switch message.Type {
+	case TypeCode, TypeCallReady, TypeCallEnded:
+		skipUserID = message.UserID
+	}
+	r.fanout(message, skipUserID)
+}
+
+// fanout delivers a message to every client except skipUserID, dropping
+// clients whose send buffer is full. Caller must hold r.mu.
+func (r *Room) fanout(message *WebSocketMessage, skipUserID string) {
+	for client := range r.Clients {
+		if skipUserID != "" && client.UserID == skipUserID {
+			continue
+		}
+
+		r.deliver(client, message)
+	}
+}
+
+// sendTo delivers a message to a single client of the room. Caller must hold r.mu.
+func (r *Room) sendTo(userID string, message *WebSocketMessage) {
+	for client := range r.Clients {
+		if client.UserID == userID {
+			r.deliver(client, message)
+			return
 		}
 	}
 }
 
+// relaySignal forwards a WebRTC signaling message straight to its target.
+// It reports false when the target is not in the room.
+func (c *Client) relaySignal(msg *WebSocketMessage) bool {
+	c.Room.mu.RLock()
+	defer c.Room.mu.RUnlock()
+	target := c.Room.findClient(msg.TargetUserID)
+	if target == nil {
+		return false
+	}
+	select {
+	case target.SendChan <- msg:
+	default:
+	}
+	return true
+}
+
+// decodeContent converts a generic JSON message content into a typed payload
+func decodeContent(content interface{}, v interface{}) error {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// intFromContent reads an integer ID sent as a JSON number or string
+func intFromContent(content interface{}) (int, bool) {
+	switch v := content.(type) {
+	case float64:
+		return int(v), true
+	case string:
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		return id, err == nil
+	}
+	return 0, false
+}
+
+// lookupRoom returns the room registered under roomID
+func lookupRoom(roomID string) (*Room, bool) {
+	roomManager.mu.RLock()
+	defer roomManager.mu.RUnlock()
+	room, exists := roomManager.Rooms[roomID]
+	return room, exists
+}
+
 // HandleWebSocket handles WebSocket connections with improved client handling
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	roomID := r.URL.Query().Get("room_id")
-	log.Println("roomID=", roomID)
 	if roomID == "" {
 		http.Error(w, "room_id is required", http.StatusBadRequest)
 		return
 	}
 
+	co := r.Context().Value("core").(*core.Core)
+	lo := logger(r).With("room_id", roomID)
+
+	ip := clientIP(r)
+	if status, err := checkRoomAccess(roomID, ip); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		lo.Error("websocket upgrade failed", "err", err)
 		return
 	}
 
-	// Create new client with buffered channel
-	client := &Client{
-		Conn:     conn,
-		SendChan: make(chan *WebSocketMessage, 100),
-		UserID:   generateUserID(),
+	// Only pages handed out by the create/join handlers may open a socket
+	claims, err := verifyJoinToken(co.TokenSecret, r.URL.Query().Get("token"), roomID)
+	if err != nil {
+		lo.Warn("websocket join rejected", "err", err)
+		rejectConn(conn, err.(*JoinTokenError))
+		return
 	}
 
-	roomManager.mu.Lock()
-	room, exists := roomManager.Rooms[roomID]
-	if !exists {
-		if len(roomManager.Rooms) >= roomManager.maxRooms {
-			roomManager.cleanupOldRooms()
-		}
-		room = CreateRoom(roomID)
-		roomManager.Rooms[roomID] = room
-		client.Role = "Author"
-	} else {
-		// Check if there are any existing clients in the room
-		if len(room.Clients) == 0 {
-			client.Role = "Author"
-		} else {
-			client.Role = "Collaborator"
-		}
-	}
-	client.Room = room
-	roomManager.mu.Unlock()
+	client := newClient(roomID, ip, claims.Subject, &wsTransport{conn: conn}, lo)
 
-	// Start client message handlers
-	go client.writePump()
-	go client.readPump()
+	// Start client message handlers. The client joins the room once its
+	// hello handshake is done.
+	go client.writePump(conn)
+	go client.readPump(conn)
+}
 
-	// Register client with room
-	room.Register <- client
+// join registers the client with its room. Only the first call has an effect.
+func (c *Client) join() {
+	c.joinOnce.Do(func() {
+		select {
+		case c.Room.Register <- c:
+			c.joined.Store(true)
+		case <-c.Room.Closed():
+			close(c.SendChan)
+		}
+	})
+}
+
+// abandonJoin stops a client that never joined from joining later and
+// reports whether it had joined
+func (c *Client) abandonJoin() bool {
+	c.joinOnce.Do(func() {
+		close(c.SendChan)
+	})
+	return c.joined.Load()
 }
 
 func generateUserID() string {
@@ -304,83 +641,66 @@ func generateUserID() string {
 }
 
 // Client message reading routine
-func (c *Client) readPump() {
+func (c *Client) readPump(conn *websocket.Conn) {
+	c.startHandshake()
 	defer func() {
-		c.Room.Unregister <- c
-		c.Conn.Close()
+		c.leave()
+		conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(512 * 1024) // Limit message size to 512KB
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(settings.Load().PongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(settings.Load().PongWait))
 		return nil
 	})
 
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.log.Warn("socket closed unexpectedly", "err", err)
 			}
 			break
 		}
-
-		var msg WebSocketMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			continue
-		}
-		msg.UserID = c.UserID
-
-		// Handle WebRTC signaling messages
-		if msg.Type == TypeOffer || msg.Type == TypeAnswer || msg.Type == TypeIceCandidate {
-			// Find target client in the room
-			c.Room.mu.RLock()
-			for client := range c.Room.Clients {
-				if client.UserID == msg.TargetUserID {
-					client.SendChan <- &msg
-					break
-				}
-			}
-			c.Room.mu.RUnlock()
-		} else {
-			// Broadcast other messages to all clients in the room
-			c.Room.Broadcast <- &msg
+		if !c.receive(message) {
+			// Room was closed while we were reading
+			break
 		}
 	}
 }
 
 // Client message writing routine
-func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+func (c *Client) writePump(conn *websocket.Conn) {
+	ticker := time.NewTicker(settings.Load().PingInterval)
 	defer func() {
 		ticker.Stop()
-		c.Conn.Close()
+		conn.Close()
 	}()
 
 	for {
 		select {
 		case message, ok := <-c.SendChan:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			conn.SetWriteDeadline(time.Now().Add(settings.Load().WriteTimeout))
 			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-
-			json.NewEncoder(w).Encode(message)
-
-			if err := w.Close(); err != nil {
-				return
+			for _, out := range c.translate(message) {
+				data, err := c.encode(out)
+				if err != nil {
+					c.log.Error("error encoding message", "type", out.Type, "err", err)
+					continue
+				}
+				if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
 			}
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			conn.SetWriteDeadline(time.Now().Add(settings.Load().WriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
@@ -389,10 +709,10 @@ func (c *Client) writePump() {
 
 // Cleanup old rooms to manage server resources
 func (rm *RoomManager) cleanupOldRooms() {
-	threshold := time.Now().Add(-24 * time.Hour)
+	threshold := time.Now().Add(-settings.Load().StaleRoomAge)
 	for id, room := range rm.Rooms {
 		if room.CreatedAt.Before(threshold) && len(room.Clients) == 0 {
-			delete(rm.Rooms, id)
+			rm.removeRoom(id)
 		}
 	}
 }
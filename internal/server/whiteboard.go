@@ -0,0 +1,275 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidShape    = fmt.Errorf("invalid whiteboard element")
+	ErrWhiteboardFull  = fmt.Errorf("whiteboard is full. clear it to keep drawing")
+	ErrElementNotFound = fmt.Errorf("whiteboard element not found")
+	ErrClearForbidden  = fmt.Errorf("only the room owner can clear drawings of others")
+)
+
+const (
+	maxWhiteboardElements = 2000  // elements kept per room
+	maxStrokePoints       = 5000  // points per freehand stroke
+	maxWhiteboardPoints   = 50000 // points of all elements kept per room
+	maxShapeText          = 500   // characters in a text element
+	defaultStrokeColor    = "#111827"
+	defaultStrokeWidth    = 2
+)
+
+// Whiteboard element kinds
+const (
+	ShapeStroke  = "stroke"
+	ShapeLine    = "line"
+	ShapeArrow   = "arrow"
+	ShapeRect    = "rect"
+	ShapeEllipse = "ellipse"
+	ShapeText    = "text"
+)
+
+// colorPattern only allows hex colors so they can be embedded in SVG safely
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+
+// Point is a coordinate on the whiteboard canvas
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// WhiteboardElement is a stroke or shape drawn on the room's whiteboard.
+// Strokes use Points, lines and arrows use the first two Points, and
+// rectangles, ellipses and text use X/Y/Width/Height.
+type WhiteboardElement struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Points      []Point   `json:"points,omitempty"`
+	X           float64   `json:"x,omitempty"`
+	Y           float64   `json:"y,omitempty"`
+	Width       float64   `json:"width,omitempty"`
+	Height      float64   `json:"height,omitempty"`
+	Text        string    `json:"text,omitempty"`
+	Color       string    `json:"color"`
+	StrokeWidth float64   `json:"stroke_width"`
+	UserID      string    `json:"user_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// validate checks the element and fills in defaults
+func (e *WhiteboardElement) validate() error {
+	switch e.Kind {
+	case ShapeStroke:
+		if len(e.Points) == 0 || len(e.Points) > maxStrokePoints {
+			return ErrInvalidShape
+		}
+	case ShapeLine, ShapeArrow:
+		if len(e.Points) != 2 {
+			return ErrInvalidShape
+		}
+	case ShapeRect, ShapeEllipse:
+		if e.Width <= 0 || e.Height <= 0 {
+			return ErrInvalidShape
+		}
+	case ShapeText:
+		if e.Text == "" || len(e.Text) > maxShapeText {
+			return ErrInvalidShape
+		}
+	default:
+		return ErrInvalidShape
+	}
+
+	for _, v := range []float64{e.X, e.Y, e.Width, e.Height, e.StrokeWidth} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrInvalidShape
+		}
+	}
+	if e.Color == "" {
+		e.Color = defaultStrokeColor
+	} else if !colorPattern.MatchString(e.Color) {
+		return ErrInvalidShape
+	}
+	if e.StrokeWidth <= 0 || e.StrokeWidth > 50 {
+		e.StrokeWidth = defaultStrokeWidth
+	}
+	return nil
+}
+
+// copyWhiteboard returns the drawing document of the room. Caller must hold r.mu.
+func (r *Room) copyWhiteboard() []WhiteboardElement {
+	if len(r.Whiteboard) == 0 {
+		return nil
+	}
+	out := make([]WhiteboardElement, 0, len(r.Whiteboard))
+	for _, e := range r.Whiteboard {
+		out = append(out, *e)
+	}
+	return out
+}
+
+// whiteboardPoints counts the points of every element on the board.
+// Caller must hold r.mu.
+func (r *Room) whiteboardPoints() int {
+	n := 0
+	for _, e := range r.Whiteboard {
+		n += len(e.Points)
+	}
+	return n
+}
+
+// handleWhiteboardDraw adds a stroke or shape to the board. Caller must hold r.mu.
+func (r *Room) handleWhiteboardDraw(message *WebSocketMessage) {
+	var element WhiteboardElement
+	if err := decodeContent(message.Content, &element); err != nil {
+		r.replyError(message.UserID, ErrInvalidShape)
+		return
+	}
+	if message.Type == TypeWhiteboardStroke {
+		element.Kind = ShapeStroke
+	}
+	if err := element.validate(); err != nil {
+		r.replyError(message.UserID, err)
+		return
+	}
+	if len(r.Whiteboard) >= maxWhiteboardElements || r.whiteboardPoints()+len(element.Points) > maxWhiteboardPoints {
+		r.replyError(message.UserID, ErrWhiteboardFull)
+		return
+	}
+
+	r.whiteboardSeq++
+	element.ID = r.whiteboardSeq
+	element.UserID = message.UserID
+	element.CreatedAt = time.Now()
+	r.Whiteboard = append(r.Whiteboard, &element)
+
+	r.fanout(&WebSocketMessage{
+		Type:    message.Type,
+		RoomID:  r.ID,
+		UserID:  message.UserID,
+		Role:    message.Role,
+		Content: element,
+	}, "")
+}
+
+// handleWhiteboardErase removes one element from the board. Only the room
+// owner may erase elements drawn by others. Caller must hold r.mu.
+func (r *Room) handleWhiteboardErase(message *WebSocketMessage) {
+	id, ok := intFromContent(message.Content)
+	if !ok {
+		r.replyError(message.UserID, ErrElementNotFound)
+		return
+	}
+	for i, e := range r.Whiteboard {
+		if e.ID == id {
+			if e.UserID != message.UserID && !r.isOwner(message.UserID) {
+				r.replyError(message.UserID, ErrClearForbidden)
+				return
+			}
+			r.Whiteboard = append(r.Whiteboard[:i], r.Whiteboard[i+1:]...)
+			r.fanout(&WebSocketMessage{
+				Type:    TypeWhiteboardErase,
+				RoomID:  r.ID,
+				UserID:  message.UserID,
+				Role:    message.Role,
+				Content: id,
+			}, "")
+			return
+		}
+	}
+	r.replyError(message.UserID, ErrElementNotFound)
+}
+
+// handleWhiteboardClear wipes the board. Only the room owner may wipe
+// elements drawn by others. Caller must hold r.mu.
+func (r *Room) handleWhiteboardClear(message *WebSocketMessage) {
+	if !r.isOwner(message.UserID) {
+		for _, e := range r.Whiteboard {
+			if e.UserID != message.UserID {
+				r.replyError(message.UserID, ErrClearForbidden)
+				return
+			}
+		}
+	}
+	r.Whiteboard = nil
+	r.fanout(&WebSocketMessage{
+		Type:   TypeWhiteboardClear,
+		RoomID: r.ID,
+		UserID: message.UserID,
+		Role:   message.Role,
+	}, "")
+}
+
+// whiteboardSVG renders the elements as a standalone SVG document
+func whiteboardSVG(elements []WhiteboardElement) string {
+	// Fit the view box around everything that was drawn
+	minX, minY, maxX, maxY := 0.0, 0.0, 800.0, 600.0
+	extend := func(x, y float64) {
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	for _, e := range elements {
+		for _, p := range e.Points {
+			extend(p.X, p.Y)
+		}
+		if len(e.Points) == 0 {
+			extend(e.X, e.Y)
+			extend(e.X+e.Width, e.Y+e.Height)
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="%g %g %g %g" width="%g" height="%g">`+"\n",
+		minX, minY, maxX-minX, maxY-minY, maxX-minX, maxY-minY)
+	sb.WriteString(`<defs><marker id="arrowhead" markerWidth="10" markerHeight="7" refX="10" refY="3.5" orient="auto"><polygon points="0 0, 10 3.5, 0 7" fill="context-stroke"/></marker></defs>` + "\n")
+	fmt.Fprintf(&sb, `<rect x="%g" y="%g" width="%g" height="%g" fill="#ffffff"/>`+"\n", minX, minY, maxX-minX, maxY-minY)
+
+	for _, e := range elements {
+		stroke := fmt.Sprintf(`stroke="%s" stroke-width="%g" fill="none"`, e.Color, e.StrokeWidth)
+		switch e.Kind {
+		case ShapeStroke:
+			points := make([]string, 0, len(e.Points))
+			for _, p := range e.Points {
+				points = append(points, fmt.Sprintf("%g,%g", p.X, p.Y))
+			}
+			fmt.Fprintf(&sb, `<polyline points="%s" %s stroke-linecap="round" stroke-linejoin="round"/>`+"\n", strings.Join(points, " "), stroke)
+		case ShapeLine, ShapeArrow:
+			marker := ""
+			if e.Kind == ShapeArrow {
+				marker = ` marker-end="url(#arrowhead)"`
+			}
+			fmt.Fprintf(&sb, `<line x1="%g" y1="%g" x2="%g" y2="%g" %s%s/>`+"\n", e.Points[0].X, e.Points[0].Y, e.Points[1].X, e.Points[1].Y, stroke, marker)
+		case ShapeRect:
+			fmt.Fprintf(&sb, `<rect x="%g" y="%g" width="%g" height="%g" %s/>`+"\n", e.X, e.Y, e.Width, e.Height, stroke)
+		case ShapeEllipse:
+			fmt.Fprintf(&sb, `<ellipse cx="%g" cy="%g" rx="%g" ry="%g" %s/>`+"\n", e.X+e.Width/2, e.Y+e.Height/2, e.Width/2, e.Height/2, stroke)
+		case ShapeText:
+			fmt.Fprintf(&sb, `<text x="%g" y="%g" fill="%s" font-family="sans-serif" font-size="16">%s</text>`+"\n", e.X, e.Y, e.Color, html.EscapeString(e.Text))
+		}
+	}
+	sb.WriteString("</svg>\n")
+	return sb.String()
+}
+
+// ExportWhiteboardHandler exports the room's whiteboard as an SVG image
+func ExportWhiteboardHandler(w http.ResponseWriter, r *http.Request) {
+	room, ok := lookupRoom(r.PathValue("room_id"))
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	room.mu.RLock()
+	elements := room.copyWhiteboard()
+	room.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(whiteboardSVG(elements)))
+}
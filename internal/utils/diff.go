@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change.
+const diffContextLines = 3
+
+// MaxDiffLines bounds the changed lines UnifiedDiff compares on either side,
+// which keeps its time and memory in check for code of any size
+const MaxDiffLines = 5000
+
+var ErrDiffTooLarge = fmt.Errorf("texts differ in too many lines to diff")
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// UnifiedDiff returns a unified diff between two texts, line by line.
+// An empty string is returned when both texts are identical, and
+// ErrDiffTooLarge when more than MaxDiffLines lines changed on either side.
+func UnifiedDiff(fromName, toName, a, b string) (string, error) {
+	if a == b {
+		return "", nil
+	}
+
+	ops, ok := diffLines(SplitLines(a), SplitLines(b), MaxDiffLines)
+	if !ok {
+		return "", ErrDiffTooLarge
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Walk the edit script and emit hunks with surrounding context.
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		start := max(i-diffContextLines, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			// Stop once we see more unchanged lines than two context blocks.
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContextLines {
+				end = min(end+diffContextLines, len(ops))
+				break
+			}
+			end = run
+		}
+
+		aStart, bStart := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+
+		// An empty range names the line before it, like diff -u does
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		i = end
+	}
+
+	return sb.String(), nil
+}
+
+// SplitLines splits a text into its lines. A final newline does not start
+// another line, and an empty text has none.
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes a minimal edit script with Myers' linear space
+// algorithm. Only the lines between the common prefix and suffix are diffed:
+// when they exceed maxChanged on either side, the script replaces them
+// wholesale and diffLines reports false.
+func diffLines(a, b []string, maxChanged int) ([]diffOp, bool) {
+	ops := make([]diffOp, 0, max(len(a), len(b)))
+	prefix := commonPrefix(a, b)
+	suffix := commonSuffix(a[prefix:], b[prefix:])
+	ops = appendOps(ops, ' ', a[:prefix])
+
+	changedA, changedB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	ok := len(changedA) <= maxChanged && len(changedB) <= maxChanged
+	if ok {
+		ops = myers(ops, changedA, changedB)
+	} else {
+		ops = appendOps(ops, '-', changedA)
+		ops = appendOps(ops, '+', changedB)
+	}
+	return appendOps(ops, ' ', a[len(a)-suffix:]), ok
+}
+
+// myers appends the edit script from a to b to ops. It splits the problem at
+// the middle snake of a shortest edit path, so it needs linear space.
+func myers(ops []diffOp, a, b []string) []diffOp {
+	prefix := commonPrefix(a, b)
+	ops = appendOps(ops, ' ', a[:prefix])
+	a, b = a[prefix:], b[prefix:]
+	suffix := commonSuffix(a, b)
+	tail := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		ops = appendOps(ops, '+', b)
+	case len(b) == 0:
+		ops = appendOps(ops, '-', a)
+	default:
+		x, y, u, v := middleSnake(a, b)
+		ops = myers(ops, a[:x], b[:y])
+		ops = appendOps(ops, ' ', a[x:u])
+		ops = myers(ops, a[u:], b[v:])
+	}
+	return appendOps(ops, ' ', tail)
+}
+
+// middleSnake finds the snake in the middle of a shortest edit path from a
+// to b by searching forward from the start and backward from the end at
+// once. The snake runs from a[x], b[y] to a[u], b[v]. a and b must differ
+// in their first and last lines.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	dmax := (n + m + 1) / 2
+	off := dmax + 1
+	// forward[off+k] is the furthest x reached on diagonal k = x-y from the
+	// start, backward[off+c] the furthest reached from the end on c = delta-k
+	forward := make([]int, 2*off+1)
+	backward := make([]int, 2*off+1)
+
+	for d := 0; d <= dmax; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x0 int
+			if k == -d || (k != d && forward[off+k-1] < forward[off+k+1]) {
+				x0 = forward[off+k+1]
+			} else {
+				x0 = forward[off+k-1] + 1
+			}
+			x1 := x0
+			for x1 < n && x1-k < m && a[x1] == b[x1-k] {
+				x1++
+			}
+			forward[off+k] = x1
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x1+backward[off+c] >= n {
+				return x0, x0 - k, x1, x1 - k
+			}
+		}
+		for c := -d; c <= d; c += 2 {
+			var x0 int
+			if c == -d || (c != d && backward[off+c-1] < backward[off+c+1]) {
+				x0 = backward[off+c+1]
+			} else {
+				x0 = backward[off+c-1] + 1
+			}
+			x1 := x0
+			for x1 < n && x1-c < m && a[n-1-x1] == b[m-1-(x1-c)] {
+				x1++
+			}
+			backward[off+c] = x1
+			if k := delta - c; !odd && k >= -d && k <= d && forward[off+k]+x1 >= n {
+				return n - x1, m - (x1 - c), n - x0, m - (x0 - c)
+			}
+		}
+	}
+	panic("utils: no middle snake between different texts")
+}
+
+func commonPrefix(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func commonSuffix(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[len(a)-1-i] == b[len(b)-1-i] {
+		i++
+	}
+	return i
+}
+
+func appendOps(ops []diffOp, kind byte, lines []string) []diffOp {
+	for _, line := range lines {
+		ops = append(ops, diffOp{kind, line})
+	}
+	return ops
+}
+
+// LineMapping maps every line of a to its index in b after the edit,
+// or -1 when the line was removed or changed. Changed regions of more than
+// maxChanged lines are not diffed: all their lines map to -1.
+func LineMapping(a, b string, maxChanged int) []int {
+	ops, _ := diffLines(SplitLines(a), SplitLines(b), maxChanged)
+	mapping := make([]int, 0, len(ops))
+	j := 0
+	for _, op := range ops {
+		switch op.kind {
+		case ' ':
+			mapping = append(mapping, j)
+			j++
+		case '-':
+			mapping = append(mapping, -1)
+		case '+':
+			j++
+		}
+	}
+	return mapping
+}
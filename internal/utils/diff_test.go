@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "identical",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "both empty",
+			want: "",
+		},
+		{
+			name: "from empty",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "to empty",
+			a:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "insert",
+			a:    "a\nb\nc\n",
+			b:    "a\nb\nx\nc\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,4 @@\n a\n b\n+x\n c\n",
+		},
+		{
+			name: "delete",
+			a:    "a\nb\nc\n",
+			b:    "a\nc\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,2 @@\n a\n-b\n c\n",
+		},
+		{
+			name: "change",
+			a:    "a\nb\nc\n",
+			b:    "a\nx\nc\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			name: "moved block",
+			a:    "a\nb\nc\nd\ne\n",
+			b:    "d\ne\na\nb\nc\n",
+			want: "--- a\n+++ b\n@@ -1,5 +1,5 @@\n+d\n+e\n a\n b\n c\n-d\n-e\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnifiedDiff("a", "b", tt.a, tt.b)
+			if err != nil {
+				t.Fatalf("UnifiedDiff: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("UnifiedDiff =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffTooLarge(t *testing.T) {
+	var a, b strings.Builder
+	for i := range MaxDiffLines + 1 {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+	if _, err := UnifiedDiff("a", "b", a.String(), b.String()); !errors.Is(err, ErrDiffTooLarge) {
+		t.Fatalf("UnifiedDiff error = %v, want %v", err, ErrDiffTooLarge)
+	}
+
+	// The same lines around a small change are fine
+	code := a.String()
+	if _, err := UnifiedDiff("a", "b", code, "x\n"+code); err != nil {
+		t.Fatalf("UnifiedDiff of an insert into large code: %v", err)
+	}
+}
+
+func TestLineMapping(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       string
+		maxChanged int
+		want       []int
+	}{
+		{
+			name: "empty",
+			want: []int{},
+		},
+		{
+			name: "to empty",
+			a:    "a\nb",
+			want: []int{-1, -1},
+		},
+		{
+			name: "from empty",
+			b:    "a\nb",
+			want: []int{},
+		},
+		{
+			name: "insert shifts the lines below",
+			a:    "a\nb\nc",
+			b:    "x\na\nb\nc",
+			want: []int{1, 2, 3},
+		},
+		{
+			name: "delete shifts the lines below",
+			a:    "a\nb\nc\nd",
+			b:    "a\nd",
+			want: []int{0, -1, -1, 1},
+		},
+		{
+			name: "changed line",
+			a:    "a\nb\nc",
+			b:    "a\nx\nc",
+			want: []int{0, -1, 2},
+		},
+		{
+			name: "moved block",
+			a:    "a\nb\nc\nd\ne",
+			b:    "d\ne\na\nb\nc",
+			want: []int{2, 3, 4, -1, -1},
+		},
+		{
+			name:       "changed region over the budget",
+			a:          "a\nb\nc\nd\ne",
+			b:          "a\nc\nb\ne",
+			maxChanged: 2,
+			want:       []int{0, -1, -1, -1, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxChanged := tt.maxChanged
+			if maxChanged == 0 {
+				maxChanged = MaxDiffLines
+			}
+			if got := LineMapping(tt.a, tt.b, maxChanged); !slices.Equal(got, tt.want) {
+				t.Errorf("LineMapping = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDiffLinesMinimal checks the edit scripts of random texts against the
+// longest common subsequence of a quadratic table
+func TestDiffLinesMinimal(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomLines := func() []string {
+		lines := make([]string, rng.IntN(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.IntN(4)))
+		}
+		return lines
+	}
+
+	for range 2000 {
+		a, b := randomLines(), randomLines()
+		ops, ok := diffLines(a, b, MaxDiffLines)
+		if !ok {
+			t.Fatalf("diffLines(%q, %q) reported too large", a, b)
+		}
+
+		var from, to []string
+		kept := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				from = append(from, op.line)
+			}
+			if op.kind != '-' {
+				to = append(to, op.line)
+			}
+			if op.kind == ' ' {
+				kept++
+			}
+		}
+		if !slices.Equal(from, a) || !slices.Equal(to, b) {
+			t.Fatalf("diffLines(%q, %q) = %q does not turn one into the other", a, b, ops)
+		}
+		if want := lcsLength(a, b); kept != want {
+			t.Fatalf("diffLines(%q, %q) keeps %d lines, want %d", a, b, kept, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table[0][0]
+}
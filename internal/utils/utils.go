@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 // GetStringFromEnv to read string value from environment
@@ -30,3 +31,18 @@ func GetNumberFromEnv(key string, fallback int) int {
 	log.Printf("reading key=%s from os environment not found. returning fallback value\n", key)
 	return fallback
 }
+
+// GetDurationFromEnv to read a duration value such as "30m" from environment
+func GetDurationFromEnv(key string, fallback time.Duration) time.Duration {
+	if val, found := os.LookupEnv(key); found {
+		log.Printf("reading key=%s from os environment found", key)
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			log.Printf("something went wrong in reading %s key\n", key)
+			return fallback
+		}
+		return d
+	}
+	log.Printf("reading key=%s from os environment not found. returning fallback value\n", key)
+	return fallback
+}
@@ -1,25 +1,56 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/core"
 	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/server"
-	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/utils"
+	"github.com/sounishnath003/practice-leetcode-multiplayer/internal/tracing"
 )
 
 func main() {
 
-	co := core.Core{
-		Port:             utils.GetNumberFromEnv("PORT", 3000),
-		CodeRunnerEngine: utils.GetStringFromEnv("CODE_RUNNER_ENGINE_API", "http://localhost:8080"),
-		Lo:               log.Default(),
+	cfg, err := core.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
+	// Every package logs through the configured logger, including the log package
+	lo := core.NewLogger(cfg, os.Stderr)
+	slog.SetDefault(lo)
+	lo.Info("effective config", "config", cfg)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		lo.Error("failed to set up tracing", "err", err)
+		os.Exit(1)
 	}
 
+	// SIGTERM is what Cloud Run and most orchestrators send before a redeploy
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Init the server
 	srv := server.Server{
-		Co: &co,
+		Co: core.New(cfg, lo),
 	}
 
-	panic(srv.StartServer())
+	err = srv.StartServer(ctx)
+	if err := shutdownTracing(context.Background()); err != nil {
+		lo.Error("failed to flush traces", "err", err)
+	}
+	if err != nil {
+		lo.Error("server stopped with an error", "err", err)
+		os.Exit(1)
+	}
 }
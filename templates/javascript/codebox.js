@@ -88,7 +88,9 @@ function setupRunCode() {
             const language = languageSelect ? languageSelect.value : 'python'; 
             const input = testcasesArea ? testcasesArea.value : '';
             const roomId = document.querySelector("span#roomId")?.textContent.trim() || "";
-            const userId = window.wssClient?.user_id || "";
+            // Sharing the output with the room takes the join token of the room's page
+            const wsUrl = document.querySelector("span#roomId")?.dataset.wsUrl;
+            const joinToken = wsUrl ? new URL(wsUrl, window.location.href).searchParams.get("token") : null;
 
             console.log(`Executing ${language} code...`);
 
@@ -107,14 +109,14 @@ function setupRunCode() {
                 const response = await fetch('/api/execute-code', {
                     method: 'POST',
                     headers: {
-                        'Content-Type': 'application/json'
+                        'Content-Type': 'application/json',
+                        ...(joinToken && { 'Authorization': `Bearer ${joinToken}` })
                     },
                     body: JSON.stringify({
                         language: language,
                         code: code,
                         stdin: input,
-                        room_id: roomId,
-                        user_id: userId
+                        room_id: roomId
                     })
                 });
 
@@ -0,0 +1,91 @@
+// RoomSocket looks like a WebSocket to the rest of the page. It connects over
+// a WebSocket and, when that cannot be opened (e.g. a proxy blocks it), falls
+// back to Server-Sent Events for receiving and HTTP POST for sending.
+class RoomSocket {
+    constructor(wsPath) {
+        this.wsPath = wsPath;
+        this.readyState = WebSocket.CONNECTING;
+        this.transport = 'websocket';
+        this.listeners = { open: [], message: [], close: [], error: [] };
+        this.session = null;
+        this.sendQueue = Promise.resolve(); // POSTs go out one at a time to keep messages in order
+        this.#connectWebSocket();
+    }
+
+    addEventListener(type, listener) {
+        (this.listeners[type] || (this.listeners[type] = [])).push(listener);
+    }
+
+    #emit(type, event) {
+        (this.listeners[type] || []).forEach(listener => listener(event));
+    }
+
+    #connectWebSocket() {
+        const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
+        const ws = new WebSocket(`${protocol}://${window.location.host}${this.wsPath}`);
+        let opened = false;
+        this.ws = ws;
+
+        ws.addEventListener('open', (e) => {
+            opened = true;
+            this.readyState = WebSocket.OPEN;
+            this.#emit('open', e);
+        });
+        ws.addEventListener('message', (e) => this.#emit('message', e));
+        ws.addEventListener('close', (e) => {
+            if (!opened) {
+                // The socket never opened, so try the event stream instead
+                console.warn('WebSocket unavailable, falling back to Server-Sent Events');
+                this.#connectEventStream();
+                return;
+            }
+            this.readyState = WebSocket.CLOSED;
+            this.#emit('close', e);
+        });
+    }
+
+    #connectEventStream() {
+        this.transport = 'sse';
+        this.ws = null;
+        const es = new EventSource(this.wsPath.replace(/^\/ws/, '/sse'));
+        this.es = es;
+
+        es.addEventListener('session', (e) => {
+            this.session = JSON.parse(e.data).session;
+            this.readyState = WebSocket.OPEN;
+            this.#emit('open', e);
+        });
+        es.addEventListener('message', (e) => this.#emit('message', e));
+        es.addEventListener('error', () => {
+            // A new stream would be a new room member, so do not let it reconnect
+            es.close();
+            this.readyState = WebSocket.CLOSED;
+            this.#emit('close', { code: 1006, reason: '' });
+        });
+    }
+
+    send(data) {
+        if (this.readyState !== WebSocket.OPEN) return;
+        if (this.ws) {
+            this.ws.send(data);
+            return;
+        }
+        const url = `/sse/send?session=${encodeURIComponent(this.session)}`;
+        this.sendQueue = this.sendQueue
+            .then(() => fetch(url, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: data
+            }))
+            .catch(err => console.error('Failed to send message:', err));
+    }
+
+    close() {
+        this.readyState = WebSocket.CLOSED;
+        if (this.ws) this.ws.close();
+        if (this.es) {
+            this.es.close();
+            this.#emit('close', { code: 1000, reason: '' });
+        }
+    }
+}
@@ -205,13 +205,30 @@ function codeboxInit(language, cachedContent) {
     return currentEditor;
 }
 
+// Protocol version and features this page renders. Chat, comments and the
+// whiteboard have no UI here yet, so the server does not send them.
+const PROTOCOL_VERSION = 2;
+const PROTOCOL_CAPABILITIES = ['call', 'code_buffers', 'snapshots', 'presence', 'moderation', 'code_delta', 'compact', 'question_ref'];
+
+// textHash is 32-bit FNV-1a over the UTF-16 code units of a string, matching the server
+function textHash(text) {
+    let h = 2166136261;
+    for (let i = 0; i < text.length; i++) {
+        h ^= text.charCodeAt(i);
+        h = Math.imul(h, 16777619) >>> 0;
+    }
+    return h;
+}
+
 class WebSocketClient {
     constructor(roomId, editor, onLanguageChange) {
         this.roomId = roomId;
         this.editor = editor;
         this.onLanguageChange = onLanguageChange;
-        const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-        this.wss = new WebSocket(`${protocol}://${window.location.host}/ws?room_id=${roomId}`);
+        // The server renders the socket URL with the join token of the room
+        const roomIdEl = document.querySelector('span#roomId');
+        const wsPath = (roomIdEl && roomIdEl.dataset.wsUrl) || `/ws?room_id=${roomId}`;
+        this.wss = new RoomSocket(wsPath);
         this.user_id = undefined;
         this.role = undefined;
         this.roomUsers = new Map(); // Track users in the room
@@ -239,6 +256,14 @@ class WebSocketClient {
 
         this.wss.addEventListener('open', (e) => {
             console.log('WebSocket connection opened:', e);
+            // Declare our protocol version before the server sends the room state
+            this.wss.send(JSON.stringify({
+                type: 'hello',
+                content: {
+                    version: PROTOCOL_VERSION,
+                    capabilities: PROTOCOL_CAPABILITIES
+                }
+            }));
         });
 
         this.wss.addEventListener('message', (e) => {
@@ -250,7 +275,9 @@ class WebSocketClient {
                 this.webrtcHandler.handleMessage(message);
             }
 
-            if (message.type === 'join') {
+            if (message.type === 'hello') {
+                this.protocol = message.content;
+            } else if (message.type === 'join') {
                 // Add user to room users map
                 this.roomUsers.set(message.user_id, {
                     role: message.role,
@@ -270,8 +297,13 @@ class WebSocketClient {
                     this.webrtcHandler.disconnect();
                 }
             } else if (message.type === 'language_change') {
+                // The server answers every language change with the room's draft for that language
                 if (this.onLanguageChange) {
-                    this.onLanguageChange(message.language);
+                    this.onLanguageChange(message.language, message.content);
+                }
+                // Nobody has written in this language yet: seed the room buffer with our stub
+                if (!message.content && message.user_id === this.user_id) {
+                    this.#sendCode(this.editor.getValue());
                 }
             } else if (message.type === 'call_ready') {
                 this.remoteCallReady = true;
@@ -280,11 +312,30 @@ class WebSocketClient {
             } else if (message.type === 'call_ended') {
                 this.endCall(false); // End local call without notifying peer back
                 this.showNotification(`${message.role} ended the call`, 'info');
-            } else if (message.type === 'code') {
+            } else if (message.type === 'kick' || message.type === 'ban') {
+                this.showNotification(message.type === 'ban' ? 'You were banned from this room' : 'You were removed from this room', 'error');
+            } else if (message.type === 'owner_change') {
+                this.ownerId = message.owner_id;
+                if (message.owner_id === this.user_id) {
+                    this.showNotification('You are now the room owner', 'info');
+                }
+            } else if (message.type === 'room_lock') {
+                this.showNotification(message.content ? 'Room locked' : 'Room unlocked', 'info');
+            } else if (message.type === 'error') {
+                this.showNotification(message.content, 'error');
+            } else if (message.type === 'backpressure') {
+                this.showNotification(message.content || 'Your connection could not keep up with the room', 'warning');
+            } else if (message.type === 'presence') {
+                this.renderRemoteCursor(message.content);
+            } else if (message.type === 'snapshot') {
+                const name = message.content && message.content.name;
+                this.showNotification(`Checkpoint saved: ${name}`, 'success');
+            } else if (message.type === 'code' || message.type === 'snapshot_restore') {
                 // Update editor content without triggering change event
                 const currentCursor = this.editor.getCursor();
                 const oldContent = this.editor.getValue();
-                const newContent = message.content;
+                // Compact messages leave out empty fields, so cleared code may come without content
+                const newContent = message.content ?? '';
                 
                 this.editor.setValue(newContent);
                 this.editor.setCursor(currentCursor);
@@ -306,16 +357,22 @@ class WebSocketClient {
                         }
                     });
                 }
+            } else if (message.type === 'code_delta') {
+                this.applyCodeDelta(message.content);
             } else if (message.type === 'sync') {
                 // Set identity from sync message
                 this.user_id = message.user_id;
                 this.role = message.role;
+                this.ownerId = message.owner_id;
 
                 // Sync initial state
                 this.initializeWebRTC(); // Ensure WebRTC is ready for late joiners
 
+                if (message.code_buffers && this.onCodeBuffers) {
+                    this.onCodeBuffers(message.code_buffers);
+                }
                 if (message.language && this.onLanguageChange) {
-                    this.onLanguageChange(message.language);
+                    this.onLanguageChange(message.language, message.content);
                 }
                 if (message.content) {
                     this.editor.setValue(message.content);
@@ -372,8 +429,10 @@ class WebSocketClient {
             if (message.question_snippets) this.updateQuestionSnippets(message.question_snippets);
         });
 
-        this.wss.addEventListener('close', () => {
-            this.showNotification('WebSocket connection closed.', 'error');
+        this.wss.addEventListener('close', (e) => {
+            // Codes 4000+ carry the server's reason, e.g. an expired join token
+            const reason = e.code >= 4000 && e.reason ? e.reason : 'WebSocket connection closed.';
+            this.showNotification(reason, 'error');
             if (this.webrtcHandler) {
                 this.webrtcHandler.disconnect();
             }
@@ -381,11 +440,12 @@ class WebSocketClient {
 
         // Handle editor changes
         this.editor.on('change', (cm, change) => {
-            if (change.origin !== 'setValue') {
+            if (change.origin !== 'setValue' && change.origin !== 'remote') {
                 const content = cm.getValue();
                 this.#sendCode(content);
             }
         });
+        this.editor.on('cursorActivity', (cm) => this.#sendPresence(cm));
 
         // Create audio controls
         this.createAudioControls();
@@ -420,11 +480,12 @@ class WebSocketClient {
     updateEditor(newEditor) {
         this.editor = newEditor;
         this.editor.on('change', (cm, change) => {
-            if (change.origin !== 'setValue') {
+            if (change.origin !== 'setValue' && change.origin !== 'remote') {
                 const content = cm.getValue();
                 this.#sendCode(content);
             }
         });
+        this.editor.on('cursorActivity', (cm) => this.#sendPresence(cm));
     }
 
     createNotificationContainer() {
@@ -477,6 +538,39 @@ class WebSocketClient {
         }
     }
 
+    // Cursor updates are throttled here and again on the server
+    #sendPresence(cm) {
+        const now = Date.now();
+        if (this.wss.readyState !== WebSocket.OPEN || now - (this.lastPresenceAt || 0) < 100) return;
+        this.lastPresenceAt = now;
+
+        this.wss.send(JSON.stringify({
+            type: 'presence',
+            room_id: this.roomId,
+            content: {
+                cursor: cm.getCursor(),
+                selections: cm.listSelections().map(s => ({
+                    anchor: { line: s.anchor.line, ch: s.anchor.ch },
+                    head: { line: s.head.line, ch: s.head.ch },
+                })),
+            },
+        }));
+    }
+
+    renderRemoteCursor(presence) {
+        if (!presence || !presence.cursor || !this.editor) return;
+        this.remoteCursors = this.remoteCursors || new Map();
+
+        const previous = this.remoteCursors.get(presence.user_id);
+        if (previous) previous.clear();
+
+        const marker = document.createElement('span');
+        marker.className = 'remote-cursor';
+        marker.style.borderLeftColor = presence.color;
+        marker.title = presence.status;
+        this.remoteCursors.set(presence.user_id, this.editor.setBookmark(presence.cursor, { widget: marker }));
+    }
+
     #sendCode(content) {
         if (this.wss.readyState === WebSocket.OPEN && !this.isRemoteUpdate) {
             const message = {
@@ -484,16 +578,47 @@ class WebSocketClient {
                 room_id: this.roomId,
                 content: content,
                 user_id: this.user_id,
+                language: this.getLanguage(),
+            };
+            const question = {
                 problem_title: this.getProblemTitle(),
                 problem_description: this.getProblemDescription(),
                 question_meta: this.getQuestionMeta(),
                 question_hints: this.getQuestionHints(),
                 question_snippets: this.getQuestionSnippets(),
             };
+            // The server remembers the question, so only send it when it changed
+            const questionKey = Object.values(question).join('\u0000');
+            if (!this.hasCapability('question_ref') || questionKey !== this.lastSentQuestion) {
+                Object.assign(message, question);
+                this.lastSentQuestion = questionKey;
+            }
             this.wss.send(JSON.stringify(message));
         }
     }
 
+    hasCapability(capability) {
+        return !!(this.protocol && this.protocol.capabilities.includes(capability));
+    }
+
+    // Applies a code_delta splice, asking for the whole buffer if our text drifted
+    applyCodeDelta(delta) {
+        const text = this.editor.getValue();
+        if (textHash(text) !== delta.base_hash) {
+            this.wss.send(JSON.stringify({ type: 'code_resync', room_id: this.roomId }));
+            return;
+        }
+        const from = this.editor.posFromIndex(delta.start);
+        const to = this.editor.posFromIndex(delta.start + delta.delete);
+        this.editor.replaceRange(delta.insert, from, to, 'remote');
+    }
+
+    getLanguage() {
+        const el = document.querySelector('#programmingLanguages');
+        if (!el || el.value === 'select language') return '';
+        return el.value.toLowerCase();
+    }
+
     getProblemTitle() {
         const el = document.querySelector("#questionTitle");
         return el ? el.innerHTML : "";
@@ -797,14 +922,17 @@ function runWebsocketProcess() {
     // Initialize with the default language
     let codeEditor = codeboxInit();
 
-    // Callback for remote language changes
-    const onRemoteLanguageChange = (newLanguage) => {
+    // Callback for language changes confirmed by the server, which owns the per-language drafts
+    const onRemoteLanguageChange = (newLanguage, content) => {
         const normalizedLanguage = newLanguage.toLowerCase();
 
         // Save current code before switching
         if (codeEditor) {
             codeCache.set(lastLanguage, codeEditor.getValue());
         }
+        if (content) {
+            codeCache.set(normalizedLanguage, content);
+        }
 
         if (languageSelector.value.toLowerCase() !== normalizedLanguage) {
             // Find and select the matching option case-insensitively
@@ -814,18 +942,23 @@ function runWebsocketProcess() {
                     break;
                 }
             }
-
-            // Update tracking and init editor with cached code
-            lastLanguage = normalizedLanguage;
-            codeEditor = codeboxInit(normalizedLanguage, codeCache.get(normalizedLanguage));
-            wss.updateEditor(codeEditor);
         }
+
+        // Update tracking and init editor with the room's draft or boilerplate
+        lastLanguage = normalizedLanguage;
+        codeEditor = codeboxInit(normalizedLanguage, codeCache.get(normalizedLanguage));
+        wss.updateEditor(codeEditor);
     };
 
     // Initialize WebSocket connection
     let wss = new WebSocketClient(roomId, codeEditor, onRemoteLanguageChange);
     window.wssClient = wss;
 
+    // Late joiners receive every language draft of the room
+    wss.onCodeBuffers = (buffers) => {
+        Object.entries(buffers).forEach(([lang, code]) => codeCache.set(lang, code));
+    };
+
     // Listen for HTMX swaps to re-initialize editor with new question boilerplate
     document.body.addEventListener('htmx:afterSwap', (event) => {
         // Only trigger if the question block was swapped
@@ -847,7 +980,7 @@ function runWebsocketProcess() {
         }
     });
 
-    // Reload the code editor and WebSocket connection when the programming language changes
+    // Ask the server to switch the room's language; its reply loads the matching draft
     languageSelector.addEventListener('change', (event) => {
         const selectedLanguage = event.target.value.toLowerCase();
 
@@ -857,29 +990,10 @@ function runWebsocketProcess() {
         }
 
         // Notify peers about language change
-        wss.sendLanguageChange(selectedLanguage);
-
-        // Update tracking and reinitialize the editor with cached code or boilerplate
-        lastLanguage = selectedLanguage;
-        codeEditor = codeboxInit(selectedLanguage, codeCache.get(selectedLanguage));
-
-        // Update the editor reference in the WebSocket client
-        wss.updateEditor(codeEditor);
-
-        // Send a sync message to update the code in the room
         if (wss.wss.readyState === WebSocket.OPEN) {
-            const message = {
-                type: 'code',
-                room_id: roomId,
-                content: codeEditor.getValue(),
-                user_id: wss.user_id,
-                problem_title: wss.getProblemTitle(),
-                problem_description: wss.getProblemDescription(),
-                question_meta: wss.getQuestionMeta(),
-                question_hints: wss.getQuestionHints(),
-                question_snippets: wss.getQuestionSnippets(),
-            };
-            wss.wss.send(JSON.stringify(message));
+            wss.sendLanguageChange(selectedLanguage);
+        } else {
+            onRemoteLanguageChange(selectedLanguage);
         }
     });
 }